@@ -26,6 +26,8 @@ import (
 	"github.com/spf13/viper"
 
 	log "github.com/uthng/golog"
+
+	"github.com/uthng/container-injector/sidecar"
 )
 
 var cfgFile string
@@ -59,6 +61,16 @@ func init() {
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.container-injector.yaml)")
 	rootCmd.PersistentFlags().IntVar(&verbosity, "verbosity", log.INFO, "Log level. Default: INFO")
+	rootCmd.PersistentFlags().String("annotation-prefix", sidecar.DefaultAnnotationPrefix, "Prefix of the annotations managed by the injector")
+	rootCmd.PersistentFlags().StringSlice("legacy-annotation-prefixes", nil, "Other annotation prefixes still accepted in pods")
+
+	// Flags can also be set in the configuration file
+	for _, name := range []string{"annotation-prefix", "legacy-annotation-prefixes"} {
+		if err := viper.BindPFlag(name, rootCmd.PersistentFlags().Lookup(name)); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
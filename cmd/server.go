@@ -23,18 +23,32 @@ import (
 	"syscall"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
 
 	log "github.com/uthng/golog"
 
 	"github.com/uthng/container-injector/server/http"
+	"github.com/uthng/container-injector/sidecar"
 )
 
 var (
 	serverAddr     string
 	serverCertFile string
 	serverKeyFile  string
+	kubeconfig     string
 )
 
+// profileConfig is the definition of a profile in the configuration file.
+// The container and the volumes are yaml strings as in configmap templates
+// since the keys of the configuration are case-insensitive.
+type profileConfig struct {
+	Container string
+	Volumes   string
+	Overrides []string
+}
+
 // serverCmd represents the server command
 var serverCmd = &cobra.Command{
 	Use:   "server",
@@ -61,6 +75,17 @@ func init() {
 	serverCmd.PersistentFlags().StringVar(&serverAddr, "addr", ":8443", "Server listening addr.")
 	serverCmd.PersistentFlags().StringVar(&serverCertFile, "cert", "/etc/webhook/certs/cert.pem", "X.509 certificat for HTTPS")
 	serverCmd.PersistentFlags().StringVar(&serverKeyFile, "key", "/etc/webhook/certs/key.pem", "X.509 Privaye Key for HTTPS")
+	serverCmd.PersistentFlags().StringVar(&kubeconfig, "kubeconfig", "", "Kubeconfig file. Default: in-cluster configuration")
+	serverCmd.PersistentFlags().String("sidecar-mode", sidecar.SidecarModeClassic, "Default sidecar mode: classic or native (Kubernetes 1.28+)")
+	serverCmd.PersistentFlags().String("on-error", sidecar.OnErrorDeny, "Default failure mode: deny, allow-with-warning or allow-silently")
+
+	// Flags can also be set in the configuration file
+	for _, name := range []string{"sidecar-mode", "on-error"} {
+		if err := viper.BindPFlag(name, serverCmd.PersistentFlags().Lookup(name)); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
 }
 
 func initServer(args []string) {
@@ -76,8 +101,24 @@ func initServer(args []string) {
 	httpLogger.SetVerbosity(verbosity)
 	httpLogger.DisableColor()
 
+	config, err := loadConfig()
+	if err != nil {
+		logger.Errorw("Invalid injection configuration", "err", err)
+		os.Exit(1)
+	}
+
+	logger.Infow("Injection configuration loaded", "sidecar-mode", config.SidecarMode, "profiles", len(config.Profiles),
+		"annotation-prefix", config.AnnotationPrefix, "legacy-annotation-prefixes", config.LegacyAnnotationPrefixes,
+		"on-error", config.OnError)
+
+	// Initialize Kubernetes client
+	clientset, err := newClientset(kubeconfig)
+	if err != nil {
+		logger.Errorw("Kubernetes client cannot be initialized. Configmap templates are disabled", "err", err)
+	}
+
 	// Initialize http server
-	httpServer := http.NewServer(serverAddr, serverCertFile, serverKeyFile, httpLogger)
+	httpServer := http.NewServer(serverAddr, serverCertFile, serverKeyFile, clientset, config, httpLogger)
 
 	// HTTP
 	go func() {
@@ -87,10 +128,56 @@ func initServer(args []string) {
 
 	// Interuption
 	go func() {
-		c := make(chan os.Signal)
+		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGINT)
 		errs <- fmt.Errorf("%s", <-c)
 	}()
 
 	logger.Errorw("Exit", "err", <-errs)
 }
+
+// loadConfig reads the injection configuration from the flags and the configuration file.
+func loadConfig() (*sidecar.Config, error) {
+	var profiles map[string]profileConfig
+
+	config := &sidecar.Config{
+		SidecarMode:              viper.GetString("sidecar-mode"),
+		Profiles:                 map[string]*sidecar.Profile{},
+		AnnotationPrefix:         viper.GetString("annotation-prefix"),
+		LegacyAnnotationPrefixes: viper.GetStringSlice("legacy-annotation-prefixes"),
+		OnError:                  viper.GetString("on-error"),
+	}
+
+	if err := viper.UnmarshalKey("profiles", &profiles); err != nil {
+		return nil, fmt.Errorf("error reading profiles: %s", err)
+	}
+
+	for name, p := range profiles {
+		profile, err := sidecar.NewProfile(p.Container, p.Volumes, p.Overrides)
+		if err != nil {
+			return nil, fmt.Errorf("error reading profile '%s': %s", name, err)
+		}
+
+		config.Profiles[name] = profile
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func newClientset(kubeconfig string) (kubernetes.Interface, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return clientset, nil
+}
@@ -0,0 +1,121 @@
+/*
+Copyright © 2020 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+
+	httphandler "github.com/uthng/container-injector/handlers/http"
+	"github.com/uthng/container-injector/sidecar"
+)
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status [file]",
+	Short: "Show the injection status of a pod or a workload.",
+	Long:  `Decode the annotations added by the injection from a manifest in YAML or JSON of a pod, or of the pod template of a Deployment, StatefulSet, DaemonSet, ReplicaSet, Job or CronJob. The manifest is read from the standard input if no file is given or if the file is "-".`,
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := showStatus(statusConfig(), args, os.Stdin, os.Stdout); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+}
+
+// statusConfig returns the configuration of the annotation prefixes. The profiles
+// are not loaded so that an invalid profile does not prevent reading a status.
+func statusConfig() *sidecar.Config {
+	return &sidecar.Config{
+		AnnotationPrefix:         viper.GetString("annotation-prefix"),
+		LegacyAnnotationPrefixes: viper.GetStringSlice("legacy-annotation-prefixes"),
+	}
+}
+
+func showStatus(config *sidecar.Config, args []string, stdin io.Reader, stdout io.Writer) error {
+	var data []byte
+	var err error
+
+	if len(args) == 0 || args[0] == "-" {
+		data, err = ioutil.ReadAll(stdin)
+	} else {
+		data, err = ioutil.ReadFile(args[0])
+	}
+
+	if err != nil {
+		return fmt.Errorf("error reading manifest: %s", err)
+	}
+
+	raw, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return fmt.Errorf("error parsing manifest: %s", err)
+	}
+
+	obj := &metav1.PartialObjectMetadata{}
+	if err := yaml.Unmarshal(raw, obj); err != nil {
+		return fmt.Errorf("error parsing manifest: %s", err)
+	}
+
+	gv, err := schema.ParseGroupVersion(obj.APIVersion)
+	if err != nil {
+		return fmt.Errorf("error parsing manifest: %s", err)
+	}
+
+	// Workloads are decoded as the pod of their template like by the webhook
+	pod, _, err := httphandler.DecodePod(metav1.GroupVersionKind{
+		Group:   gv.Group,
+		Version: gv.Version,
+		Kind:    obj.Kind,
+	}, raw)
+	if err != nil {
+		return fmt.Errorf("error parsing manifest: %s", err)
+	}
+
+	status := config.GetStatus(pod)
+
+	if status.Status == "" {
+		status.Status = "not injected"
+	}
+
+	kind := obj.Kind
+	if kind == "" {
+		kind = "Pod"
+	}
+
+	fmt.Fprintf(stdout, "%-21s%s\n", kind+":", obj.Name)
+	fmt.Fprintf(stdout, "Status:              %s\n", status.Status)
+	fmt.Fprintf(stdout, "Version:             %s\n", status.Version)
+	fmt.Fprintf(stdout, "Hash:                %s\n", status.Hash)
+	fmt.Fprintf(stdout, "Injected containers: %s\n", strings.Join(status.Containers, ", "))
+	fmt.Fprintf(stdout, "Injected volumes:    %s\n", strings.Join(status.Volumes, ", "))
+
+	return nil
+}
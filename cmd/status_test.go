@@ -0,0 +1,176 @@
+//go:build unit
+// +build unit
+
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShowStatus(t *testing.T) {
+	testCases := []struct {
+		name     string
+		manifest string
+		result   interface{}
+	}{
+		{
+			"ErrUnsupportedKind",
+			`
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+`,
+			"error parsing manifest: unsupported kind: Service",
+		},
+		{
+			"ErrInvalidManifest",
+			"metadata: [",
+			"error parsing manifest: yaml: line 1: did not find expected node content",
+		},
+		{
+			"OKPod",
+			`
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+  annotations:
+    container-injector.uthng.me/status: injected
+    container-injector.uthng.me/status-hash: 0a68ac073ed5974b
+    container-injector.uthng.me/status-version: v0.3.0
+    container-injector.uthng.me/injected-containers: proxy
+    container-injector.uthng.me/injected-volumes: proxy-tls
+spec:
+  containers:
+  - name: web
+    image: nginx
+  - name: proxy
+    image: envoyproxy/envoy
+`,
+			`Pod:                 web
+Status:              injected
+Version:             v0.3.0
+Hash:                0a68ac073ed5974b
+Injected containers: proxy
+Injected volumes:    proxy-tls
+`,
+		},
+		{
+			"OKPodNotInjected",
+			`{"metadata": {"name": "web"}}`,
+			`Pod:                 web
+Status:              not injected
+Version:
+Hash:
+Injected containers:
+Injected volumes:
+`,
+		},
+		{
+			"OKDeployment",
+			`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  annotations:
+    container-injector.uthng.me/status: ignored
+spec:
+  template:
+    metadata:
+      annotations:
+        container-injector.uthng.me/status: injected
+        container-injector.uthng.me/status-hash: d5f2fec26413da0f
+        container-injector.uthng.me/injected-containers: proxy,logs
+    spec:
+      containers:
+      - name: web
+        image: nginx
+`,
+			`Deployment:          web
+Status:              injected
+Version:
+Hash:                d5f2fec26413da0f
+Injected containers: proxy, logs
+Injected volumes:
+`,
+		},
+		{
+			"OKCronJob",
+			`
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: backup
+spec:
+  schedule: "0 0 * * *"
+  jobTemplate:
+    spec:
+      template:
+        metadata:
+          annotations:
+            container-injector.uthng.me/status: injected
+            container-injector.uthng.me/injected-containers: logs
+            container-injector.uthng.me/injected-volumes: logs-data
+        spec:
+          containers:
+          - name: backup
+            image: busybox
+`,
+			`CronJob:             backup
+Status:              injected
+Version:
+Hash:
+Injected containers: logs
+Injected volumes:    logs-data
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout bytes.Buffer
+
+			err := showStatus(statusConfig(), nil, strings.NewReader(tc.manifest), &stdout)
+			if strings.HasPrefix(tc.name, "Err") {
+				require.NotNil(t, err)
+				require.Equal(t, tc.result, err.Error())
+				return
+			}
+
+			require.Nil(t, err)
+
+			// Empty values are followed by the spaces aligning the fields
+			lines := strings.Split(stdout.String(), "\n")
+			for i := range lines {
+				lines[i] = strings.TrimRight(lines[i], " ")
+			}
+
+			require.Equal(t, tc.result, strings.Join(lines, "\n"))
+		})
+	}
+}
+
+func TestStatusConfigInvalidProfile(t *testing.T) {
+	viper.Set("profiles", map[string]interface{}{
+		"broken": map[string]interface{}{
+			"container": "name: [",
+		},
+	})
+	defer viper.Set("profiles", nil)
+
+	_, err := loadConfig()
+	require.NotNil(t, err)
+
+	var stdout bytes.Buffer
+
+	err = showStatus(statusConfig(), []string{"-"}, strings.NewReader(`{"metadata": {"name": "web"}}`), &stdout)
+	require.Nil(t, err)
+	require.Contains(t, stdout.String(), "Status:              not injected")
+}
@@ -0,0 +1,99 @@
+package http
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/uthng/container-injector/sidecar"
+)
+
+// Decisions recorded in the audit annotations of the responses.
+const (
+	decisionInjected   = "injected"
+	decisionUninjected = "uninjected"
+	decisionUpdated    = "updated"
+	decisionSkipped    = "skipped"
+	decisionDenied     = "denied"
+	decisionFailed     = "failed"
+)
+
+// Keys of the audit annotations. The API server prefixes them
+// with the name of the webhook.
+const (
+	auditDecision   = "decision"
+	auditReason     = "reason"
+	auditContainers = "containers"
+	auditTemplates  = "templates"
+	auditOnError    = "on-error"
+)
+
+// audit records the decision and its details in the audit annotations
+// of the response. Empty details are not recorded.
+func audit(resp *v1.AdmissionResponse, decision string, details map[string]string) *v1.AdmissionResponse {
+	resp.AuditAnnotations = map[string]string{
+		auditDecision: decision,
+	}
+
+	for k, v := range details {
+		if v != "" {
+			resp.AuditAnnotations[k] = v
+		}
+	}
+
+	return resp
+}
+
+// skip admits the request without mutation. The reason is recorded in the
+// audit annotations and is also returned as a warning if warn is true.
+func skip(resp *v1.AdmissionResponse, reason string, warn bool) *v1.AdmissionResponse {
+	if warn {
+		resp.Warnings = append(resp.Warnings, fmt.Sprintf("injection skipped: %s", reason))
+	}
+
+	return audit(resp, decisionSkipped, map[string]string{
+		auditReason: reason,
+	})
+}
+
+// skipReason returns why a pod is not injected nor uninjected and whether
+// the user should be warned, that is when the pod is configured for an
+// injection which is not enabled.
+func skipReason(pod *corev1.Pod, config *sidecar.Config) (string, bool) {
+	if _, ok := config.Annotation(pod, sidecar.AnnotationContainerInject); !ok {
+		reason := fmt.Sprintf("annotation '%s' not found", config.AnnotationKey(sidecar.AnnotationContainerInject))
+		return reason, config.HasAnnotations(pod)
+	}
+
+	if injectEnabled(pod, config) {
+		return "already injected", false
+	}
+
+	return "injection disabled", false
+}
+
+// sidecarsAudit returns the names of the injected containers and the
+// templates they use such as "proxy=configmap:envoy" for the audit annotations.
+func sidecarsAudit(sidecars *sidecar.Sidecars) map[string]string {
+	var containers []string
+	var templates []string
+
+	for _, c := range sidecars.Containers {
+		containers = append(containers, c.Name)
+
+		if c.ProfileName != "" {
+			templates = append(templates, fmt.Sprintf("%s=profile:%s", c.Name, c.ProfileName))
+		}
+
+		if c.ConfigMapName != "" {
+			templates = append(templates, fmt.Sprintf("%s=configmap:%s", c.Name, c.ConfigMapName))
+		}
+	}
+
+	return map[string]string{
+		auditContainers: strings.Join(containers, ","),
+		auditTemplates:  strings.Join(templates, ","),
+	}
+}
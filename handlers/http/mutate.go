@@ -1,19 +1,27 @@
 package http
 
 import (
+	"context"
 	"fmt"
 	//"io"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"runtime/debug"
 	"strconv"
+	"strings"
+	"time"
 
 	"k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
 	//admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
 
 	log "github.com/uthng/golog"
 	utils "github.com/uthng/goutils"
@@ -24,22 +32,47 @@ import (
 // Mutate represents a struct for http.Handler
 type Mutate struct {
 	logger *log.Logger
+
+	clientset kubernetes.Interface
+
+	config *sidecar.Config
 }
 
+// deserializer decodes the AdmissionReview of admission/v1 and v1beta1.
 var deserializer = func() runtime.Decoder {
-	codecs := serializer.NewCodecFactory(runtime.NewScheme())
+	scheme := runtime.NewScheme()
+	utilruntime.Must(v1.AddToScheme(scheme))
+	utilruntime.Must(v1beta1.AddToScheme(scheme))
+
+	codecs := serializer.NewCodecFactory(scheme)
 	return codecs.UniversalDeserializer()
 }
 
+// namespaceTimeout is the maximum time to read the namespace of a request
+// whose injection failed.
+const namespaceTimeout = 5 * time.Second
+
+// configMapsTimeout is the maximum time to read the configmaps
+// of the container templates of a request.
+const configMapsTimeout = 5 * time.Second
+
 var ignoredNamespaces = []string{
 	metav1.NamespaceSystem,
 	metav1.NamespacePublic,
 }
 
-// NewMutate return new mutate instance implementing http.Handler
-func NewMutate(l *log.Logger) *Mutate {
+// NewMutate return new mutate instance implementing http.Handler.
+// The clientset is used to load container templates from configmaps.
+// The default configuration is used if config is nil.
+func NewMutate(l *log.Logger, clientset kubernetes.Interface, config *sidecar.Config) *Mutate {
+	if config == nil {
+		config = sidecar.DefaultConfig()
+	}
+
 	return &Mutate{
-		logger: l,
+		logger:    l,
+		clientset: clientset,
+		config:    config,
 	}
 }
 
@@ -47,8 +80,7 @@ func NewMutate(l *log.Logger) *Mutate {
 func (m *Mutate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var body []byte
 	var err error
-	var admReviewReq v1.AdmissionReview
-	var admReviewResp v1.AdmissionReview
+	var admReviewResp runtime.Object
 
 	m.logger.Infow("Request received. Checking request content...")
 	m.logger.Debugw("Request header", "header", r.Header)
@@ -84,7 +116,13 @@ func (m *Mutate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	m.logger.Debugw("Request body", "body", string(body))
 
-	if _, _, err := deserializer().Decode(body, nil, &admReviewReq); err != nil {
+	obj, gvk, err := deserializer().Decode(body, nil, nil)
+	if runtime.IsNotRegisteredError(err) {
+		m.unsupportedRequest(w, gvk)
+		return
+	}
+
+	if err != nil {
 		m.logger.Errorw("Error to decode adminssion request", "err", err)
 
 		msg := fmt.Sprintf("Error decoding admission request: %s", err)
@@ -93,9 +131,39 @@ func (m *Mutate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	admReviewResp.Response = m.mutate(admReviewReq.Request)
+	// The response has the version of the request
+	typeMeta := metav1.TypeMeta{
+		APIVersion: gvk.GroupVersion().String(),
+		Kind:       gvk.Kind,
+	}
+
+	switch admReviewReq := obj.(type) {
+	case *v1.AdmissionReview:
+		if admReviewReq.Request == nil {
+			m.emptyRequest(w)
+			return
+		}
+
+		admReviewResp = &v1.AdmissionReview{
+			TypeMeta: typeMeta,
+			Response: m.review(admReviewReq.Request),
+		}
+	case *v1beta1.AdmissionReview:
+		if admReviewReq.Request == nil {
+			m.emptyRequest(w)
+			return
+		}
 
-	resp, err := json.Marshal(&admReviewResp)
+		admReviewResp = &v1beta1.AdmissionReview{
+			TypeMeta: typeMeta,
+			Response: toV1beta1Response(m.review(toV1Request(admReviewReq.Request))),
+		}
+	default:
+		m.unsupportedRequest(w, gvk)
+		return
+	}
+
+	resp, err := json.Marshal(admReviewResp)
 	if err != nil {
 		m.logger.Errorw("Error to marshal admission response", "err", err)
 
@@ -112,35 +180,107 @@ func (m *Mutate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// mutate takes an admission request and performs mutation if necessary,
-// returning the final API response.
-func (m *Mutate) mutate(req *v1.AdmissionRequest) *v1.AdmissionResponse {
-	// Decode the pod from the request
-	var pod corev1.Pod
-	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
-		m.logger.Errorw("Could not unmarshal request to pod", "err", err)
-		m.logger.Debugf("Request Object Raw: %s", req.Object.Raw)
+// emptyRequest answers an admission review without request.
+func (m *Mutate) emptyRequest(w http.ResponseWriter) {
+	msg := "Empty admission request"
+	m.logger.Errorw(msg)
+	http.Error(w, msg, http.StatusBadRequest)
+}
 
-		return &v1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
+// unsupportedRequest answers a request which is not an AdmissionReview
+// of admission/v1 or v1beta1.
+func (m *Mutate) unsupportedRequest(w http.ResponseWriter, gvk *schema.GroupVersionKind) {
+	m.logger.Errorw("Unsupported admission request", "kind", gvk)
+
+	msg := fmt.Sprintf("Unsupported admission request: %s", gvk)
+	http.Error(w, msg, http.StatusBadRequest)
+}
+
+// review mutates the request and echoes its UID in the response,
+// including when the request is rejected. Panics are recovered and
+// handled as errors by the failure mode of the pod.
+func (m *Mutate) review(req *v1.AdmissionRequest) (resp *v1.AdmissionResponse) {
+	defer func() {
+		if r := recover(); r != nil {
+			m.logger.Errorw("Recovered from panic", "panic", r, "stack", string(debug.Stack()))
+
+			// The pod is decoded again since the panic may have happened at any step
+			pod, prefix, _ := DecodePod(req.Kind, req.Object.Raw)
+			resp = m.fail(req, &v1.AdmissionResponse{Allowed: true}, pod, prefix, fmt.Errorf("internal error: %v", r))
 		}
-	}
 
+		resp.UID = req.UID
+	}()
+
+	return m.mutate(req)
+}
+
+// mutate takes an admission request and performs mutation if necessary,
+// returning the final API response.
+func (m *Mutate) mutate(req *v1.AdmissionRequest) *v1.AdmissionResponse {
 	// Build the basic response
 	resp := &v1.AdmissionResponse{
 		Allowed: true,
 		UID:     req.UID,
 	}
 
+	// Decode the pod or the pod template of the workload from the request
+	pod, prefix, err := DecodePod(req.Kind, req.Object.Raw)
+	if err != nil {
+		m.logger.Errorw("Could not unmarshal request to pod", "kind", req.Kind, "err", err)
+		m.logger.Debugf("Request Object Raw: %s", req.Object.Raw)
+
+		return m.fail(req, resp, nil, prefix, err)
+	}
+
+	resp.Warnings = m.config.Warnings(pod)
+
 	m.logger.Infow("Checking if a container should be inject...")
 
-	inject, err := needInject(&pod)
+	inject, err := needInject(pod, m.config)
 	if err != nil {
-		return admissionError(fmt.Errorf("error checking if a container should be injected: %s", err))
-	} else if !inject {
-		return resp
+		return m.fail(req, resp, pod, prefix, fmt.Errorf("error checking if a container should be injected: %s", err))
+	}
+
+	if req.Operation == v1.Update {
+		old, _, err := DecodePod(req.Kind, req.OldObject.Raw)
+		if err != nil {
+			m.logger.Errorw("Could not unmarshal old object to pod", "kind", req.Kind, "err", err)
+			return m.fail(req, resp, pod, prefix, fmt.Errorf("error decoding old object: %s", err))
+		}
+
+		// Updates are only mutated when the injection annotations change.
+		// The new configuration is then injected again.
+		if !m.config.AnnotationsChanged(old, pod) {
+			return skip(resp, "injection annotations unchanged", false)
+		}
+
+		inject = injectEnabled(pod, m.config)
+
+		// Patching the template would make the API server reject the update
+		if immutableTemplate(req.Kind) {
+			return skip(resp, "the pod template of a job cannot be changed", true)
+		}
+	}
+
+	uninject := !inject && needUninject(pod, m.config)
+
+	// Containers cannot be added to or removed from an existing pod.
+	// Only the images of the injected containers are updated.
+	imagesOnly := req.Operation == v1.Update && prefix == ""
+	if imagesOnly {
+		if inject && !m.config.IsInjected(pod) {
+			return skip(resp, "containers cannot be added to an existing pod", true)
+		}
+
+		if uninject {
+			return skip(resp, "containers cannot be removed from an existing pod", true)
+		}
+	}
+
+	if !inject && !uninject {
+		reason, warn := skipReason(pod, m.config)
+		return skip(resp, reason, warn)
 	}
 
 	m.logger.Infow("Checking namespaces...")
@@ -149,36 +289,199 @@ func (m *Mutate) mutate(req *v1.AdmissionRequest) *v1.AdmissionResponse {
 		err := fmt.Errorf("error with request namespace: cannot inject into system namespaces: %s", req.Namespace)
 		m.logger.Errorw("Error request namespace", "namespace", req.Namespace)
 
-		return admissionError(err)
+		return m.fail(req, resp, pod, prefix, err)
+	}
+
+	if uninject {
+		m.logger.Infow("Creating patches to remove injected containers...")
+
+		patch, err := m.config.Uninject(pod)
+		if err != nil {
+			m.logger.Errorw("Error to create patches for Pod", "err", err)
+			return m.fail(req, resp, pod, prefix, err)
+		}
+
+		m.logger.Infow("Sending patches to update Pod...")
+
+		audit(resp, decisionUninjected, map[string]string{
+			auditContainers: strings.Join(m.config.GetStatus(pod).Containers, ","),
+		})
+
+		if err := patchResponse(resp, patch, prefix); err != nil {
+			return m.fail(req, resp, pod, prefix, err)
+		}
+
+		return resp
 	}
 
-	m.logger.Infow("Initializing container to be injected...")
+	m.logger.Infow("Initializing containers to be injected...")
+
+	// The namespace of pods created by controllers is only in the request.
+	// It is not patched but used by the templates of annotation values.
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
 
-	container, err := sidecar.NewContainer(&pod)
+	sidecars, err := sidecar.NewSidecarsWithConfig(pod, m.config)
 	if err != nil {
-		m.logger.Errorw("Error to initialize container to be injected", "err", err)
-		return admissionError(err)
+		m.logger.Errorw("Error to initialize containers to be injected", "err", err)
+		return m.fail(req, resp, pod, prefix, err)
 	}
 
+	m.logger.Infow("Loading container templates...")
+
+	if err := sidecars.LoadTemplates(m.configMapGetter(req.Namespace)); err != nil {
+		m.logger.Errorw("Error to load container templates", "err", err)
+		return m.fail(req, resp, pod, prefix, err)
+	}
+
+	m.logger.Infow("Validating containers to be injected...")
+
+	if err := sidecars.Validate(); err != nil {
+		m.logger.Errorw("Error to validate containers to be injected", "err", err)
+		return m.fail(req, resp, pod, prefix, err)
+	}
+
+	resp.Warnings = append(resp.Warnings, sidecars.Warnings()...)
+
 	m.logger.Infow("Creating patches for Pod...")
 
-	patch, err := container.Patch()
+	var patch []byte
+
+	decision := decisionInjected
+
+	if imagesOnly {
+		decision = decisionUpdated
+		patch, err = sidecars.PatchImages()
+	} else {
+		patch, err = sidecars.Patch()
+	}
+
 	if err != nil {
 		m.logger.Errorw("Error to create patches for Pod", "err", err)
-		return admissionError(err)
+		return m.fail(req, resp, pod, prefix, err)
 	}
 
 	m.logger.Infow("Sending patches to update Pod...")
 
+	audit(resp, decision, sidecarsAudit(sidecars))
+
+	if err := patchResponse(resp, patch, prefix); err != nil {
+		return m.fail(req, resp, pod, prefix, err)
+	}
+
+	return resp
+}
+
+// patchResponse adds the patch to the admission response. The paths of the
+// patch are prefixed with the path of the pod template for workloads.
+func patchResponse(resp *v1.AdmissionResponse, patch []byte, prefix string) error {
+	if len(patch) == 0 {
+		return nil
+	}
+
+	patch, err := sidecar.PrefixPatch(patch, prefix)
+	if err != nil {
+		return err
+	}
+
 	resp.Patch = patch
 	patchType := v1.PatchTypeJSONPatch
 	resp.PatchType = &patchType
 
+	return nil
+}
+
+// fail handles the error with the failure mode of the pod: the request is denied,
+// or it is admitted without mutation. With "allow-with-warning", the error is
+// returned as a warning and recorded in the annotations of the pod, if decoded.
+func (m *Mutate) fail(req *v1.AdmissionRequest, resp *v1.AdmissionResponse, pod *corev1.Pod, prefix string, err error) *v1.AdmissionResponse {
+	mode, modeErr := m.config.OnErrorMode(pod, func() *corev1.Namespace {
+		return m.namespace(req.Namespace)
+	})
+	if modeErr != nil {
+		m.logger.Errorw("Invalid failure mode", "err", modeErr)
+		resp.Warnings = append(resp.Warnings, modeErr.Error())
+	}
+
+	if mode == sidecar.OnErrorDeny {
+		return admissionError(resp, err)
+	}
+
+	m.logger.Infow("Admitting request without injection", "on-error", mode, "err", err)
+
+	resp.Allowed = true
+	resp.Patch = nil
+	resp.PatchType = nil
+	resp.Result = nil
+
+	audit(resp, decisionFailed, map[string]string{
+		auditReason:  err.Error(),
+		auditOnError: mode,
+	})
+
+	if mode != sidecar.OnErrorAllowWithWarning {
+		return resp
+	}
+
+	resp.Warnings = append(resp.Warnings, fmt.Sprintf("injection failed: %s", err))
+
+	if pod == nil {
+		return resp
+	}
+
+	patch, patchErr := m.config.PatchInjectionError(pod, err)
+	if patchErr == nil {
+		patchErr = patchResponse(resp, patch, prefix)
+	}
+
+	if patchErr != nil {
+		m.logger.Errorw("Error to create patches recording the injection error", "err", patchErr)
+	}
+
 	return resp
 }
 
-func needInject(pod *corev1.Pod) (bool, error) {
-	raw, ok := pod.Annotations[sidecar.AnnotationContainerInject]
+// namespace returns the namespace of the request, or nil if
+// it cannot be read. Its annotations may set the failure mode.
+func (m *Mutate) namespace(name string) *corev1.Namespace {
+	if m.clientset == nil || name == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), namespaceTimeout)
+	defer cancel()
+
+	namespace, err := m.clientset.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		m.logger.Errorw("Error to get namespace", "namespace", name, "err", err)
+		return nil
+	}
+
+	return namespace
+}
+
+// configMapGetter returns a getter of configmaps in the given namespace
+// failing once configMapsTimeout is elapsed.
+func (m *Mutate) configMapGetter(namespace string) sidecar.ConfigMapGetter {
+	// The configmaps of all the containers share the deadline so that the
+	// request is answered before the webhook timeout
+	deadline := time.Now().Add(configMapsTimeout)
+
+	return func(name string) (*corev1.ConfigMap, error) {
+		if m.clientset == nil {
+			return nil, fmt.Errorf("no Kubernetes client configured")
+		}
+
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+
+		return m.clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+}
+
+func needInject(pod *corev1.Pod, config *sidecar.Config) (bool, error) {
+	raw, ok := config.Annotation(pod, sidecar.AnnotationContainerInject)
 	if !ok {
 		return false, nil
 	}
@@ -193,7 +496,7 @@ func needInject(pod *corev1.Pod) (bool, error) {
 	}
 
 	// This shouldn't happen so bail.
-	raw, ok = pod.Annotations[sidecar.AnnotationContainerStatus]
+	raw, ok = config.Annotation(pod, sidecar.AnnotationContainerStatus)
 	if !ok {
 		return true, nil
 	}
@@ -208,10 +511,46 @@ func needInject(pod *corev1.Pod) (bool, error) {
 	return true, nil
 }
 
-func admissionError(err error) *v1.AdmissionResponse {
-	return &v1.AdmissionResponse{
-		Result: &metav1.Status{
-			Message: err.Error(),
-		},
+// injectEnabled checks if injection is explicitly enabled for a pod
+// whatever its injection status.
+func injectEnabled(pod *corev1.Pod, config *sidecar.Config) bool {
+	raw, ok := config.Annotation(pod, sidecar.AnnotationContainerInject)
+	if !ok {
+		return false
+	}
+
+	inject, err := strconv.ParseBool(raw)
+
+	return err == nil && inject
+}
+
+// needUninject checks if injection is explicitly disabled for a pod
+// which records containers of a previous injection.
+func needUninject(pod *corev1.Pod, config *sidecar.Config) bool {
+	raw, ok := config.Annotation(pod, sidecar.AnnotationContainerInject)
+	if !ok {
+		return false
 	}
+
+	inject, err := strconv.ParseBool(raw)
+	if err != nil || inject {
+		return false
+	}
+
+	return config.IsInjected(pod)
+}
+
+// admissionError denies the request with the error. The warnings
+// of the response are kept.
+func admissionError(resp *v1.AdmissionResponse, err error) *v1.AdmissionResponse {
+	resp.Allowed = false
+	resp.Patch = nil
+	resp.PatchType = nil
+	resp.Result = &metav1.Status{
+		Message: err.Error(),
+	}
+
+	return audit(resp, decisionDenied, map[string]string{
+		auditReason: err.Error(),
+	})
 }
@@ -5,19 +5,24 @@ import (
 	"encoding/base64"
 	//"encoding/json"
 	//"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
-	//"strings"
-	"io/ioutil"
+	"strings"
 	"testing"
 
 	"github.com/json-iterator/go"
 	"github.com/stretchr/testify/require"
 
 	"k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 
 	log "github.com/uthng/golog"
 
@@ -63,7 +68,7 @@ func TestHandlerMutateChecks(t *testing.T) {
 
 	basicTypeMeta := metav1.TypeMeta{
 		Kind:       "AdmissionReview",
-		APIVersion: "v1",
+		APIVersion: "admission.k8s.io/v1",
 	}
 
 	testCases := []struct {
@@ -129,7 +134,7 @@ func TestHandlerMutateChecks(t *testing.T) {
 			},
 			httptest.ResponseRecorder{
 				Code: http.StatusOK,
-				Body: bytes.NewBuffer([]byte(`{"response":{"uid":"","allowed":false,"status":{"metadata":{},"message":"unexpected end of JSON input"}}}`)),
+				Body: bytes.NewBuffer([]byte(`{"kind":"AdmissionReview","apiVersion":"admission.k8s.io/v1","response":{"uid":"","allowed":false,"status":{"metadata":{},"message":"unexpected end of JSON input"},"auditAnnotations":{"decision":"denied","reason":"unexpected end of JSON input"}}}`)),
 			},
 		},
 		{
@@ -153,7 +158,7 @@ func TestHandlerMutateChecks(t *testing.T) {
 			},
 			httptest.ResponseRecorder{
 				Code: http.StatusOK,
-				Body: bytes.NewBuffer([]byte(`{"response":{"uid":"","allowed":false,"status":{"metadata":{},"message":"error with request namespace: cannot inject into system namespaces: kube-system"}}}`)),
+				Body: bytes.NewBuffer([]byte(`{"kind":"AdmissionReview","apiVersion":"admission.k8s.io/v1","response":{"uid":"","allowed":false,"status":{"metadata":{},"message":"error with request namespace: cannot inject into system namespaces: kube-system"},"auditAnnotations":{"decision":"denied","reason":"error with request namespace: cannot inject into system namespaces: kube-system"}}}`)),
 			},
 		},
 		{
@@ -177,7 +182,36 @@ func TestHandlerMutateChecks(t *testing.T) {
 			},
 			httptest.ResponseRecorder{
 				Code: http.StatusOK,
-				Body: bytes.NewBuffer([]byte(`{"response":{"uid":"","allowed":false,"status":{"metadata":{},"message":"error checking if a container should be injected: strconv.ParseBool: parsing \"hello\": invalid syntax"}}}`)),
+				Body: bytes.NewBuffer([]byte(`{"kind":"AdmissionReview","apiVersion":"admission.k8s.io/v1","response":{"uid":"","allowed":false,"status":{"metadata":{},"message":"error checking if a container should be injected: strconv.ParseBool: parsing \"hello\": invalid syntax"},"auditAnnotations":{"decision":"denied","reason":"error checking if a container should be injected: strconv.ParseBool: parsing \"hello\": invalid syntax"}}}`)),
+			},
+		},
+		{
+			"ErrContainerValidation",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Namespace: "container-injector",
+					Object: encodeRaw(t, &corev1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								sidecar.AnnotationContainerInject:                "true",
+								sidecar.AnnotationContainerName:                  "curl-ssl",
+								sidecar.AnnotationContainerImage:                 "govermentpaas/curl-ssl",
+								sidecar.AnnotationContainerPullPolicy:            "Sometimes",
+								sidecar.AnnotationContainerLimitsCPU:             "1 cpu",
+								sidecar.AnnotationContainerVolumeMount + "-data": "data",
+							},
+						},
+						Spec: basicSpec,
+					}),
+				},
+			},
+			httptest.ResponseRecorder{
+				Code: http.StatusOK,
+				Body: bytes.NewBuffer([]byte(`{"kind":"AdmissionReview","apiVersion":"admission.k8s.io/v1","response":{"uid":"","allowed":false,"status":{"metadata":{},"message":"[metadata.annotations[container-injector.uthng.me/pull-policy]: Unsupported value: \"Sometimes\": supported values: \"Always\", \"IfNotPresent\", \"Never\", metadata.annotations[container-injector.uthng.me/limits-cpu]: Invalid value: \"1 cpu\": quantities must match the regular expression '^([+-]?[0-9.]+)([eEinumkKMGTP]*[-+]?[0-9]*)$', metadata.annotations[container-injector.uthng.me/volume-mount-data]: Not found: \"data\", metadata.annotations[container-injector.uthng.me/volume-mount-data]: Invalid value: \"data\": must be an absolute path]"},"auditAnnotations":{"decision":"denied","reason":"[metadata.annotations[container-injector.uthng.me/pull-policy]: Unsupported value: \"Sometimes\": supported values: \"Always\", \"IfNotPresent\", \"Never\", metadata.annotations[container-injector.uthng.me/limits-cpu]: Invalid value: \"1 cpu\": quantities must match the regular expression '^([+-]?[0-9.]+)([eEinumkKMGTP]*[-+]?[0-9]*)$', metadata.annotations[container-injector.uthng.me/volume-mount-data]: Not found: \"data\", metadata.annotations[container-injector.uthng.me/volume-mount-data]: Invalid value: \"data\": must be an absolute path]"}}}`)),
 			},
 		},
 	}
@@ -204,7 +238,7 @@ func TestHandlerMutateChecks(t *testing.T) {
 
 			rec := httptest.NewRecorder()
 
-			handlerMutate := httphandler.NewMutate(httpLogger)
+			handlerMutate := httphandler.NewMutate(httpLogger, nil, nil)
 			handlerMutate.ServeHTTP(rec, req)
 
 			result := httptest.ResponseRecorder{
@@ -245,7 +279,7 @@ func TestHandlerMutateInjection(t *testing.T) {
 
 	basicTypeMeta := metav1.TypeMeta{
 		Kind:       "AdmissionReview",
-		APIVersion: "v1",
+		APIVersion: "admission.k8s.io/v1",
 	}
 
 	testCases := []struct {
@@ -275,7 +309,7 @@ func TestHandlerMutateInjection(t *testing.T) {
 					}),
 				},
 			},
-			`[{"op":"add","path":"/spec/containers/-","value":{"name":"curl-ssl","image":"govermentpaas/curl-ssl","resources":{}}},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"}]`,
+			`[{"op":"add","path":"/spec/containers/-","value":{"name":"curl-ssl","image":"govermentpaas/curl-ssl","resources":{}}},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"curl-ssl"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"d5f2fec26413da0f"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}]`,
 		},
 		{
 			"OKContainerFullOpts",
@@ -294,7 +328,7 @@ func TestHandlerMutateInjection(t *testing.T) {
 								sidecar.AnnotationContainerImage:                      "govermentpaas/curl-ssl",
 								sidecar.AnnotationContainerCommand:                    "/bin/sh -ec echo 'hello world'",
 								sidecar.AnnotationContainerEnv + "-ENVNAME":           "envname",
-								sidecar.AnnotationContainerVolumeMount + "-gitconfig": "/opt/gitconfig",
+								sidecar.AnnotationContainerVolumeMount + "-volsecret": "/opt/gitconfig",
 								sidecar.AnnotationContainerVolumeSource + "-volsecret": `
 {
 	"secret": {
@@ -307,7 +341,174 @@ func TestHandlerMutateInjection(t *testing.T) {
 					}),
 				},
 			},
-			`[{"op":"add","path":"/spec/volumes","value":[{"name":"volsecret","secret":{"secretName":"volsecret"}}]},{"op":"add","path":"/spec/containers/-","value":{"name":"curl-ssl","image":"govermentpaas/curl-ssl","command":["/bin/sh","-ec","echo","'hello world'"],"env":[{"name":"ENVNAME","value":"envname"}],"resources":{},"volumeMounts":[{"name":"gitconfig","mountPath":"/opt/gitconfig"}]}},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"}]`,
+			`[{"op":"add","path":"/spec/volumes","value":[{"name":"volsecret","secret":{"secretName":"volsecret"}}]},{"op":"add","path":"/spec/containers/-","value":{"name":"curl-ssl","image":"govermentpaas/curl-ssl","command":["/bin/sh","-ec","echo","hello world"],"env":[{"name":"ENVNAME","value":"envname"}],"resources":{},"volumeMounts":[{"name":"volsecret","mountPath":"/opt/gitconfig"}]}},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"curl-ssl"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-volumes","value":"volsecret"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"cd320c19221ce93d"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}]`,
+		},
+		{
+			"OKContainerOrdering",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Namespace: "container-injector",
+					Object: encodeRaw(t, &corev1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								sidecar.AnnotationContainerInject:                  "true",
+								sidecar.AnnotationContainerName:                    "curl-ssl",
+								sidecar.AnnotationContainerImage:                   "govermentpaas/curl-ssl",
+								sidecar.AnnotationContainerEnv + "-URL":            "https://$(HOST)",
+								sidecar.AnnotationContainerEnv + "-LOG_LEVEL":      "debug",
+								sidecar.AnnotationContainerEnv + "-HOST":           "example.com",
+								sidecar.AnnotationContainerEnvOrder:                "HOST",
+								sidecar.AnnotationContainerVolumeMount + "-data":   "/data",
+								sidecar.AnnotationContainerVolumeMount + "-cache":  "/cache",
+								sidecar.AnnotationContainerVolumeSource + "-data":  `{"emptyDir": {}}`,
+								sidecar.AnnotationContainerVolumeSource + "-cache": `{"emptyDir": {}}`,
+							},
+						},
+						Spec: basicSpec,
+					}),
+				},
+			},
+			`[{"op":"add","path":"/spec/volumes","value":[{"name":"cache","emptyDir":{}}]},{"op":"add","path":"/spec/volumes/-","value":{"name":"data","emptyDir":{}}},{"op":"add","path":"/spec/containers/-","value":{"name":"curl-ssl","image":"govermentpaas/curl-ssl","env":[{"name":"HOST","value":"example.com"},{"name":"LOG_LEVEL","value":"debug"},{"name":"URL","value":"https://$(HOST)"}],"resources":{},"volumeMounts":[{"name":"cache","mountPath":"/cache"},{"name":"data","mountPath":"/data"}]}},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"curl-ssl"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-volumes","value":"cache,data"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"8c3f5432d45aa536"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}]`,
+		},
+		{
+			"OKContainerTemplateValues",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Namespace: "container-injector",
+					Object: encodeRaw(t, &corev1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							GenerateName: "web-",
+							Labels: map[string]string{
+								"app": "web",
+							},
+							Annotations: map[string]string{
+								sidecar.AnnotationContainerInject:          "true",
+								sidecar.AnnotationContainerName:            "curl-ssl",
+								sidecar.AnnotationContainerImage:           "govermentpaas/curl-ssl",
+								sidecar.AnnotationContainerArgs:            "--service={{ .Labels.app }}",
+								sidecar.AnnotationContainerEnv + "-POD_NS": "{{ .Namespace }}",
+							},
+						},
+						Spec: basicSpec,
+					}),
+				},
+			},
+			`[{"op":"add","path":"/spec/containers/-","value":{"name":"curl-ssl","image":"govermentpaas/curl-ssl","args":["--service=web"],"env":[{"name":"POD_NS","value":"container-injector"}],"resources":{}}},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"curl-ssl"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"1b000f5771547205"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}]`,
+		},
+		{
+			"OKContainerReinjection",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Namespace: "container-injector",
+					Object: encodeRaw(t, &corev1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								sidecar.AnnotationContainerInject:             "true",
+								sidecar.AnnotationContainerName:               "curl-ssl",
+								sidecar.AnnotationContainerImage:              "govermentpaas/curl-ssl:v2",
+								sidecar.AnnotationContainerInjectedContainers: "curl-ssl",
+							},
+						},
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{
+								{Name: "web"},
+								{Name: "curl-ssl", Image: "govermentpaas/curl-ssl:v1"},
+							},
+						},
+					}),
+				},
+			},
+			`[{"op":"replace","path":"/spec/containers/1","value":{"name":"curl-ssl","image":"govermentpaas/curl-ssl:v2","resources":{}}},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"curl-ssl"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"0a68ac073ed5974b"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}]`,
+		},
+		{
+			"OKContainerUninject",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Namespace: "container-injector",
+					Object: encodeRaw(t, &corev1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								sidecar.AnnotationContainerInject:             "false",
+								sidecar.AnnotationContainerName:               "curl-ssl",
+								sidecar.AnnotationContainerImage:              "govermentpaas/curl-ssl",
+								sidecar.AnnotationContainerInjectedContainers: "curl-ssl",
+								sidecar.AnnotationContainerStatus:             "injected",
+							},
+						},
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{
+								{Name: "web"},
+								{Name: "curl-ssl", Image: "govermentpaas/curl-ssl"},
+							},
+						},
+					}),
+				},
+			},
+			`[{"op":"remove","path":"/spec/containers/1"},{"op":"remove","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers"},{"op":"remove","path":"/metadata/annotations/container-injector.uthng.me~1status"}]`,
+		},
+		{
+			"OKInitContainerFirst",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Namespace: "container-injector",
+					Object: encodeRaw(t, &corev1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								sidecar.AnnotationContainerInject:        "true",
+								sidecar.AnnotationContainerName:          "migrate",
+								sidecar.AnnotationContainerImage:         "govermentpaas/curl-ssl",
+								sidecar.AnnotationContainerInitContainer: "true",
+								sidecar.AnnotationContainerInitFirst:     "true",
+							},
+						},
+						Spec: basicSpec,
+					}),
+				},
+			},
+			`[{"op":"add","path":"/spec/initContainers/0","value":{"name":"migrate","image":"govermentpaas/curl-ssl","resources":{}}},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"migrate"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"f4eb44cae55d98d4"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}]`,
+		},
+		{
+			"OKContainerConfigMap",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Namespace: "container-injector",
+					Object: encodeRaw(t, &corev1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								sidecar.AnnotationContainerInject:          "true",
+								sidecar.AnnotationContainerConfigMap:       "curl-ssl",
+								sidecar.AnnotationContainerEnv + "-TARGET": "https://example.com",
+							},
+						},
+						Spec: basicSpec,
+					}),
+				},
+			},
+			`[{"op":"add","path":"/spec/containers/-","value":{"name":"curl-ssl","image":"govermentpaas/curl-ssl","command":["/bin/sleep","3650d"],"env":[{"name":"TARGET","value":"https://example.com"}],"resources":{}}},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"curl-ssl"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"b9558cc46e5d1519"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}]`,
 		},
 	}
 
@@ -316,6 +517,16 @@ func TestHandlerMutateInjection(t *testing.T) {
 
 	//myserver := myhttp.NewServer("", "", "", httpLogger)
 
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "curl-ssl",
+			Namespace: "container-injector",
+		},
+		Data: map[string]string{
+			sidecar.ConfigMapKeyContainer: `{"name": "curl-ssl", "image": "govermentpaas/curl-ssl", "command": ["/bin/sleep", "3650d"]}`,
+		},
+	})
+
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			var body []byte
@@ -333,7 +544,7 @@ func TestHandlerMutateInjection(t *testing.T) {
 
 			rec := httptest.NewRecorder()
 
-			handlerMutate := httphandler.NewMutate(httpLogger)
+			handlerMutate := httphandler.NewMutate(httpLogger, clientset, nil)
 			handlerMutate.ServeHTTP(rec, req)
 
 			bodyData, err := ioutil.ReadAll(rec.Body)
@@ -346,3 +557,1240 @@ func TestHandlerMutateInjection(t *testing.T) {
 		})
 	}
 }
+
+func TestHandlerMutateAdmissionVersions(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				sidecar.AnnotationContainerInject: "true",
+				sidecar.AnnotationContainerName:   "curl-ssl",
+				sidecar.AnnotationContainerImage:  "govermentpaas/curl-ssl",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+			},
+		},
+	}
+
+	invalidPod := pod.DeepCopy()
+	invalidPod.Annotations[sidecar.AnnotationContainerPullPolicy] = "Sometimes"
+
+	testCases := []struct {
+		name   string
+		header map[string]string
+		body   interface{}
+		result interface{}
+	}{
+		{
+			"ErrAdmissionReviewVersion",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "AdmissionReview",
+					APIVersion: "admission.k8s.io/v2",
+				},
+				Request: &v1.AdmissionRequest{
+					UID:       "0b2f2ed4-6b1f-4d3a-9d49-3c8f6fd3e0a1",
+					Namespace: "container-injector",
+					Object:    encodeRaw(t, pod),
+				},
+			},
+			"Unsupported admission request: admission.k8s.io/v2, Kind=AdmissionReview\n",
+		},
+		{
+			"ErrAdmissionReviewRequest",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1beta1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "AdmissionReview",
+					APIVersion: "admission.k8s.io/v1beta1",
+				},
+			},
+			"Empty admission request\n",
+		},
+		{
+			"OKAdmissionReviewV1",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "AdmissionReview",
+					APIVersion: "admission.k8s.io/v1",
+				},
+				Request: &v1.AdmissionRequest{
+					UID:       "0b2f2ed4-6b1f-4d3a-9d49-3c8f6fd3e0a1",
+					Namespace: "container-injector",
+					Operation: v1.Create,
+					Object:    encodeRaw(t, pod),
+				},
+			},
+			`{"kind":"AdmissionReview","apiVersion":"admission.k8s.io/v1","response":{"uid":"0b2f2ed4-6b1f-4d3a-9d49-3c8f6fd3e0a1","allowed":true,"patch":"W3sib3AiOiJhZGQiLCJwYXRoIjoiL3NwZWMvY29udGFpbmVycy8tIiwidmFsdWUiOnsibmFtZSI6ImN1cmwtc3NsIiwiaW1hZ2UiOiJnb3Zlcm1lbnRwYWFzL2N1cmwtc3NsIiwicmVzb3VyY2VzIjp7fX19LHsib3AiOiJhZGQiLCJwYXRoIjoiL21ldGFkYXRhL2Fubm90YXRpb25zL2NvbnRhaW5lci1pbmplY3Rvci51dGhuZy5tZX4xaW5qZWN0ZWQtY29udGFpbmVycyIsInZhbHVlIjoiY3VybC1zc2wifSx7Im9wIjoiYWRkIiwicGF0aCI6Ii9tZXRhZGF0YS9hbm5vdGF0aW9ucy9jb250YWluZXItaW5qZWN0b3IudXRobmcubWV+MXN0YXR1cyIsInZhbHVlIjoiaW5qZWN0ZWQifSx7Im9wIjoiYWRkIiwicGF0aCI6Ii9tZXRhZGF0YS9hbm5vdGF0aW9ucy9jb250YWluZXItaW5qZWN0b3IudXRobmcubWV+MXN0YXR1cy1oYXNoIiwidmFsdWUiOiJkNWYyZmVjMjY0MTNkYTBmIn0seyJvcCI6ImFkZCIsInBhdGgiOiIvbWV0YWRhdGEvYW5ub3RhdGlvbnMvY29udGFpbmVyLWluamVjdG9yLnV0aG5nLm1lfjFzdGF0dXMtdmVyc2lvbiIsInZhbHVlIjoiZGV2In1d","patchType":"JSONPatch","auditAnnotations":{"containers":"curl-ssl","decision":"injected"}}}`,
+		},
+		{
+			"OKAdmissionReviewV1beta1",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1beta1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "AdmissionReview",
+					APIVersion: "admission.k8s.io/v1beta1",
+				},
+				Request: &v1beta1.AdmissionRequest{
+					UID:       "5d0b8c8e-2a71-4c55-8f0e-8f3c1d6b7e42",
+					Namespace: "container-injector",
+					Operation: v1beta1.Create,
+					Object:    encodeRaw(t, pod),
+				},
+			},
+			`{"kind":"AdmissionReview","apiVersion":"admission.k8s.io/v1beta1","response":{"uid":"5d0b8c8e-2a71-4c55-8f0e-8f3c1d6b7e42","allowed":true,"patch":"W3sib3AiOiJhZGQiLCJwYXRoIjoiL3NwZWMvY29udGFpbmVycy8tIiwidmFsdWUiOnsibmFtZSI6ImN1cmwtc3NsIiwiaW1hZ2UiOiJnb3Zlcm1lbnRwYWFzL2N1cmwtc3NsIiwicmVzb3VyY2VzIjp7fX19LHsib3AiOiJhZGQiLCJwYXRoIjoiL21ldGFkYXRhL2Fubm90YXRpb25zL2NvbnRhaW5lci1pbmplY3Rvci51dGhuZy5tZX4xaW5qZWN0ZWQtY29udGFpbmVycyIsInZhbHVlIjoiY3VybC1zc2wifSx7Im9wIjoiYWRkIiwicGF0aCI6Ii9tZXRhZGF0YS9hbm5vdGF0aW9ucy9jb250YWluZXItaW5qZWN0b3IudXRobmcubWV+MXN0YXR1cyIsInZhbHVlIjoiaW5qZWN0ZWQifSx7Im9wIjoiYWRkIiwicGF0aCI6Ii9tZXRhZGF0YS9hbm5vdGF0aW9ucy9jb250YWluZXItaW5qZWN0b3IudXRobmcubWV+MXN0YXR1cy1oYXNoIiwidmFsdWUiOiJkNWYyZmVjMjY0MTNkYTBmIn0seyJvcCI6ImFkZCIsInBhdGgiOiIvbWV0YWRhdGEvYW5ub3RhdGlvbnMvY29udGFpbmVyLWluamVjdG9yLnV0aG5nLm1lfjFzdGF0dXMtdmVyc2lvbiIsInZhbHVlIjoiZGV2In1d","patchType":"JSONPatch","auditAnnotations":{"containers":"curl-ssl","decision":"injected"}}}`,
+		},
+		{
+			"OKAdmissionReviewV1beta1Denied",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1beta1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "AdmissionReview",
+					APIVersion: "admission.k8s.io/v1beta1",
+				},
+				Request: &v1beta1.AdmissionRequest{
+					UID:       "5d0b8c8e-2a71-4c55-8f0e-8f3c1d6b7e42",
+					Namespace: "container-injector",
+					Operation: v1beta1.Create,
+					Object:    encodeRaw(t, invalidPod),
+				},
+			},
+			`{"kind":"AdmissionReview","apiVersion":"admission.k8s.io/v1beta1","response":{"uid":"5d0b8c8e-2a71-4c55-8f0e-8f3c1d6b7e42","allowed":false,"status":{"metadata":{},"message":"metadata.annotations[container-injector.uthng.me/pull-policy]: Unsupported value: \"Sometimes\": supported values: \"Always\", \"IfNotPresent\", \"Never\""},"auditAnnotations":{"decision":"denied","reason":"metadata.annotations[container-injector.uthng.me/pull-policy]: Unsupported value: \"Sometimes\": supported values: \"Always\", \"IfNotPresent\", \"Never\""}}}`,
+		},
+	}
+
+	// Set logger
+	httpLogger := log.NewLogger()
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body, err := json.Marshal(tc.body)
+			require.Nil(t, err)
+
+			req, err := http.NewRequest("POST", "/", bytes.NewBuffer(body))
+			require.Nil(t, err)
+
+			req.Header.Set("Content-Type", tc.header["Content-Type"])
+
+			rec := httptest.NewRecorder()
+
+			handlerMutate := httphandler.NewMutate(httpLogger, nil, nil)
+			handlerMutate.ServeHTTP(rec, req)
+
+			if strings.HasPrefix(tc.name, "Err") {
+				require.Equal(t, http.StatusBadRequest, rec.Code)
+				require.Equal(t, tc.result.(string), rec.Body.String())
+				return
+			}
+
+			require.Equal(t, http.StatusOK, rec.Code)
+			require.JSONEq(t, tc.result.(string), rec.Body.String())
+		})
+	}
+}
+
+func TestHandlerMutateWorkloads(t *testing.T) {
+	template := corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{
+				"app": "web",
+			},
+			Annotations: map[string]string{
+				sidecar.AnnotationContainerInject:                 "true",
+				sidecar.AnnotationContainerName:                   "curl-ssl",
+				sidecar.AnnotationContainerImage:                  "govermentpaas/curl-ssl",
+				sidecar.AnnotationContainerEnv + "-POD_NAMESPACE": "{{ .Namespace }}",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "web",
+				},
+			},
+		},
+	}
+
+	// Patches of the pod template in workloads and in cronjobs
+	templatePatch := `[{"op":"add","path":"/spec/template/spec/containers/-","value":{"name":"curl-ssl","image":"govermentpaas/curl-ssl","env":[{"name":"POD_NAMESPACE","value":"container-injector"}],"resources":{}}},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"curl-ssl"},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1status-hash","value":"554f124c41259c62"},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}]`
+	jobTemplatePatch := `[{"op":"add","path":"/spec/jobTemplate/spec/template/spec/containers/-","value":{"name":"curl-ssl","image":"govermentpaas/curl-ssl","env":[{"name":"POD_NAMESPACE","value":"container-injector"}],"resources":{}}},{"op":"add","path":"/spec/jobTemplate/spec/template/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"curl-ssl"},{"op":"add","path":"/spec/jobTemplate/spec/template/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},{"op":"add","path":"/spec/jobTemplate/spec/template/metadata/annotations/container-injector.uthng.me~1status-hash","value":"554f124c41259c62"},{"op":"add","path":"/spec/jobTemplate/spec/template/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}]`
+
+	basicTypeMeta := metav1.TypeMeta{
+		Kind:       "AdmissionReview",
+		APIVersion: "admission.k8s.io/v1",
+	}
+
+	testCases := []struct {
+		name   string
+		header map[string]string
+		body   interface{}
+		result interface{}
+	}{
+		{
+			"OKDeployment",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+					Namespace: "container-injector",
+					Object: encodeRaw(t, &appsv1.Deployment{
+						ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "container-injector"},
+						Spec:       appsv1.DeploymentSpec{Template: template},
+					}),
+				},
+			},
+			templatePatch,
+		},
+		{
+			"OKStatefulSet",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "StatefulSet"},
+					Namespace: "container-injector",
+					Object: encodeRaw(t, &appsv1.StatefulSet{
+						ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "container-injector"},
+						Spec:       appsv1.StatefulSetSpec{Template: template},
+					}),
+				},
+			},
+			templatePatch,
+		},
+		{
+			"OKDaemonSet",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "DaemonSet"},
+					Namespace: "container-injector",
+					Object: encodeRaw(t, &appsv1.DaemonSet{
+						ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "container-injector"},
+						Spec:       appsv1.DaemonSetSpec{Template: template},
+					}),
+				},
+			},
+			templatePatch,
+		},
+		{
+			"OKReplicaSet",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "ReplicaSet"},
+					Namespace: "container-injector",
+					Object: encodeRaw(t, &appsv1.ReplicaSet{
+						ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "container-injector"},
+						Spec:       appsv1.ReplicaSetSpec{Template: template},
+					}),
+				},
+			},
+			templatePatch,
+		},
+		{
+			"OKJob",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"},
+					Namespace: "container-injector",
+					Object: encodeRaw(t, &batchv1.Job{
+						ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "container-injector"},
+						Spec:       batchv1.JobSpec{Template: template},
+					}),
+				},
+			},
+			templatePatch,
+		},
+		{
+			"OKCronJob",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "CronJob"},
+					Namespace: "container-injector",
+					Object: encodeRaw(t, &batchv1.CronJob{
+						ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "container-injector"},
+						Spec: batchv1.CronJobSpec{
+							JobTemplate: batchv1.JobTemplateSpec{
+								Spec: batchv1.JobSpec{Template: template},
+							},
+						},
+					}),
+				},
+			},
+			jobTemplatePatch,
+		},
+		{
+			"ErrUnsupportedKind",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Group: "", Version: "v1", Kind: "Service"},
+					Namespace: "container-injector",
+					Object: encodeRaw(t, &corev1.Service{
+						ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "container-injector", Annotations: template.Annotations},
+					}),
+				},
+			},
+			"unsupported kind: Service",
+		},
+	}
+
+	// Set logger
+	httpLogger := log.NewLogger()
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body, err := json.Marshal(tc.body)
+			require.Nil(t, err)
+
+			req, err := http.NewRequest("POST", "/", bytes.NewBuffer(body))
+			require.Nil(t, err)
+
+			req.Header.Set("Content-Type", tc.header["Content-Type"])
+
+			rec := httptest.NewRecorder()
+
+			handlerMutate := httphandler.NewMutate(httpLogger, nil, nil)
+			handlerMutate.ServeHTTP(rec, req)
+
+			bodyData, err := ioutil.ReadAll(rec.Body)
+			require.Nil(t, err)
+
+			if strings.HasPrefix(tc.name, "Err") {
+				require.Equal(t, tc.result.(string), json.Get(bodyData, "response", "status", "message").ToString())
+				return
+			}
+
+			patch, err := base64.StdEncoding.DecodeString(json.Get(bodyData, "response", "patch").ToString())
+			require.Nil(t, err)
+
+			require.Equal(t, tc.result.(string), string(patch))
+		})
+	}
+}
+
+func TestHandlerMutateUpdate(t *testing.T) {
+	annotations := map[string]string{
+		sidecar.AnnotationContainerInject: "true",
+		sidecar.AnnotationContainerName:   "curl-ssl",
+		sidecar.AnnotationContainerImage:  "govermentpaas/curl-ssl",
+	}
+
+	// pod returns a pod with the annotations
+	pod := func(annotations map[string]string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: annotations,
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{Name: "web"},
+				},
+			},
+		}
+	}
+
+	// injectedPod returns a pod injected with the annotations
+	// to which the given annotations are added
+	injectedPod := func(extra map[string]string) *corev1.Pod {
+		p := pod(map[string]string{
+			sidecar.AnnotationContainerInjectedContainers: "curl-ssl",
+			sidecar.AnnotationContainerStatus:             "injected",
+		})
+
+		for k, v := range annotations {
+			p.Annotations[k] = v
+		}
+
+		for k, v := range extra {
+			p.Annotations[k] = v
+		}
+
+		p.Spec.Containers = append(p.Spec.Containers, corev1.Container{
+			Name:  "curl-ssl",
+			Image: "govermentpaas/curl-ssl",
+		})
+
+		return p
+	}
+
+	// deployment returns a deployment with the pod as template
+	deployment := func(p *corev1.Pod) *appsv1.Deployment {
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "container-injector"},
+			Spec: appsv1.DeploymentSpec{
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: p.ObjectMeta,
+					Spec:       p.Spec,
+				},
+			},
+		}
+	}
+
+	// job returns a job with the pod as template
+	job := func(p *corev1.Pod) *batchv1.Job {
+		return &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: "backup", Namespace: "container-injector"},
+			Spec: batchv1.JobSpec{
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: p.ObjectMeta,
+					Spec:       p.Spec,
+				},
+			},
+		}
+	}
+
+	// groupsPod returns a pod injected with the annotations and a logs group
+	// sharing a volume with the application container
+	groupsPod := func() *corev1.Pod {
+		p := injectedPod(map[string]string{
+			sidecar.AnnotationContainerInjectedContainers:                       "curl-ssl,logs",
+			sidecar.AnnotationContainerInjectedVolumes:                          "logs-data",
+			sidecar.DefaultAnnotationPrefix + "logs.name":                       "logs",
+			sidecar.DefaultAnnotationPrefix + "logs.image":                      "busybox",
+			sidecar.DefaultAnnotationPrefix + "logs.volume-source-logs-data":    `{"emptyDir": {}}`,
+			sidecar.DefaultAnnotationPrefix + "logs.volume-mount-logs-data":     "/data",
+			sidecar.DefaultAnnotationPrefix + "logs.app-volume-mount-logs-data": "/logs",
+		})
+
+		p.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "logs-data", MountPath: "/logs"}}
+
+		p.Spec.Containers = append(p.Spec.Containers, corev1.Container{
+			Name:         "logs",
+			Image:        "busybox",
+			VolumeMounts: []corev1.VolumeMount{{Name: "logs-data", MountPath: "/data"}},
+		})
+
+		p.Spec.Volumes = []corev1.Volume{
+			{Name: "logs-data", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+		}
+
+		return p
+	}
+
+	// withoutGroup returns the pod without the annotations of the logs group
+	withoutGroup := func(p *corev1.Pod) *corev1.Pod {
+		for k := range p.Annotations {
+			if strings.HasPrefix(k, sidecar.DefaultAnnotationPrefix+"logs.") {
+				delete(p.Annotations, k)
+			}
+		}
+
+		return p
+	}
+
+	// withoutStatus returns the pod without the status annotation
+	withoutStatus := func(p *corev1.Pod) *corev1.Pod {
+		delete(p.Annotations, sidecar.AnnotationContainerStatus)
+		return p
+	}
+
+	basicTypeMeta := metav1.TypeMeta{
+		Kind:       "AdmissionReview",
+		APIVersion: "admission.k8s.io/v1",
+	}
+
+	testCases := []struct {
+		name   string
+		header map[string]string
+		body   interface{}
+		result interface{}
+	}{
+		{
+			"OKPodUpdateUnchanged",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+					Operation: v1.Update,
+					Namespace: "container-injector",
+					Object:    encodeRaw(t, injectedPod(nil)),
+					OldObject: encodeRaw(t, injectedPod(nil)),
+				},
+			},
+			"",
+		},
+		{
+			"OKPodUpdateImage",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+					Operation: v1.Update,
+					Namespace: "container-injector",
+					Object:    encodeRaw(t, injectedPod(map[string]string{sidecar.AnnotationContainerImage: "govermentpaas/curl-ssl:v2"})),
+					OldObject: encodeRaw(t, injectedPod(nil)),
+				},
+			},
+			`[{"op":"replace","path":"/spec/containers/1/image","value":"govermentpaas/curl-ssl:v2"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"0a68ac073ed5974b"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}]`,
+		},
+		{
+			"OKPodUpdateStatusRemoved",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+					Operation: v1.Update,
+					Namespace: "container-injector",
+					Object:    encodeRaw(t, withoutStatus(injectedPod(nil))),
+					OldObject: encodeRaw(t, injectedPod(nil)),
+				},
+			},
+			`[{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"d5f2fec26413da0f"},{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}]`,
+		},
+		{
+			"OKPodUpdateNotInjected",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+					Operation: v1.Update,
+					Namespace: "container-injector",
+					Object:    encodeRaw(t, pod(annotations)),
+					OldObject: encodeRaw(t, pod(nil)),
+				},
+			},
+			"",
+		},
+		{
+			"OKPodUpdateUninject",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+					Operation: v1.Update,
+					Namespace: "container-injector",
+					Object:    encodeRaw(t, injectedPod(map[string]string{sidecar.AnnotationContainerInject: "false"})),
+					OldObject: encodeRaw(t, injectedPod(nil)),
+				},
+			},
+			"",
+		},
+		{
+			"OKDeploymentUpdateUnchanged",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+					Operation: v1.Update,
+					Namespace: "container-injector",
+					Object:    encodeRaw(t, deployment(injectedPod(nil))),
+					OldObject: encodeRaw(t, deployment(injectedPod(nil))),
+				},
+			},
+			"",
+		},
+		{
+			"OKDeploymentUpdateInject",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+					Operation: v1.Update,
+					Namespace: "container-injector",
+					Object:    encodeRaw(t, deployment(pod(annotations))),
+					OldObject: encodeRaw(t, deployment(pod(nil))),
+				},
+			},
+			`[{"op":"add","path":"/spec/template/spec/containers/-","value":{"name":"curl-ssl","image":"govermentpaas/curl-ssl","resources":{}}},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"curl-ssl"},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1status-hash","value":"d5f2fec26413da0f"},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}]`,
+		},
+		{
+			"OKDeploymentUpdateImage",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+					Operation: v1.Update,
+					Namespace: "container-injector",
+					Object:    encodeRaw(t, deployment(injectedPod(map[string]string{sidecar.AnnotationContainerImage: "govermentpaas/curl-ssl:v2"}))),
+					OldObject: encodeRaw(t, deployment(injectedPod(nil))),
+				},
+			},
+			`[{"op":"replace","path":"/spec/template/spec/containers/1","value":{"name":"curl-ssl","image":"govermentpaas/curl-ssl:v2","resources":{}}},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"curl-ssl"},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1status-hash","value":"0a68ac073ed5974b"},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}]`,
+		},
+		{
+			"OKDeploymentUpdateUninject",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+					Operation: v1.Update,
+					Namespace: "container-injector",
+					Object:    encodeRaw(t, deployment(injectedPod(map[string]string{sidecar.AnnotationContainerInject: "false"}))),
+					OldObject: encodeRaw(t, deployment(injectedPod(nil))),
+				},
+			},
+			`[{"op":"remove","path":"/spec/template/spec/containers/1"},{"op":"remove","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1injected-containers"},{"op":"remove","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1status"}]`,
+		},
+		{
+			"OKDeploymentUpdateSidecarMode",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+					Operation: v1.Update,
+					Namespace: "container-injector",
+					Object:    encodeRaw(t, deployment(injectedPod(map[string]string{sidecar.AnnotationContainerSidecarMode: sidecar.SidecarModeNative}))),
+					OldObject: encodeRaw(t, deployment(injectedPod(nil))),
+				},
+			},
+			`[{"op":"remove","path":"/spec/template/spec/containers/1"},{"op":"add","path":"/spec/template/spec/initContainers","value":[{"name":"curl-ssl","image":"govermentpaas/curl-ssl","resources":{},"restartPolicy":"Always"}]},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"curl-ssl"},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1status-hash","value":"65e98635bd956c08"},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}]`,
+		},
+		{
+			"OKDeploymentUpdateRemoveGroup",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+					Operation: v1.Update,
+					Namespace: "container-injector",
+					Object:    encodeRaw(t, deployment(withoutGroup(groupsPod()))),
+					OldObject: encodeRaw(t, deployment(groupsPod())),
+				},
+			},
+			`[{"op":"remove","path":"/spec/template/spec/containers/0/volumeMounts"},{"op":"remove","path":"/spec/template/spec/containers/2"},{"op":"remove","path":"/spec/template/spec/volumes"},{"op":"replace","path":"/spec/template/spec/containers/1","value":{"name":"curl-ssl","image":"govermentpaas/curl-ssl","resources":{}}},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"curl-ssl"},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1status-hash","value":"d5f2fec26413da0f"},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"},{"op":"remove","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1injected-volumes"}]`,
+		},
+		{
+			"OKDeploymentUpdateStatusRemoved",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+					Operation: v1.Update,
+					Namespace: "container-injector",
+					Object:    encodeRaw(t, deployment(withoutStatus(injectedPod(nil)))),
+					OldObject: encodeRaw(t, deployment(injectedPod(nil))),
+				},
+			},
+			`[{"op":"replace","path":"/spec/template/spec/containers/1","value":{"name":"curl-ssl","image":"govermentpaas/curl-ssl","resources":{}}},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"curl-ssl"},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1status-hash","value":"d5f2fec26413da0f"},{"op":"add","path":"/spec/template/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}]`,
+		},
+		{
+			"OKJobUpdateImage",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"},
+					Operation: v1.Update,
+					Namespace: "container-injector",
+					Object:    encodeRaw(t, job(injectedPod(map[string]string{sidecar.AnnotationContainerImage: "govermentpaas/curl-ssl:v2"}))),
+					OldObject: encodeRaw(t, job(injectedPod(nil))),
+				},
+			},
+			"",
+		},
+		{
+			"OKJobUpdateInject",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"},
+					Operation: v1.Update,
+					Namespace: "container-injector",
+					Object:    encodeRaw(t, job(pod(annotations))),
+					OldObject: encodeRaw(t, job(pod(nil))),
+				},
+			},
+			"",
+		},
+	}
+
+	// Set logger
+	httpLogger := log.NewLogger()
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body, err := json.Marshal(tc.body)
+			require.Nil(t, err)
+
+			req, err := http.NewRequest("POST", "/", bytes.NewBuffer(body))
+			require.Nil(t, err)
+
+			req.Header.Set("Content-Type", tc.header["Content-Type"])
+
+			rec := httptest.NewRecorder()
+
+			handlerMutate := httphandler.NewMutate(httpLogger, nil, nil)
+			handlerMutate.ServeHTTP(rec, req)
+
+			bodyData, err := ioutil.ReadAll(rec.Body)
+			require.Nil(t, err)
+			require.True(t, json.Get(bodyData, "response", "allowed").ToBool(), string(bodyData))
+
+			patch, err := base64.StdEncoding.DecodeString(json.Get(bodyData, "response", "patch").ToString())
+			require.Nil(t, err)
+
+			require.Equal(t, tc.result.(string), string(patch))
+		})
+	}
+}
+
+func TestHandlerMutateAnnotationPrefix(t *testing.T) {
+	basicSpec := corev1.PodSpec{
+		Containers: []corev1.Container{
+			{
+				Name: "web",
+			},
+		},
+	}
+
+	basicTypeMeta := metav1.TypeMeta{
+		Kind:       "AdmissionReview",
+		APIVersion: "admission.k8s.io/v1",
+	}
+
+	config := sidecar.DefaultConfig()
+	config.AnnotationPrefix = "sidecar.example.com/"
+	config.LegacyAnnotationPrefixes = []string{sidecar.DefaultAnnotationPrefix}
+
+	testCases := []struct {
+		name   string
+		header map[string]string
+		body   interface{}
+		result interface{}
+	}{
+		{
+			"OKContainerPrefix",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Namespace: "container-injector",
+					Object: encodeRaw(t, &corev1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								"sidecar.example.com/inject": "true",
+								"sidecar.example.com/name":   "curl-ssl",
+								"sidecar.example.com/image":  "govermentpaas/curl-ssl",
+							},
+						},
+						Spec: basicSpec,
+					}),
+				},
+			},
+			`[{"op":"add","path":"/spec/containers/-","value":{"name":"curl-ssl","image":"govermentpaas/curl-ssl","resources":{}}},{"op":"add","path":"/metadata/annotations/sidecar.example.com~1injected-containers","value":"curl-ssl"},{"op":"add","path":"/metadata/annotations/sidecar.example.com~1status","value":"injected"},{"op":"add","path":"/metadata/annotations/sidecar.example.com~1status-hash","value":"d5f2fec26413da0f"},{"op":"add","path":"/metadata/annotations/sidecar.example.com~1status-version","value":"dev"}]`,
+		},
+		{
+			"OKContainerLegacyPrefix",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Namespace: "container-injector",
+					Object: encodeRaw(t, &corev1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								sidecar.AnnotationContainerInject: "true",
+								sidecar.AnnotationContainerName:   "curl-ssl",
+								sidecar.AnnotationContainerImage:  "govermentpaas/curl-ssl",
+							},
+						},
+						Spec: basicSpec,
+					}),
+				},
+			},
+			`[{"op":"add","path":"/spec/containers/-","value":{"name":"curl-ssl","image":"govermentpaas/curl-ssl","resources":{}}},{"op":"add","path":"/metadata/annotations/sidecar.example.com~1injected-containers","value":"curl-ssl"},{"op":"add","path":"/metadata/annotations/sidecar.example.com~1status","value":"injected"},{"op":"add","path":"/metadata/annotations/sidecar.example.com~1status-hash","value":"d5f2fec26413da0f"},{"op":"add","path":"/metadata/annotations/sidecar.example.com~1status-version","value":"dev"}]`,
+		},
+		{
+			"OKContainerLegacyStatus",
+			map[string]string{
+				"Content-Type": "application/json",
+			},
+			v1.AdmissionReview{
+				TypeMeta: basicTypeMeta,
+				Request: &v1.AdmissionRequest{
+					Namespace: "container-injector",
+					Object: encodeRaw(t, &corev1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								sidecar.AnnotationContainerInject: "true",
+								sidecar.AnnotationContainerName:   "curl-ssl",
+								sidecar.AnnotationContainerImage:  "govermentpaas/curl-ssl",
+								sidecar.AnnotationContainerStatus: "injected",
+							},
+						},
+						Spec: basicSpec,
+					}),
+				},
+			},
+			``,
+		},
+	}
+
+	// Set logger
+	httpLogger := log.NewLogger()
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var body []byte
+			var err error
+
+			if tc.body != nil {
+				body, err = json.Marshal(tc.body)
+				require.Nil(t, err)
+			}
+
+			req, err := http.NewRequest("POST", "/", bytes.NewBuffer(body))
+			require.Nil(t, err)
+
+			req.Header.Set("Content-Type", tc.header["Content-Type"])
+
+			rec := httptest.NewRecorder()
+
+			handlerMutate := httphandler.NewMutate(httpLogger, nil, config)
+			handlerMutate.ServeHTTP(rec, req)
+
+			bodyData, err := ioutil.ReadAll(rec.Body)
+			require.Nil(t, err)
+
+			patch, err := base64.StdEncoding.DecodeString(json.Get(bodyData, "response", "patch").ToString())
+			require.Nil(t, err)
+
+			require.Equal(t, tc.result.(string), string(patch))
+		})
+	}
+}
+
+func TestHandlerMutateWarnings(t *testing.T) {
+	basicSpec := corev1.PodSpec{
+		Containers: []corev1.Container{
+			{
+				Name: "web",
+			},
+		},
+	}
+
+	config := sidecar.DefaultConfig()
+	config.AnnotationPrefix = "sidecar.example.com/"
+	config.LegacyAnnotationPrefixes = []string{sidecar.DefaultAnnotationPrefix}
+
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		result      interface{}
+	}{
+		{
+			"OKInjected",
+			map[string]string{
+				"sidecar.example.com/inject":    "true",
+				"sidecar.example.com/configmap": "curl-ssl",
+			},
+			`{"allowed":true,"auditAnnotations":{"containers":"curl-ssl","decision":"injected","templates":"curl-ssl=configmap:curl-ssl"}}`,
+		},
+		{
+			"OKDeprecatedAnnotations",
+			map[string]string{
+				"sidecar.example.com/inject":        "true",
+				"container-injector.uthng.me/name":  "curl-ssl",
+				"container-injector.uthng.me/image": "govermentpaas/curl-ssl",
+				"sidecar.example.com/imag":          "govermentpaas/curl-ssl",
+			},
+			`{"allowed":true,"auditAnnotations":{"containers":"curl-ssl","decision":"injected"},"warnings":[
+	"annotation 'container-injector.uthng.me/image' is deprecated, use 'sidecar.example.com/image' instead",
+	"annotation 'container-injector.uthng.me/name' is deprecated, use 'sidecar.example.com/name' instead",
+	"unknown annotation 'sidecar.example.com/imag' is ignored"
+]}`,
+		},
+		{
+			"OKSkippedInjectMissing",
+			map[string]string{
+				"sidecar.example.com/name":  "curl-ssl",
+				"sidecar.example.com/image": "govermentpaas/curl-ssl",
+			},
+			`{"allowed":true,"auditAnnotations":{"decision":"skipped","reason":"annotation 'sidecar.example.com/inject' not found"},"warnings":[
+	"injection skipped: annotation 'sidecar.example.com/inject' not found"
+]}`,
+		},
+		{
+			"OKSkippedNoAnnotation",
+			map[string]string{},
+			`{"allowed":true,"auditAnnotations":{"decision":"skipped","reason":"annotation 'sidecar.example.com/inject' not found"}}`,
+		},
+		{
+			"OKSkippedInjectDisabled",
+			map[string]string{
+				"sidecar.example.com/inject": "false",
+			},
+			`{"allowed":true,"auditAnnotations":{"decision":"skipped","reason":"injection disabled"}}`,
+		},
+		{
+			"OKSkippedAlreadyInjected",
+			map[string]string{
+				"sidecar.example.com/inject": "true",
+				"sidecar.example.com/status": "injected",
+			},
+			`{"allowed":true,"auditAnnotations":{"decision":"skipped","reason":"already injected"}}`,
+		},
+		{
+			"OKIgnoredSettings",
+			map[string]string{
+				"sidecar.example.com/inject":     "true",
+				"sidecar.example.com/name":       "curl-ssl",
+				"sidecar.example.com/image":      "govermentpaas/curl-ssl",
+				"sidecar.example.com/init-first": "true",
+			},
+			`{"allowed":true,"auditAnnotations":{"containers":"curl-ssl","decision":"injected"},"warnings":[
+	"annotation 'sidecar.example.com/init-first' is ignored by regular containers"
+]}`,
+		},
+		{
+			"OKDenied",
+			map[string]string{
+				"sidecar.example.com/inject":      "true",
+				"sidecar.example.com/name":        "curl-ssl",
+				"sidecar.example.com/image":       "govermentpaas/curl-ssl",
+				"sidecar.example.com/pull-policy": "Sometimes",
+			},
+			`{"allowed":false,"auditAnnotations":{"decision":"denied","reason":"metadata.annotations[sidecar.example.com/pull-policy]: Unsupported value: \"Sometimes\": supported values: \"Always\", \"IfNotPresent\", \"Never\""}}`,
+		},
+	}
+
+	// Set logger
+	httpLogger := log.NewLogger()
+
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "curl-ssl",
+			Namespace: "container-injector",
+		},
+		Data: map[string]string{
+			sidecar.ConfigMapKeyContainer: `{"name": "curl-ssl", "image": "govermentpaas/curl-ssl"}`,
+		},
+	})
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body, err := json.Marshal(v1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "AdmissionReview",
+					APIVersion: "admission.k8s.io/v1",
+				},
+				Request: &v1.AdmissionRequest{
+					Namespace: "container-injector",
+					Object: encodeRaw(t, &corev1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: tc.annotations,
+						},
+						Spec: basicSpec,
+					}),
+				},
+			})
+			require.Nil(t, err)
+
+			req, err := http.NewRequest("POST", "/", bytes.NewBuffer(body))
+			require.Nil(t, err)
+
+			req.Header.Set("Content-Type", "application/json")
+
+			rec := httptest.NewRecorder()
+
+			handlerMutate := httphandler.NewMutate(httpLogger, clientset, config)
+			handlerMutate.ServeHTTP(rec, req)
+
+			bodyData, err := ioutil.ReadAll(rec.Body)
+			require.Nil(t, err)
+
+			response := map[string]interface{}{
+				"allowed":          json.Get(bodyData, "response", "allowed").GetInterface(),
+				"auditAnnotations": json.Get(bodyData, "response", "auditAnnotations").GetInterface(),
+			}
+
+			if warnings := json.Get(bodyData, "response", "warnings"); warnings.LastError() == nil {
+				response["warnings"] = warnings.GetInterface()
+			}
+
+			result, err := json.Marshal(response)
+			require.Nil(t, err)
+
+			require.JSONEq(t, tc.result.(string), string(result))
+		})
+	}
+}
+
+func TestHandlerMutateOnError(t *testing.T) {
+	basicSpec := corev1.PodSpec{
+		Containers: []corev1.Container{
+			{
+				Name: "web",
+			},
+		},
+	}
+
+	invalidAnnotations := map[string]string{
+		sidecar.AnnotationContainerInject:     "true",
+		sidecar.AnnotationContainerName:       "curl-ssl",
+		sidecar.AnnotationContainerImage:      "govermentpaas/curl-ssl",
+		sidecar.AnnotationContainerPullPolicy: "Sometimes",
+	}
+
+	// withAnnotations returns the invalid annotations with the given ones
+	withAnnotations := func(annotations map[string]string) map[string]string {
+		result := map[string]string{}
+
+		for k, v := range invalidAnnotations {
+			result[k] = v
+		}
+
+		for k, v := range annotations {
+			result[k] = v
+		}
+
+		return result
+	}
+
+	testCases := []struct {
+		name        string
+		onError     string
+		namespace   string
+		annotations map[string]string
+		result      interface{}
+	}{
+		{
+			"OKServerDeny",
+			sidecar.OnErrorDeny,
+			"container-injector",
+			invalidAnnotations,
+			`{"allowed":false,"auditAnnotations":{"decision":"denied","reason":"metadata.annotations[container-injector.uthng.me/pull-policy]: Unsupported value: \"Sometimes\": supported values: \"Always\", \"IfNotPresent\", \"Never\""},"patch":""}`,
+		},
+		{
+			"OKServerAllowWithWarning",
+			sidecar.OnErrorAllowWithWarning,
+			"container-injector",
+			invalidAnnotations,
+			`{"allowed":true,"auditAnnotations":{"decision":"failed","on-error":"allow-with-warning","reason":"metadata.annotations[container-injector.uthng.me/pull-policy]: Unsupported value: \"Sometimes\": supported values: \"Always\", \"IfNotPresent\", \"Never\""},"patch":"[{\"op\":\"add\",\"path\":\"/metadata/annotations/container-injector.uthng.me~1injection-error\",\"value\":\"metadata.annotations[container-injector.uthng.me/pull-policy]: Unsupported value: \\\"Sometimes\\\": supported values: \\\"Always\\\", \\\"IfNotPresent\\\", \\\"Never\\\"\"}]","warnings":["injection failed: metadata.annotations[container-injector.uthng.me/pull-policy]: Unsupported value: \"Sometimes\": supported values: \"Always\", \"IfNotPresent\", \"Never\""]}`,
+		},
+		{
+			"OKServerAllowSilently",
+			sidecar.OnErrorAllowSilently,
+			"container-injector",
+			invalidAnnotations,
+			`{"allowed":true,"auditAnnotations":{"decision":"failed","on-error":"allow-silently","reason":"metadata.annotations[container-injector.uthng.me/pull-policy]: Unsupported value: \"Sometimes\": supported values: \"Always\", \"IfNotPresent\", \"Never\""},"patch":""}`,
+		},
+		{
+			"OKNamespaceAllowWithWarning",
+			sidecar.OnErrorDeny,
+			"allow-with-warning",
+			invalidAnnotations,
+			`{"allowed":true,"auditAnnotations":{"decision":"failed","on-error":"allow-with-warning","reason":"metadata.annotations[container-injector.uthng.me/pull-policy]: Unsupported value: \"Sometimes\": supported values: \"Always\", \"IfNotPresent\", \"Never\""},"patch":"[{\"op\":\"add\",\"path\":\"/metadata/annotations/container-injector.uthng.me~1injection-error\",\"value\":\"metadata.annotations[container-injector.uthng.me/pull-policy]: Unsupported value: \\\"Sometimes\\\": supported values: \\\"Always\\\", \\\"IfNotPresent\\\", \\\"Never\\\"\"}]","warnings":["injection failed: metadata.annotations[container-injector.uthng.me/pull-policy]: Unsupported value: \"Sometimes\": supported values: \"Always\", \"IfNotPresent\", \"Never\""]}`,
+		},
+		{
+			"OKPodDeny",
+			sidecar.OnErrorAllowSilently,
+			"allow-with-warning",
+			withAnnotations(map[string]string{
+				sidecar.AnnotationContainerOnError: sidecar.OnErrorDeny,
+			}),
+			`{"allowed":false,"auditAnnotations":{"decision":"denied","reason":"metadata.annotations[container-injector.uthng.me/pull-policy]: Unsupported value: \"Sometimes\": supported values: \"Always\", \"IfNotPresent\", \"Never\""},"patch":""}`,
+		},
+		{
+			"OKPodInvalidMode",
+			sidecar.OnErrorAllowSilently,
+			"container-injector",
+			withAnnotations(map[string]string{
+				sidecar.AnnotationContainerOnError: "allow",
+			}),
+			`{"allowed":true,"auditAnnotations":{"decision":"failed","on-error":"allow-silently","reason":"metadata.annotations[container-injector.uthng.me/pull-policy]: Unsupported value: \"Sometimes\": supported values: \"Always\", \"IfNotPresent\", \"Never\""},"patch":"","warnings":["invalid failure mode 'allow' in annotation 'container-injector.uthng.me/on-error' of the pod: must be one of [deny allow-with-warning allow-silently]"]}`,
+		},
+		{
+			"OKPanicAllowWithWarning",
+			sidecar.OnErrorAllowWithWarning,
+			"container-injector",
+			map[string]string{
+				sidecar.AnnotationContainerInject:    "true",
+				sidecar.AnnotationContainerConfigMap: "panic",
+			},
+			`{"allowed":true,"auditAnnotations":{"decision":"failed","on-error":"allow-with-warning","reason":"internal error: configmap getter panicked"},"patch":"[{\"op\":\"add\",\"path\":\"/metadata/annotations/container-injector.uthng.me~1injection-error\",\"value\":\"internal error: configmap getter panicked\"}]","warnings":["injection failed: internal error: configmap getter panicked"]}`,
+		},
+		{
+			"OKInjectionErrorRemoved",
+			sidecar.OnErrorAllowWithWarning,
+			"container-injector",
+			map[string]string{
+				sidecar.AnnotationContainerInject:         "true",
+				sidecar.AnnotationContainerName:           "curl-ssl",
+				sidecar.AnnotationContainerImage:          "govermentpaas/curl-ssl",
+				sidecar.AnnotationContainerInjectionError: "previous error",
+			},
+			`{"allowed":true,"auditAnnotations":{"containers":"curl-ssl","decision":"injected"},"patch":"[{\"op\":\"add\",\"path\":\"/spec/containers/-\",\"value\":{\"name\":\"curl-ssl\",\"image\":\"govermentpaas/curl-ssl\",\"resources\":{}}},{\"op\":\"add\",\"path\":\"/metadata/annotations/container-injector.uthng.me~1injected-containers\",\"value\":\"curl-ssl\"},{\"op\":\"add\",\"path\":\"/metadata/annotations/container-injector.uthng.me~1status\",\"value\":\"injected\"},{\"op\":\"add\",\"path\":\"/metadata/annotations/container-injector.uthng.me~1status-hash\",\"value\":\"d5f2fec26413da0f\"},{\"op\":\"add\",\"path\":\"/metadata/annotations/container-injector.uthng.me~1status-version\",\"value\":\"dev\"},{\"op\":\"remove\",\"path\":\"/metadata/annotations/container-injector.uthng.me~1injection-error\"}]"}`,
+		},
+	}
+
+	// Set logger
+	httpLogger := log.NewLogger()
+
+	clientset := fake.NewSimpleClientset(
+		&corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "container-injector",
+			},
+		},
+		&corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "allow-with-warning",
+				Annotations: map[string]string{
+					sidecar.AnnotationContainerOnError: sidecar.OnErrorAllowWithWarning,
+				},
+			},
+		},
+	)
+
+	// Loading the configmap panics to check that panics are recovered
+	clientset.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		panic("configmap getter panicked")
+	})
+
+	namespaceReads := 0
+
+	clientset.PrependReactor("get", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		namespaceReads++
+		return false, nil, nil
+	})
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := sidecar.DefaultConfig()
+			config.OnError = tc.onError
+
+			namespaceReads = 0
+
+			body, err := json.Marshal(v1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "AdmissionReview",
+					APIVersion: "admission.k8s.io/v1",
+				},
+				Request: &v1.AdmissionRequest{
+					UID:       "0b2f2ed4-6b1f-4d3a-9d49-3c8f6fd3e0a1",
+					Namespace: tc.namespace,
+					Object: encodeRaw(t, &corev1.Pod{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: tc.annotations,
+						},
+						Spec: basicSpec,
+					}),
+				},
+			})
+			require.Nil(t, err)
+
+			req, err := http.NewRequest("POST", "/", bytes.NewBuffer(body))
+			require.Nil(t, err)
+
+			req.Header.Set("Content-Type", "application/json")
+
+			rec := httptest.NewRecorder()
+
+			handlerMutate := httphandler.NewMutate(httpLogger, clientset, config)
+			handlerMutate.ServeHTTP(rec, req)
+
+			bodyData, err := ioutil.ReadAll(rec.Body)
+			require.Nil(t, err)
+
+			require.Equal(t, "0b2f2ed4-6b1f-4d3a-9d49-3c8f6fd3e0a1", json.Get(bodyData, "response", "uid").ToString())
+
+			patch, err := base64.StdEncoding.DecodeString(json.Get(bodyData, "response", "patch").ToString())
+			require.Nil(t, err)
+
+			response := map[string]interface{}{
+				"allowed":          json.Get(bodyData, "response", "allowed").GetInterface(),
+				"auditAnnotations": json.Get(bodyData, "response", "auditAnnotations").GetInterface(),
+				"patch":            string(patch),
+			}
+
+			if warnings := json.Get(bodyData, "response", "warnings"); warnings.LastError() == nil {
+				response["warnings"] = warnings.GetInterface()
+			}
+
+			result, err := json.Marshal(response)
+			require.Nil(t, err)
+
+			require.JSONEq(t, tc.result.(string), string(result))
+
+			// The namespace is not read when the pod sets a valid failure mode
+			if tc.annotations[sidecar.AnnotationContainerOnError] == sidecar.OnErrorDeny {
+				require.Zero(t, namespaceReads)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package http
+
+import (
+	"k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+)
+
+// toV1Request converts an admission/v1beta1 request to admission/v1
+// so that both versions are mutated the same way.
+func toV1Request(req *v1beta1.AdmissionRequest) *v1.AdmissionRequest {
+	return &v1.AdmissionRequest{
+		UID:                req.UID,
+		Kind:               req.Kind,
+		Resource:           req.Resource,
+		SubResource:        req.SubResource,
+		RequestKind:        req.RequestKind,
+		RequestResource:    req.RequestResource,
+		RequestSubResource: req.RequestSubResource,
+		Name:               req.Name,
+		Namespace:          req.Namespace,
+		Operation:          v1.Operation(req.Operation),
+		UserInfo:           req.UserInfo,
+		Object:             req.Object,
+		OldObject:          req.OldObject,
+		DryRun:             req.DryRun,
+		Options:            req.Options,
+	}
+}
+
+// toV1beta1Response converts an admission/v1 response to admission/v1beta1
+// to answer a v1beta1 request.
+func toV1beta1Response(resp *v1.AdmissionResponse) *v1beta1.AdmissionResponse {
+	result := &v1beta1.AdmissionResponse{
+		UID:              resp.UID,
+		Allowed:          resp.Allowed,
+		Result:           resp.Result,
+		Patch:            resp.Patch,
+		AuditAnnotations: resp.AuditAnnotations,
+		Warnings:         resp.Warnings,
+	}
+
+	if resp.PatchType != nil {
+		patchType := v1beta1.PatchType(*resp.PatchType)
+		result.PatchType = &patchType
+	}
+
+	return result
+}
@@ -0,0 +1,108 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// templatePath is the path of the pod template in workload controllers.
+	templatePath = "/spec/template"
+
+	// jobTemplatePath is the path of the pod template in cronjobs.
+	jobTemplatePath = "/spec/jobTemplate/spec/template"
+)
+
+// DecodePod decodes the pod of an object of the given kind. For workload
+// controllers, the pod is built from the pod template and the returned path
+// prefixes its patches. Objects without kind are pods.
+func DecodePod(kind metav1.GroupVersionKind, raw []byte) (*corev1.Pod, string, error) {
+	switch {
+	case kind.Kind == "" || kind.Group == "" && kind.Kind == "Pod":
+		pod := &corev1.Pod{}
+		if err := json.Unmarshal(raw, pod); err != nil {
+			return nil, "", err
+		}
+
+		return pod, "", nil
+	case kind.Group == "apps" && kind.Kind == "Deployment":
+		obj := &appsv1.Deployment{}
+		if err := json.Unmarshal(raw, obj); err != nil {
+			return nil, "", err
+		}
+
+		return templatePod(obj.ObjectMeta, obj.Spec.Template), templatePath, nil
+	case kind.Group == "apps" && kind.Kind == "StatefulSet":
+		obj := &appsv1.StatefulSet{}
+		if err := json.Unmarshal(raw, obj); err != nil {
+			return nil, "", err
+		}
+
+		return templatePod(obj.ObjectMeta, obj.Spec.Template), templatePath, nil
+	case kind.Group == "apps" && kind.Kind == "DaemonSet":
+		obj := &appsv1.DaemonSet{}
+		if err := json.Unmarshal(raw, obj); err != nil {
+			return nil, "", err
+		}
+
+		return templatePod(obj.ObjectMeta, obj.Spec.Template), templatePath, nil
+	case kind.Group == "apps" && kind.Kind == "ReplicaSet":
+		obj := &appsv1.ReplicaSet{}
+		if err := json.Unmarshal(raw, obj); err != nil {
+			return nil, "", err
+		}
+
+		return templatePod(obj.ObjectMeta, obj.Spec.Template), templatePath, nil
+	case kind.Group == "batch" && kind.Kind == "Job":
+		obj := &batchv1.Job{}
+		if err := json.Unmarshal(raw, obj); err != nil {
+			return nil, "", err
+		}
+
+		return templatePod(obj.ObjectMeta, obj.Spec.Template), templatePath, nil
+	case kind.Group == "batch" && kind.Kind == "CronJob":
+		obj := &batchv1.CronJob{}
+		if err := json.Unmarshal(raw, obj); err != nil {
+			return nil, "", err
+		}
+
+		return templatePod(obj.ObjectMeta, obj.Spec.JobTemplate.Spec.Template), jobTemplatePath, nil
+	}
+
+	return nil, "", fmt.Errorf("unsupported kind: %s", kindName(kind))
+}
+
+// immutableTemplate checks if the pod template of the kind cannot be changed
+// once the object is created, as for Jobs.
+func immutableTemplate(kind metav1.GroupVersionKind) bool {
+	return kind.Group == "batch" && kind.Kind == "Job"
+}
+
+// templatePod returns a pod with the metadata and the spec of the pod template.
+// The namespace of the workload is used by the templates of annotation values.
+func templatePod(meta metav1.ObjectMeta, template corev1.PodTemplateSpec) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: template.ObjectMeta,
+		Spec:       template.Spec,
+	}
+
+	if pod.Namespace == "" {
+		pod.Namespace = meta.Namespace
+	}
+
+	return pod
+}
+
+// kindName returns the kind with its group such as "Deployment.apps".
+func kindName(kind metav1.GroupVersionKind) string {
+	if kind.Group == "" {
+		return kind.Kind
+	}
+
+	return kind.Kind + "." + kind.Group
+}
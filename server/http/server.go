@@ -7,10 +7,12 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"k8s.io/client-go/kubernetes"
 
 	log "github.com/uthng/golog"
 
 	httphandler "github.com/uthng/container-injector/handlers/http"
+	"github.com/uthng/container-injector/sidecar"
 )
 
 // Server describes a list of functions for this interface
@@ -24,21 +26,29 @@ type Server struct {
 
 	mutate http.Handler
 
+	clientset kubernetes.Interface
+
+	config *sidecar.Config
+
 	addr     string
 	certFile string
 	keyFile  string
 }
 
-// NewServer returns a new interface
-func NewServer(addr, certFile, keyFile string, logger *log.Logger) *Server {
+// NewServer returns a new interface. The clientset can be nil
+// if no Kubernetes API access is required. The config gives the
+// default values of the injection.
+func NewServer(addr, certFile, keyFile string, clientset kubernetes.Interface, config *sidecar.Config, logger *log.Logger) *Server {
 	s := &Server{
-		logger:   logger,
-		addr:     addr,
-		certFile: certFile,
-		keyFile:  keyFile,
+		logger:    logger,
+		addr:      addr,
+		certFile:  certFile,
+		keyFile:   keyFile,
+		clientset: clientset,
+		config:    config,
 	}
 
-	s.mutate = httphandler.NewMutate(logger)
+	s.mutate = httphandler.NewMutate(logger, clientset, config)
 
 	return s
 }
@@ -1,11 +1,56 @@
 package sidecar
 
+import (
+	"regexp"
+	"strings"
+)
+
+// DefaultAnnotationPrefix is the prefix of all annotations managed by the injector.
+// The annotations below are given with it and are renamed when another
+// prefix is configured.
+const DefaultAnnotationPrefix = "container-injector.uthng.me/"
+
 const (
 	// AnnotationContainerStatus is the annotation that is added to
 	// a pod after an injection is done.
 	// The value must be "injected".
 	AnnotationContainerStatus = "container-injector.uthng.me/status"
 
+	// AnnotationContainerStatusHash is the hash of the containers, volumes and
+	// volume mounts injected in the pod. A new injection producing the same hash
+	// does not change the pod.
+	AnnotationContainerStatusHash = "container-injector.uthng.me/status-hash"
+
+	// AnnotationContainerStatusVersion is the version of the container-injector
+	// which injected the pod.
+	AnnotationContainerStatusVersion = "container-injector.uthng.me/status-version"
+
+	// AnnotationContainerInjectedContainers is the comma-separated list of the
+	// containers injected in the pod. It is added to the pod by the injection
+	// so that a new injection replaces the containers instead of adding them.
+	AnnotationContainerInjectedContainers = "container-injector.uthng.me/injected-containers"
+
+	// AnnotationContainerInjectedVolumes is the comma-separated list of the volumes
+	// added to the pod by the injection.
+	AnnotationContainerInjectedVolumes = "container-injector.uthng.me/injected-volumes"
+
+	// AnnotationContainerOnCollision is the strategy used when an injected container,
+	// volume or container port has the name or the number of one of the pod:
+	// "fail" rejects the pod (default), "reuse" keeps the one of the pod and
+	// "suffix" renames the injected one with a numeric suffix or uses the next free port.
+	AnnotationContainerOnCollision = "container-injector.uthng.me/on-collision"
+
+	// AnnotationContainerOnError is the failure mode when the injection fails:
+	// "deny" rejects the pod, "allow-with-warning" admits it without injection
+	// with a warning and the injection-error annotation and "allow-silently"
+	// admits it without injection. It can also be set on the namespace of the pod.
+	// Default is the failure mode of the server.
+	AnnotationContainerOnError = "container-injector.uthng.me/on-error"
+
+	// AnnotationContainerInjectionError is the error added to a pod admitted
+	// without injection by the "allow-with-warning" failure mode.
+	AnnotationContainerInjectionError = "container-injector.uthng.me/injection-error"
+
 	// AnnotationContainerInject controls whether injection is explicitly
 	// enabled or disabled for a pod. This should be set to a true or false value,
 	// as parseable by strconv.ParseBool
@@ -18,35 +63,82 @@ const (
 	AnnotationContainerImage = "container-injector.uthng.me/image"
 
 	// AnnotationContainerCommand specifies the command to be executed
-	// when the container starts.
+	// when the container starts. The value is split into words as a shell does
+	// or is a json array of strings such as ["/bin/sh", "-c", "echo hi"].
 	AnnotationContainerCommand = "container-injector.uthng.me/command"
 
 	// AnnotationContainerArgs is the list of arguments for the command
-	// to be executed when the container starts.
+	// to be executed when the container starts. It is parsed as the command.
 	AnnotationContainerArgs = "container-injector.uthng.me/args"
 
-	// AnnotationContainerInitContainer makes the initialization container the first container
-	// to run when a pod starts. Default is last.
+	// AnnotationContainerInitContainer injects the container as an initialization
+	// container in "/spec/initContainers" instead of a regular container.
 	AnnotationContainerInitContainer = "container-injector.uthng.me/init-container"
 
 	// AnnotationContainerInitFirst makes the initialization container the first container
 	// to run when a pod starts. Default is last.
 	AnnotationContainerInitFirst = "container-injector.uthng.me/init-first"
 
+	// AnnotationContainerExpandTemplates controls whether the values of the
+	// annotations of the container are expanded as templates of the pod metadata.
+	// Default is true.
+	AnnotationContainerExpandTemplates = "container-injector.uthng.me/expand-templates"
+
+	// AnnotationContainerInitPosition is the index at which the initialization
+	// container is inserted among the existing ones. Default is last.
+	// It cannot be used together with init-first.
+	AnnotationContainerInitPosition = "container-injector.uthng.me/init-position"
+
+	// AnnotationContainerSidecarMode is the way the container is injected: "classic"
+	// as a regular container or "native" as an init container whose restart policy
+	// is Always. Default is the mode configured on the server. It has no effect
+	// on the containers injected with init-container.
+	AnnotationContainerSidecarMode = "container-injector.uthng.me/sidecar-mode"
+
+	// AnnotationContainerStartupProbe is the json startup probe of the container.
+	// Containers started after a native sidecar wait for its startup probe to succeed.
+	AnnotationContainerStartupProbe = "container-injector.uthng.me/startup-probe"
+
 	// AnnotationContainerPullPolicy specifies the pull policy for container image.
 	AnnotationContainerPullPolicy = "container-injector.uthng.me/pull-policy"
 
 	// AnnotationContainerEnv specifies the environment variables and their values
 	// for the container. The name of the environment variables is the part after
 	// "container-injector.uthng.me/env-" such as "container-injector.uthng.me/env-TLS_SECRETS".
+	// The value can also reference a source such as "secret:<name>/<key>",
+	// "configmap:<name>/<key>", "field:<path>", "resource:<resource>" or be
+	// a json object such as {"secretKeyRef": {"name": "<name>", "key": "<key>"}}.
 	AnnotationContainerEnv = "container-injector.uthng.me/env"
 
+	// AnnotationContainerEnvFrom specifies the secrets and configmaps whose keys are
+	// exposed as environment variables. The value is a comma-separated list such as
+	// "secret:<name>,configmap:<name>" or a json list of EnvFromSource.
+	AnnotationContainerEnvFrom = "container-injector.uthng.me/env-from"
+
+	// AnnotationContainerEnvOrder is the comma-separated list of environment variables
+	// placed first in the container, in this order. It allows variables to reference
+	// others with "$(NAME)". Other variables follow sorted by name.
+	AnnotationContainerEnvOrder = "container-injector.uthng.me/env-order"
+
 	// AnnotationContainerVolumeMount specifies the volume mount paths
 	// in the container. The name of the volumes is the part after
 	// "container-injector.uthng.me/volume-mount-" such as
 	//"container-injector.uthng.me/volume-mount-config".
 	AnnotationContainerVolumeMount = "container-injector.uthng.me/volume-mount"
 
+	// AnnotationContainerAppVolumeMount specifies the volume mount paths in the
+	// application containers of the pod, so that they share volumes with the
+	// injected container. The name of the volumes is the part after
+	// "container-injector.uthng.me/app-volume-mount-" such as
+	// "container-injector.uthng.me/app-volume-mount-data". The value can be a
+	// json volume mount with an additional "containers" list restricting the
+	// containers in which the volume is mounted.
+	AnnotationContainerAppVolumeMount = "container-injector.uthng.me/app-volume-mount"
+
+	// AnnotationContainerAppContainers is the comma-separated list of application
+	// containers and init containers receiving the app volume mounts. Default is all.
+	AnnotationContainerAppContainers = "container-injector.uthng.me/app-containers"
+
 	// AnnotationContainerVolumeSource specifies the source of volumes to mount
 	// in the pod. The name of the volume source is the part after
 	// "container-injector.uthng.me/volume-source" such as
@@ -57,6 +149,11 @@ const (
 	// configuration file and templates can be found.
 	AnnotationContainerConfigMap = "container-injector.uthng.me/configmap"
 
+	// AnnotationContainerProfile is the name of the profile of the server configuration
+	// used as container template. Only the annotations allowed by the profile can
+	// override it. It cannot be used together with configmap.
+	AnnotationContainerProfile = "container-injector.uthng.me/profile"
+
 	// AnnotationContainerLimitsCPU sets the CPU limit on the  Container containers.
 	AnnotationContainerLimitsCPU = "container-injector.uthng.me/limits-cpu"
 
@@ -69,13 +166,184 @@ const (
 	// AnnotationContainerRequestsMem sets the requested memory amount on the  Container containers.
 	AnnotationContainerRequestsMem = "container-injector.uthng.me/requests-mem"
 
+	// AnnotationContainerLimitsEphemeralStorage sets the ephemeral storage limit
+	// on the  Container containers.
+	AnnotationContainerLimitsEphemeralStorage = "container-injector.uthng.me/limits-ephemeral-storage"
+
+	// AnnotationContainerRequestsEphemeralStorage sets the requested ephemeral
+	// storage amount on the  Container containers.
+	AnnotationContainerRequestsEphemeralStorage = "container-injector.uthng.me/requests-ephemeral-storage"
+
+	// AnnotationContainerLimits sets limits for extended resources such as
+	// "nvidia.com/gpu". The value must be a json object mapping resource names
+	// to quantities. Dedicated annotations such as limits-cpu take precedence.
+	AnnotationContainerLimits = "container-injector.uthng.me/limits"
+
+	// AnnotationContainerRequests sets requests for extended resources.
+	// The value must be a json object mapping resource names to quantities.
+	// Dedicated annotations such as requests-cpu take precedence.
+	AnnotationContainerRequests = "container-injector.uthng.me/requests"
+
 	// AnnotationContainerRunAsUser sets the User ID to run the Container Container containers as.
 	AnnotationContainerRunAsUser = "container-injector.uthng.me/run-as-user"
 
 	// AnnotationContainerRunAsGroup sets the Group ID to run the Container Container containers as.
 	AnnotationContainerRunAsGroup = "container-injector.uthng.me/run-as-group"
 
+	// AnnotationContainerRunAsNonRoot requires the container to run as a non-root user.
+	AnnotationContainerRunAsNonRoot = "container-injector.uthng.me/run-as-non-root"
+
+	// AnnotationContainerReadOnlyRootFilesystem mounts the root filesystem
+	// of the container as read-only.
+	AnnotationContainerReadOnlyRootFilesystem = "container-injector.uthng.me/read-only-root-filesystem"
+
+	// AnnotationContainerAllowPrivilegeEscalation controls whether a process
+	// can gain more privileges than its parent process.
+	AnnotationContainerAllowPrivilegeEscalation = "container-injector.uthng.me/allow-privilege-escalation"
+
+	// AnnotationContainerCapabilitiesAdd is the comma-separated list of
+	// capabilities to add to the container such as "NET_ADMIN,SYS_TIME".
+	AnnotationContainerCapabilitiesAdd = "container-injector.uthng.me/capabilities-add"
+
+	// AnnotationContainerCapabilitiesDrop is the comma-separated list of
+	// capabilities to drop from the container such as "ALL".
+	AnnotationContainerCapabilitiesDrop = "container-injector.uthng.me/capabilities-drop"
+
+	// AnnotationContainerSeccompProfile is the seccomp profile of the container:
+	// "runtime/default", "unconfined" or "localhost/<path>".
+	AnnotationContainerSeccompProfile = "container-injector.uthng.me/seccomp-profile"
+
+	// AnnotationContainerSecurityContext is a json security context merged on top
+	// of the one built from the other security annotations.
+	AnnotationContainerSecurityContext = "container-injector.uthng.me/security-context"
+
+	// AnnotationContainerSecurityContextInherit starts the security context of the
+	// container from the one of the first application container.
+	AnnotationContainerSecurityContextInherit = "container-injector.uthng.me/security-context-inherit"
+
+	// AnnotationContainerServiceAccountToken mounts the service account token of the pod
+	// in the container. The value can be "reuse" to share the token volume mounted in
+	// the application containers, "projected" to add a projected token volume, "true"
+	// to reuse the token if possible and to project one otherwise, or "false".
+	AnnotationContainerServiceAccountToken = "container-injector.uthng.me/service-account-token"
+
+	// AnnotationContainerServiceAccountTokenPath is the path where the service account
+	// token is mounted. Default is the path of the reused token or "/var/run/secrets/tokens".
+	AnnotationContainerServiceAccountTokenPath = "container-injector.uthng.me/service-account-token-path"
+
+	// AnnotationContainerServiceAccountTokenAudience is the audience of the projected
+	// service account token. It implies a projected token.
+	AnnotationContainerServiceAccountTokenAudience = "container-injector.uthng.me/service-account-token-audience"
+
+	// AnnotationContainerServiceAccountTokenExpiration is the expiration in seconds of the
+	// projected service account token. It implies a projected token.
+	AnnotationContainerServiceAccountTokenExpiration = "container-injector.uthng.me/service-account-token-expiration"
+
 	// AnnotationContainerTLSSecret is the name of the Kubernetes secret containing
 	// client TLS certificates and keys.
 	AnnotationContainerTLSSecret = "container-injector.uthng.me/tls-secret"
+
+	// AnnotationContainerTLSMountPath is the path where the TLS secret is mounted
+	// in the container. Default is "/etc/tls".
+	AnnotationContainerTLSMountPath = "container-injector.uthng.me/tls-mount-path"
+
+	// AnnotationContainerTLSItems projects keys of the TLS secret to specific paths
+	// relative to the mount path. The value must be a json object mapping keys to
+	// paths such as {"tls.crt": "cert.pem", "tls.key": "key.pem"}. Only projected
+	// keys are mounted.
+	AnnotationContainerTLSItems = "container-injector.uthng.me/tls-items"
+
+	// AnnotationContainerTLSDefaultMode is the mode of the files of the TLS secret
+	// such as "0440".
+	AnnotationContainerTLSDefaultMode = "container-injector.uthng.me/tls-default-mode"
 )
+
+// containerAnnotations are the annotations configuring a container.
+// They can be prefixed by a group name to configure several containers.
+var containerAnnotations = []string{
+	AnnotationContainerName,
+	AnnotationContainerImage,
+	AnnotationContainerCommand,
+	AnnotationContainerArgs,
+	AnnotationContainerInitContainer,
+	AnnotationContainerInitFirst,
+	AnnotationContainerInitPosition,
+	AnnotationContainerSidecarMode,
+	AnnotationContainerExpandTemplates,
+	AnnotationContainerStartupProbe,
+	AnnotationContainerPullPolicy,
+	AnnotationContainerEnvFrom,
+	AnnotationContainerEnvOrder,
+	AnnotationContainerConfigMap,
+	AnnotationContainerProfile,
+	AnnotationContainerLimitsCPU,
+	AnnotationContainerLimitsMem,
+	AnnotationContainerRequestsCPU,
+	AnnotationContainerRequestsMem,
+	AnnotationContainerLimitsEphemeralStorage,
+	AnnotationContainerRequestsEphemeralStorage,
+	AnnotationContainerLimits,
+	AnnotationContainerRequests,
+	AnnotationContainerRunAsUser,
+	AnnotationContainerRunAsGroup,
+	AnnotationContainerRunAsNonRoot,
+	AnnotationContainerReadOnlyRootFilesystem,
+	AnnotationContainerAllowPrivilegeEscalation,
+	AnnotationContainerCapabilitiesAdd,
+	AnnotationContainerCapabilitiesDrop,
+	AnnotationContainerSeccompProfile,
+	AnnotationContainerSecurityContext,
+	AnnotationContainerSecurityContextInherit,
+	AnnotationContainerAppContainers,
+	AnnotationContainerTLSSecret,
+	AnnotationContainerTLSMountPath,
+	AnnotationContainerTLSItems,
+	AnnotationContainerTLSDefaultMode,
+	AnnotationContainerServiceAccountToken,
+	AnnotationContainerServiceAccountTokenPath,
+	AnnotationContainerServiceAccountTokenAudience,
+	AnnotationContainerServiceAccountTokenExpiration,
+}
+
+// containerAnnotationFamilies are the annotations configuring a container
+// whose key is followed by "-<name>".
+var containerAnnotationFamilies = []string{
+	AnnotationContainerEnv,
+	AnnotationContainerVolumeMount,
+	AnnotationContainerAppVolumeMount,
+	AnnotationContainerVolumeSource,
+}
+
+var reAnnotationGroup = regexp.MustCompile(`^` + regexp.QuoteMeta(DefaultAnnotationPrefix) + `([a-z0-9]([-a-z0-9]*[a-z0-9])?)\.(.+)$`)
+
+// isContainerAnnotation checks if the key is an annotation configuring a container
+// of the default group.
+func isContainerAnnotation(key string) bool {
+	for _, annotation := range containerAnnotations {
+		if key == annotation {
+			return true
+		}
+	}
+
+	for _, annotation := range containerAnnotationFamilies {
+		if strings.HasPrefix(key, annotation+"-") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// annotationGroup returns the group of an annotation formed as "<prefix><group>.<name>".
+func annotationGroup(key string) (string, bool) {
+	matches := reAnnotationGroup.FindStringSubmatch(key)
+	if matches == nil {
+		return "", false
+	}
+
+	if !isContainerAnnotation(DefaultAnnotationPrefix + matches[3]) {
+		return "", false
+	}
+
+	return matches[1], true
+}
@@ -0,0 +1,230 @@
+package sidecar
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+const (
+	// CollisionFail rejects the pod when an injected name collides with the pod.
+	CollisionFail = "fail"
+
+	// CollisionReuse uses the container, volume or port of the pod instead
+	// of the injected one.
+	CollisionReuse = "reuse"
+
+	// CollisionSuffix renames the injected container or volume with a numeric
+	// suffix and uses the next free number for ports.
+	CollisionSuffix = "suffix"
+)
+
+var collisionStrategies = []string{
+	CollisionFail,
+	CollisionReuse,
+	CollisionSuffix,
+}
+
+// resolveCollisions applies the collision strategy of the pod to the container
+// names, volumes and ports colliding with the ones of the pod. Containers and
+// volumes of a previous injection are not collisions. It can be called several
+// times as the result only depends on the pod and the loaded templates.
+func (s *Sidecars) resolveCollisions() field.ErrorList {
+	var errs field.ErrorList
+	var containers []*Container
+
+	strategy := CollisionFail
+	if val, ok := s.annotations[s.config.AnnotationKey(AnnotationContainerOnCollision)]; ok {
+		strategy = val
+	}
+
+	if !isCollisionStrategy(strategy) {
+		return append(errs, field.NotSupported(annotationsPath.Key(s.config.AnnotationKey(AnnotationContainerOnCollision)), strategy, collisionStrategies))
+	}
+
+	injectedContainers := s.injectedNames(AnnotationContainerInjectedContainers)
+	injectedVolumes := s.injectedNames(AnnotationContainerInjectedVolumes)
+
+	names := map[string]bool{}
+	volumes := map[string]bool{}
+	ports := map[string]bool{}
+
+	// Volumes declared by several containers are renamed once
+	renamed := map[string]string{}
+
+	for _, container := range append(append([]corev1.Container(nil), s.Pod.Spec.InitContainers...), s.Pod.Spec.Containers...) {
+		if injectedContainers[container.Name] {
+			continue
+		}
+
+		names[container.Name] = true
+
+		for _, port := range container.Ports {
+			ports[portKey(port)] = true
+		}
+	}
+
+	for _, v := range s.Pod.Spec.Volumes {
+		if !injectedVolumes[v.Name] {
+			volumes[v.Name] = true
+		}
+	}
+
+	for _, c := range s.Containers {
+		if names[c.Name] {
+			switch strategy {
+			case CollisionFail:
+				errs = append(errs, field.Duplicate(c.fieldPath(AnnotationContainerName), c.Name))
+			case CollisionReuse:
+				continue
+			case CollisionSuffix:
+				c.Name = uniqueName(c.Name, names)
+			}
+		}
+
+		names[c.Name] = true
+		containers = append(containers, c)
+
+		errs = append(errs, c.resolveVolumeCollisions(strategy, volumes, renamed)...)
+		errs = append(errs, c.resolvePortCollisions(strategy, ports)...)
+	}
+
+	s.Containers = containers
+
+	return errs
+}
+
+// resolveVolumeCollisions resolves the collisions of the volumes declared by
+// the container with the given volumes. The volumes already renamed for another
+// container keep their new name so that they are still shared.
+func (c *Container) resolveVolumeCollisions(strategy string, volumes map[string]bool, renamed map[string]string) field.ErrorList {
+	var errs field.ErrorList
+
+	declared, err := c.declaredVolumes()
+	if err != nil {
+		// Reported by the validation of the volumes
+		return nil
+	}
+
+	c.volumeNames = map[string]string{}
+
+	for _, v := range declared {
+		if name, ok := renamed[v.Name]; ok {
+			c.volumeNames[v.Name] = name
+			continue
+		}
+
+		if !volumes[v.Name] {
+			continue
+		}
+
+		switch strategy {
+		case CollisionFail:
+			fldPath := c.fieldPath(c.templateAnnotation())
+			if _, ok := c.annotations[c.annotationKey(AnnotationContainerVolumeSource)+"-"+v.Name]; ok {
+				fldPath = annotationsPath.Key(c.annotationKey(AnnotationContainerVolumeSource) + "-" + v.Name)
+			}
+
+			errs = append(errs, field.Duplicate(fldPath, v.Name))
+		case CollisionReuse:
+			c.volumeNames[v.Name] = ""
+		case CollisionSuffix:
+			name := uniqueName(v.Name, volumes)
+			volumes[name] = true
+			renamed[v.Name] = name
+			c.volumeNames[v.Name] = name
+		}
+	}
+
+	return errs
+}
+
+// resolvePortCollisions resolves the collisions of the ports of the container
+// template with the given ports. The ports of the container are then added to them.
+func (c *Container) resolvePortCollisions(strategy string, ports map[string]bool) field.ErrorList {
+	var errs field.ErrorList
+
+	c.ports = map[int32]int32{}
+
+	if c.Template == nil {
+		return nil
+	}
+
+	for _, port := range c.Template.Container.Ports {
+		if ports[portKey(port)] {
+			switch strategy {
+			case CollisionFail:
+				errs = append(errs, field.Duplicate(c.fieldPath(c.templateAnnotation()).Child("ports"), port.ContainerPort))
+			case CollisionReuse:
+				c.ports[port.ContainerPort] = 0
+				continue
+			case CollisionSuffix:
+				number := port.ContainerPort
+				for ports[portKey(port)] && port.ContainerPort < 65535 {
+					port.ContainerPort++
+				}
+
+				c.ports[number] = port.ContainerPort
+			}
+		}
+
+		ports[portKey(port)] = true
+	}
+
+	return errs
+}
+
+// containerPorts returns the ports after collisions are resolved.
+func (c *Container) containerPorts(ports []corev1.ContainerPort) []corev1.ContainerPort {
+	var result []corev1.ContainerPort
+
+	if len(c.ports) == 0 {
+		return ports
+	}
+
+	for _, port := range ports {
+		if number, ok := c.ports[port.ContainerPort]; ok {
+			if number == 0 {
+				continue
+			}
+
+			port.ContainerPort = number
+		}
+
+		result = append(result, port)
+	}
+
+	return result
+}
+
+// portKey identifies a port by its number and protocol.
+func portKey(port corev1.ContainerPort) string {
+	protocol := port.Protocol
+	if protocol == "" {
+		protocol = corev1.ProtocolTCP
+	}
+
+	return fmt.Sprintf("%d/%s", port.ContainerPort, protocol)
+}
+
+// uniqueName returns the name with the first numeric suffix not used.
+func uniqueName(name string, used map[string]bool) string {
+	result := name
+
+	for i := 1; used[result]; i++ {
+		result = fmt.Sprintf("%s-%d", name, i)
+	}
+
+	return result
+}
+
+func isCollisionStrategy(strategy string) bool {
+	for _, s := range collisionStrategies {
+		if s == strategy {
+			return true
+		}
+	}
+
+	return false
+}
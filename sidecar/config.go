@@ -0,0 +1,253 @@
+package sidecar
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// SidecarModeClassic injects the containers as regular containers.
+	SidecarModeClassic = "classic"
+
+	// SidecarModeNative injects the containers as init containers restarted
+	// during the whole life of the pod. It requires Kubernetes 1.28 or later.
+	SidecarModeNative = "native"
+)
+
+var sidecarModes = []string{
+	SidecarModeClassic,
+	SidecarModeNative,
+}
+
+// Config is the server-wide configuration of the injection.
+type Config struct {
+	// SidecarMode is the mode of the containers configured
+	// without the sidecar-mode annotation.
+	SidecarMode string
+
+	// Profiles are the container templates selected by the profile annotation.
+	Profiles map[string]*Profile
+
+	// AnnotationPrefix is the prefix of the annotations managed by the injector
+	// such as "sidecar.example.com/". Default is DefaultAnnotationPrefix.
+	AnnotationPrefix string
+
+	// LegacyAnnotationPrefixes are other prefixes still accepted in the annotations
+	// of pods. Annotations with AnnotationPrefix take precedence over them.
+	LegacyAnnotationPrefixes []string
+
+	// OnError is the failure mode of the pods configured without the on-error
+	// annotation, neither in the pod nor in its namespace. Default is OnErrorDeny.
+	OnError string
+}
+
+// DefaultConfig returns the configuration used when the server has none.
+func DefaultConfig() *Config {
+	return &Config{
+		SidecarMode:      SidecarModeClassic,
+		AnnotationPrefix: DefaultAnnotationPrefix,
+		OnError:          OnErrorDeny,
+	}
+}
+
+// Validate checks the values of the configuration.
+func (c *Config) Validate() error {
+	if !isSidecarMode(c.SidecarMode) {
+		return fmt.Errorf("invalid sidecar mode '%s': must be one of %v", c.SidecarMode, sidecarModes)
+	}
+
+	if c.OnError != "" && !isOnErrorMode(c.OnError) {
+		return fmt.Errorf("invalid failure mode '%s': must be one of %v", c.OnError, onErrorModes)
+	}
+
+	for _, prefix := range append([]string{c.prefix()}, c.LegacyAnnotationPrefixes...) {
+		if !strings.HasSuffix(prefix, "/") {
+			return fmt.Errorf("invalid annotation prefix '%s': must end with '/'", prefix)
+		}
+
+		if msgs := validation.IsDNS1123Subdomain(strings.TrimSuffix(prefix, "/")); len(msgs) > 0 {
+			return fmt.Errorf("invalid annotation prefix '%s': %s", prefix, strings.Join(msgs, ", "))
+		}
+	}
+
+	return nil
+}
+
+// AnnotationKey returns the key of the annotation, given with the default prefix,
+// with the configured prefix.
+func (c *Config) AnnotationKey(annotation string) string {
+	return c.prefix() + strings.TrimPrefix(annotation, DefaultAnnotationPrefix)
+}
+
+// Annotation returns the value of the annotation, given with the default prefix,
+// in the pod annotations with the configured prefix or else with a legacy one.
+func (c *Config) Annotation(pod *corev1.Pod, annotation string) (string, bool) {
+	val, ok := c.annotations(pod.Annotations)[c.AnnotationKey(annotation)]
+
+	return val, ok
+}
+
+// AnnotationsChanged checks if the annotations configuring the injection differ
+// between the old and the new pod. The annotations recording the injection are
+// ignored, except the status: removing or changing it forces a new injection.
+func (c *Config) AnnotationsChanged(old, pod *corev1.Pod) bool {
+	if c.GetStatus(old).Status == "injected" && c.GetStatus(pod).Status != "injected" {
+		return true
+	}
+
+	return !reflect.DeepEqual(c.injectionAnnotations(old), c.injectionAnnotations(pod))
+}
+
+// injectionAnnotations returns the annotations of the pod with the configured
+// or a legacy prefix except the ones recording the injection.
+func (c *Config) injectionAnnotations(pod *corev1.Pod) map[string]string {
+	result := map[string]string{}
+	status := map[string]bool{}
+
+	for _, annotation := range statusAnnotations {
+		status[c.AnnotationKey(annotation)] = true
+	}
+
+	for k, v := range c.annotations(pod.Annotations) {
+		if strings.HasPrefix(k, c.prefix()) && !status[k] {
+			result[k] = v
+		}
+	}
+
+	return result
+}
+
+// annotations returns the annotations of the pod in which the keys with a legacy
+// prefix use the configured prefix instead. The first legacy prefix in the list
+// takes precedence over the next ones.
+func (c *Config) annotations(annotations map[string]string) map[string]string {
+	result := map[string]string{}
+	prefix := c.prefix()
+
+	for k, v := range annotations {
+		if _, ok := c.legacyPrefix(k); !ok {
+			result[k] = v
+		}
+	}
+
+	for _, legacy := range c.LegacyAnnotationPrefixes {
+		if legacy == prefix {
+			continue
+		}
+
+		for _, k := range sortedKeys(annotations) {
+			if !strings.HasPrefix(k, legacy) {
+				continue
+			}
+
+			key := prefix + strings.TrimPrefix(k, legacy)
+			if _, ok := result[key]; !ok {
+				result[key] = annotations[k]
+			}
+		}
+	}
+
+	return result
+}
+
+// legacyKeys returns the keys of the annotations, given with the default prefix,
+// with every legacy prefix.
+func (c *Config) legacyKeys(annotations ...string) []string {
+	var keys []string
+
+	for _, legacy := range c.LegacyAnnotationPrefixes {
+		if legacy == c.prefix() {
+			continue
+		}
+
+		for _, annotation := range annotations {
+			keys = append(keys, legacy+strings.TrimPrefix(annotation, DefaultAnnotationPrefix))
+		}
+	}
+
+	return keys
+}
+
+// legacyPrefix returns the legacy prefix of the key if it has one
+// and not the configured prefix.
+func (c *Config) legacyPrefix(key string) (string, bool) {
+	if strings.HasPrefix(key, c.prefix()) {
+		return "", false
+	}
+
+	for _, legacy := range c.LegacyAnnotationPrefixes {
+		if strings.HasPrefix(key, legacy) {
+			return legacy, true
+		}
+	}
+
+	return "", false
+}
+
+// isContainerAnnotation checks if the key, with the configured prefix,
+// configures a container of the default group.
+func (c *Config) isContainerAnnotation(key string) bool {
+	if !strings.HasPrefix(key, c.prefix()) {
+		return false
+	}
+
+	return isContainerAnnotation(DefaultAnnotationPrefix + strings.TrimPrefix(key, c.prefix()))
+}
+
+// annotationGroup returns the group of an annotation, with the configured prefix,
+// formed as "<prefix><group>.<name>".
+func (c *Config) annotationGroup(key string) (string, bool) {
+	if !strings.HasPrefix(key, c.prefix()) {
+		return "", false
+	}
+
+	return annotationGroup(DefaultAnnotationPrefix + strings.TrimPrefix(key, c.prefix()))
+}
+
+// annotationGroups returns the sorted names of the annotation groups and
+// whether the default group is configured by flat annotations.
+func (c *Config) annotationGroups(annotations map[string]string) ([]string, bool) {
+	var groups []string
+
+	hasDefault := false
+	found := map[string]bool{}
+
+	for k := range annotations {
+		if group, ok := c.annotationGroup(k); ok {
+			if !found[group] {
+				found[group] = true
+				groups = append(groups, group)
+			}
+		} else if c.isContainerAnnotation(k) {
+			hasDefault = true
+		}
+	}
+
+	sort.Strings(groups)
+
+	return groups, hasDefault
+}
+
+// prefix returns the configured annotation prefix.
+func (c *Config) prefix() string {
+	if c.AnnotationPrefix == "" {
+		return DefaultAnnotationPrefix
+	}
+
+	return c.AnnotationPrefix
+}
+
+func isSidecarMode(mode string) bool {
+	for _, m := range sidecarModes {
+		if m == mode {
+			return true
+		}
+	}
+
+	return false
+}
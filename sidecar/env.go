@@ -0,0 +1,146 @@
+package sidecar
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apiresource "k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	envSourceSecret    = "secret:"
+	envSourceConfigMap = "configmap:"
+	envSourceField     = "field:"
+	envSourceResource  = "resource:"
+)
+
+// parseEnvVarSource parses the value of an environment variable annotation.
+// It returns nil if the value is a literal string rather than a source, using
+// either the short syntax "<type>:<reference>" or a json EnvVarSource object.
+// Json objects are always sources so that a misspelled field is not injected
+// as a literal value.
+func parseEnvVarSource(value string) (*corev1.EnvVarSource, error) {
+	switch {
+	case strings.HasPrefix(value, envSourceSecret):
+		name, key, err := splitKeyRef(strings.TrimPrefix(value, envSourceSecret))
+		if err != nil {
+			return nil, err
+		}
+
+		return &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: name},
+				Key:                  key,
+			},
+		}, nil
+	case strings.HasPrefix(value, envSourceConfigMap):
+		name, key, err := splitKeyRef(strings.TrimPrefix(value, envSourceConfigMap))
+		if err != nil {
+			return nil, err
+		}
+
+		return &corev1.EnvVarSource{
+			ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: name},
+				Key:                  key,
+			},
+		}, nil
+	case strings.HasPrefix(value, envSourceField):
+		path := strings.TrimPrefix(value, envSourceField)
+		if path == "" {
+			return nil, fmt.Errorf("field path must not be empty")
+		}
+
+		return &corev1.EnvVarSource{
+			FieldRef: &corev1.ObjectFieldSelector{FieldPath: path},
+		}, nil
+	case strings.HasPrefix(value, envSourceResource):
+		resource := strings.TrimPrefix(value, envSourceResource)
+		if resource == "" {
+			return nil, fmt.Errorf("resource must not be empty")
+		}
+
+		return &corev1.EnvVarSource{
+			ResourceFieldRef: &corev1.ResourceFieldSelector{
+				Resource: resource,
+				Divisor:  apiresource.MustParse("1"),
+			},
+		}, nil
+	case strings.HasPrefix(strings.TrimSpace(value), "{"):
+		// Values which are not json objects are literal values
+		if !json.Valid([]byte(value)) {
+			return nil, nil
+		}
+
+		// A source with a typo must not be injected as a literal value
+		source := &corev1.EnvVarSource{}
+
+		decoder := json.NewDecoder(bytes.NewReader([]byte(value)))
+		decoder.DisallowUnknownFields()
+
+		if err := decoder.Decode(source); err != nil {
+			return nil, fmt.Errorf("invalid json source: %s", err)
+		}
+
+		if reflect.DeepEqual(source, &corev1.EnvVarSource{}) {
+			return nil, fmt.Errorf("json source must not be empty")
+		}
+
+		return source, nil
+	}
+
+	return nil, nil
+}
+
+// parseEnvFromSources parses a comma-separated list of "secret:<name>" and
+// "configmap:<name>" or a json list of EnvFromSource.
+func parseEnvFromSources(value string) ([]corev1.EnvFromSource, error) {
+	var sources []corev1.EnvFromSource
+
+	if json.Valid([]byte(value)) {
+		if err := json.Unmarshal([]byte(value), &sources); err != nil {
+			return nil, err
+		}
+
+		return sources, nil
+	}
+
+	for _, elem := range splitList(value) {
+		switch {
+		case strings.HasPrefix(elem, envSourceSecret) && len(elem) > len(envSourceSecret):
+			sources = append(sources, corev1.EnvFromSource{
+				SecretRef: &corev1.SecretEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: strings.TrimPrefix(elem, envSourceSecret),
+					},
+				},
+			})
+		case strings.HasPrefix(elem, envSourceConfigMap) && len(elem) > len(envSourceConfigMap):
+			sources = append(sources, corev1.EnvFromSource{
+				ConfigMapRef: &corev1.ConfigMapEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: strings.TrimPrefix(elem, envSourceConfigMap),
+					},
+				},
+			})
+		default:
+			return nil, fmt.Errorf("source '%s' must be formed as 'secret:<name>' or 'configmap:<name>'", elem)
+		}
+	}
+
+	return sources, nil
+}
+
+// splitKeyRef splits a reference formed as "<name>/<key>".
+func splitKeyRef(ref string) (string, string, error) {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("reference '%s' must be formed as '<name>/<key>'", ref)
+	}
+
+	return parts[0], parts[1], nil
+}
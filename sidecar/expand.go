@@ -0,0 +1,231 @@
+package sidecar
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/spf13/cast"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// maxExpandedLength is the maximum length of an annotation value once expanded.
+const maxExpandedLength = 64 * 1024
+
+// expandTimeout is the maximum time to expand an annotation value.
+const expandTimeout = 100 * time.Millisecond
+
+// deadlineFunc is the function checking the deadline of the expansion.
+// It is called by the loops and the templates so that they cannot run
+// forever without output, such as "{{ range 1000000000 }}{{ end }}".
+const deadlineFunc = "_deadline"
+
+// templateData is the pod metadata available to the templates of annotation
+// values such as "--service={{ .Labels.app }}".
+type templateData struct {
+	Name               string
+	GenerateName       string
+	Namespace          string
+	Labels             map[string]string
+	Annotations        map[string]string
+	ServiceAccountName string
+
+	// Images are the images of the application containers by container name.
+	Images map[string]string
+}
+
+// templateFuncs are the only functions available to templates besides
+// the builtin ones of text/template.
+var templateFuncs = template.FuncMap{
+	"default": func(def string, value interface{}) string {
+		if s := fmt.Sprint(value); value != nil && s != "" {
+			return s
+		}
+
+		return def
+	},
+	"lower": strings.ToLower,
+	"replace": func(old, new, s string) string {
+		return strings.ReplaceAll(s, old, new)
+	},
+	"trunc": func(n int, s string) string {
+		if n >= 0 && len(s) > n {
+			return s[:n]
+		}
+
+		return s
+	},
+}
+
+// newTemplateData returns the metadata of the pod for templates. The injected
+// containers of a previous injection are not application containers.
+func newTemplateData(pod *corev1.Pod, injected map[string]bool) *templateData {
+	data := &templateData{
+		Name:               pod.Name,
+		GenerateName:       pod.GenerateName,
+		Namespace:          pod.Namespace,
+		Labels:             map[string]string{},
+		Annotations:        map[string]string{},
+		ServiceAccountName: pod.Spec.ServiceAccountName,
+		Images:             map[string]string{},
+	}
+
+	for k, v := range pod.Labels {
+		data.Labels[k] = v
+	}
+
+	for k, v := range pod.Annotations {
+		data.Annotations[k] = v
+	}
+
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, container := range containers {
+			if !injected[container.Name] {
+				data.Images[container.Name] = container.Image
+			}
+		}
+	}
+
+	return data
+}
+
+// expandAnnotations expands the values of the annotations of the container group
+// as templates of the pod metadata. Values without an action are kept as they are,
+// as well as all values when the expansion is disabled for the group.
+func (c *Container) expandAnnotations() error {
+	var data *templateData
+
+	c.annotations = map[string]string{}
+
+	expand := true
+	if val, ok := c.Annotations[c.annotationKey(AnnotationContainerExpandTemplates)]; ok {
+		expand = cast.ToBool(val)
+	}
+
+	for _, k := range sortedKeys(c.Annotations) {
+		v := c.Annotations[k]
+
+		if !c.ownsAnnotation(k) {
+			continue
+		}
+
+		if !expand || !strings.Contains(v, "{{") {
+			c.annotations[k] = v
+			continue
+		}
+
+		if data == nil {
+			data = newTemplateData(c.Pod, injectedNames(c.Annotations, c.config.AnnotationKey(AnnotationContainerInjectedContainers)))
+		}
+
+		value, err := expandValue(k, v, data)
+		if err != nil {
+			return newAnnotationValueError(k, err)
+		}
+
+		c.annotations[k] = value
+	}
+
+	return nil
+}
+
+// ownsAnnotation checks if the annotation configures the container group.
+func (c *Container) ownsAnnotation(key string) bool {
+	group, ok := c.config.annotationGroup(key)
+	if ok {
+		return group == c.Group
+	}
+
+	return c.Group == "" && c.config.isContainerAnnotation(key)
+}
+
+// expandValue executes the value as a template. Missing labels and annotations
+// are empty so that they can be given a default value. The execution fails
+// after expandTimeout.
+func expandValue(name, value string, data *templateData) (string, error) {
+	var buf bytes.Buffer
+
+	expired := false
+	deadline := time.Now().Add(expandTimeout)
+
+	funcs := template.FuncMap{
+		deadlineFunc: func() (string, error) {
+			if time.Now().After(deadline) {
+				expired = true
+				return "", fmt.Errorf("deadline exceeded")
+			}
+
+			return "", nil
+		},
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=zero").Funcs(templateFuncs).Funcs(funcs).Parse(value)
+	if err != nil {
+		return "", err
+	}
+
+	check, err := template.New(deadlineFunc).Funcs(funcs).Parse("{{" + deadlineFunc + "}}")
+	if err != nil {
+		return "", err
+	}
+
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil || t.Tree.Root == nil {
+			continue
+		}
+
+		addDeadlineChecks(t.Tree.Root, check.Tree.Root.Nodes[0])
+		t.Tree.Root.Nodes = append([]parse.Node{check.Tree.Root.Nodes[0]}, t.Tree.Root.Nodes...)
+	}
+
+	if err := tmpl.Execute(&limitedWriter{w: &buf, n: maxExpandedLength}, data); err != nil {
+		if expired {
+			return "", fmt.Errorf("expansion takes longer than %s", expandTimeout)
+		}
+
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// addDeadlineChecks inserts the check of the deadline at the beginning
+// of the body of the loops of the list.
+func addDeadlineChecks(list *parse.ListNode, check parse.Node) {
+	if list == nil {
+		return
+	}
+
+	for _, node := range list.Nodes {
+		switch n := node.(type) {
+		case *parse.IfNode:
+			addDeadlineChecks(n.List, check)
+			addDeadlineChecks(n.ElseList, check)
+		case *parse.WithNode:
+			addDeadlineChecks(n.List, check)
+			addDeadlineChecks(n.ElseList, check)
+		case *parse.RangeNode:
+			addDeadlineChecks(n.List, check)
+			addDeadlineChecks(n.ElseList, check)
+
+			n.List.Nodes = append([]parse.Node{check}, n.List.Nodes...)
+		}
+	}
+}
+
+// limitedWriter fails once more than n bytes are written.
+type limitedWriter struct {
+	w *bytes.Buffer
+	n int
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.w.Len()+len(p) > l.n {
+		return 0, fmt.Errorf("expanded value is longer than %d bytes", l.n)
+	}
+
+	return l.w.Write(p)
+}
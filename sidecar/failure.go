@@ -0,0 +1,99 @@
+package sidecar
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// OnErrorDeny rejects the pods whose injection fails.
+	OnErrorDeny = "deny"
+
+	// OnErrorAllowWithWarning admits the pods whose injection fails without
+	// injection. The error is returned as a warning and recorded in the
+	// injection-error annotation of the pod.
+	OnErrorAllowWithWarning = "allow-with-warning"
+
+	// OnErrorAllowSilently admits the pods whose injection fails without injection.
+	OnErrorAllowSilently = "allow-silently"
+)
+
+var onErrorModes = []string{
+	OnErrorDeny,
+	OnErrorAllowWithWarning,
+	OnErrorAllowSilently,
+}
+
+// NamespaceGetter returns the namespace of the pod, or nil if it cannot be read.
+type NamespaceGetter func() *corev1.Namespace
+
+// OnErrorMode returns the failure mode set by the on-error annotation of the pod,
+// or else of its namespace, or else by the server. The namespace is only read
+// when the pod does not set a valid failure mode. The pod and the getter
+// may be nil. Invalid annotation values are ignored and returned as an error.
+func (c *Config) OnErrorMode(pod *corev1.Pod, getNamespace NamespaceGetter) (string, error) {
+	var errs []string
+
+	key := c.AnnotationKey(AnnotationContainerOnError)
+
+	if pod != nil {
+		if mode, ok := c.annotations(pod.Annotations)[key]; ok {
+			if isOnErrorMode(mode) {
+				return mode, nil
+			}
+
+			errs = append(errs, fmt.Sprintf("invalid failure mode '%s' in annotation '%s' of the pod", mode, key))
+		}
+	}
+
+	if getNamespace != nil {
+		if namespace := getNamespace(); namespace != nil {
+			if mode, ok := c.annotations(namespace.Annotations)[key]; ok {
+				if isOnErrorMode(mode) {
+					return mode, onErrorModeError(errs)
+				}
+
+				errs = append(errs, fmt.Sprintf("invalid failure mode '%s' in annotation '%s' of the namespace %s",
+					mode, key, namespace.Name))
+			}
+		}
+	}
+
+	mode := c.OnError
+	if mode == "" {
+		mode = OnErrorDeny
+	}
+
+	return mode, onErrorModeError(errs)
+}
+
+// PatchInjectionError creates the patch recording the error in the
+// injection-error annotation of the pod.
+func (c *Config) PatchInjectionError(pod *corev1.Pod, err error) ([]byte, error) {
+	return json.Marshal(updateAnnotations(pod.Annotations, map[string]string{
+		c.AnnotationKey(AnnotationContainerInjectionError): err.Error(),
+	}))
+}
+
+// onErrorModeError returns the errors of the on-error annotations, if any,
+// with the supported failure modes.
+func onErrorModeError(errs []string) error {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%s: must be one of %v", strings.Join(errs, ", "), onErrorModes)
+}
+
+func isOnErrorMode(mode string) bool {
+	for _, m := range onErrorModes {
+		if m == mode {
+			return true
+		}
+	}
+
+	return false
+}
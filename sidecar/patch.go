@@ -1,6 +1,9 @@
 package sidecar
 
 import (
+	"encoding/json"
+	"sort"
+	"strconv"
 	"strings"
 
 	//"github.com/mattbaird/jsonpatch"
@@ -40,41 +43,98 @@ func addVolumes(target, volumes []corev1.Volume, base string) []patchOperation {
 	return result
 }
 
-//func addVolumeMounts(target, mounts []corev1.VolumeMount, base string) []patchOperation {
-//var result []patchOperation
-//var value interface{}
+func addVolumeMounts(target, mounts []corev1.VolumeMount, base string) []patchOperation {
+	var result []patchOperation
+	var value interface{}
 
-//first := len(target) == 0
+	first := len(target) == 0
 
-//for _, v := range mounts {
-//value = v
-//path := base
+	for _, v := range mounts {
+		value = v
+		path := base
 
-//if first {
-//first = false
-//value = []corev1.VolumeMount{v}
-//} else {
-//path = path + "/-"
-//}
+		if first {
+			first = false
+			value = []corev1.VolumeMount{v}
+		} else {
+			path = path + "/-"
+		}
 
-//result = append(result, patchOperation{
-//Op:    "add",
-//Path:  path,
-//Value: value,
-//})
-//}
+		result = append(result, patchOperation{
+			Op:    "add",
+			Path:  path,
+			Value: value,
+		})
+	}
 
-//return result
-//}
+	return result
+}
 
-//func removeContainers(path string) []patchOperation {
-//var result []patchOperation
+// removeContainers removes the containers whose name is in names.
+func removeContainers(target []corev1.Container, names map[string]bool, base string) []patchOperation {
+	var indexes []int
+
+	for i, container := range target {
+		if names[container.Name] {
+			indexes = append(indexes, i)
+		}
+	}
+
+	return removeElements(len(target), indexes, base)
+}
+
+// removeVolumes removes the volumes whose name is in names.
+func removeVolumes(target []corev1.Volume, names map[string]bool, base string) []patchOperation {
+	var indexes []int
+
+	for i, volume := range target {
+		if names[volume.Name] {
+			indexes = append(indexes, i)
+		}
+	}
+
+	return removeElements(len(target), indexes, base)
+}
+
+// removeVolumeMounts removes the volume mounts of the volumes whose name is in names.
+func removeVolumeMounts(target []corev1.VolumeMount, names map[string]bool, base string) []patchOperation {
+	var indexes []int
+
+	for i, mount := range target {
+		if names[mount.Name] {
+			indexes = append(indexes, i)
+		}
+	}
+
+	return removeElements(len(target), indexes, base)
+}
+
+// removeElements removes the elements of an array at the given ascending indexes.
+// They are removed from the last one so that indexes are not shifted. The array
+// is removed if it becomes empty.
+func removeElements(length int, indexes []int, base string) []patchOperation {
+	var result []patchOperation
+
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	if len(indexes) == length {
+		return append(result, patchOperation{
+			Op:   "remove",
+			Path: base,
+		})
+	}
+
+	for i := len(indexes) - 1; i >= 0; i-- {
+		result = append(result, patchOperation{
+			Op:   "remove",
+			Path: base + "/" + strconv.Itoa(indexes[i]),
+		})
+	}
 
-//return append(result, patchOperation{
-//Op:   "remove",
-//Path: path,
-//})
-//}
+	return result
+}
 
 func addContainers(target, containers []corev1.Container, base string) []patchOperation {
 	var result []patchOperation
@@ -103,6 +163,37 @@ func addContainers(target, containers []corev1.Container, base string) []patchOp
 	return result
 }
 
+// insertContainers inserts the containers at the given position in the target.
+// They are appended if the position is negative or out of range.
+func insertContainers(target, containers []corev1.Container, base string, position int) []patchOperation {
+	var result []patchOperation
+
+	if position < 0 || position >= len(target) {
+		return addContainers(target, containers, base)
+	}
+
+	for i, container := range containers {
+		result = append(result, patchOperation{
+			Op:    "add",
+			Path:  base + "/" + strconv.Itoa(position+i),
+			Value: container,
+		})
+	}
+
+	return result
+}
+
+// replaceValue replaces the value at the given path.
+func replaceValue(path string, value interface{}) []patchOperation {
+	return []patchOperation{
+		{
+			Op:    "replace",
+			Path:  path,
+			Value: value,
+		},
+	}
+}
+
 func updateAnnotations(target, annotations map[string]string) []patchOperation {
 	var result []patchOperation
 
@@ -116,17 +207,67 @@ func updateAnnotations(target, annotations map[string]string) []patchOperation {
 		return result
 	}
 
-	for key, value := range annotations {
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
 		result = append(result, patchOperation{
 			Op:    "add",
 			Path:  "/metadata/annotations/" + EscapeJSONPointer(key),
-			Value: value,
+			Value: annotations[key],
+		})
+	}
+
+	return result
+}
+
+// removeAnnotations removes the given annotations if they are in the target.
+func removeAnnotations(target map[string]string, annotations []string) []patchOperation {
+	var result []patchOperation
+
+	for _, key := range annotations {
+		if _, ok := target[key]; !ok {
+			continue
+		}
+
+		result = append(result, patchOperation{
+			Op:   "remove",
+			Path: "/metadata/annotations/" + EscapeJSONPointer(key),
 		})
 	}
 
 	return result
 }
 
+// PrefixPatch prefixes the paths of the patch so that a patch created for a pod
+// applies to a pod template such as "/spec/template" in a Deployment.
+func PrefixPatch(patch []byte, prefix string) ([]byte, error) {
+	// Values are kept as they are to preserve the order of their fields
+	var operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value,omitempty"`
+	}
+
+	if len(patch) == 0 || prefix == "" {
+		return patch, nil
+	}
+
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		return nil, err
+	}
+
+	for i := range operations {
+		operations[i].Path = prefix + operations[i].Path
+	}
+
+	return json.Marshal(operations)
+}
+
 // EscapeJSONPointer escapes a JSON string to be compliant with the
 // JavaScript Object Notation (JSON) Pointer syntax RFC:
 // https://tools.ietf.org/html/rfc6901.
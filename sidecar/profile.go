@@ -0,0 +1,116 @@
+package sidecar
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+)
+
+// Profile is a container template defined in the server configuration
+// and selected by the profile annotation.
+type Profile struct {
+	// Template is the container and the volumes to inject.
+	Template Template
+
+	// Overrides are the annotations, without prefix, allowed to override the
+	// profile such as "image", "limits-cpu" or "env" for all "env-<name>".
+	Overrides []string
+}
+
+// NewProfile parses the yaml or json definitions of the container and of the
+// list of volumes of a profile, in the format of the configmap templates.
+func NewProfile(container, volumes string, overrides []string) (*Profile, error) {
+	p := &Profile{
+		Overrides: overrides,
+	}
+
+	if container == "" {
+		return nil, fmt.Errorf("container not found")
+	}
+
+	if err := yaml.Unmarshal([]byte(container), &p.Template.Container); err != nil {
+		return nil, fmt.Errorf("error parsing container: %s", err)
+	}
+
+	if volumes != "" {
+		if err := yaml.Unmarshal([]byte(volumes), &p.Template.Volumes); err != nil {
+			return nil, fmt.Errorf("error parsing volumes: %s", err)
+		}
+	}
+
+	return p, nil
+}
+
+// loadProfile uses the profile of the configuration as template.
+func (c *Container) loadProfile() error {
+	p, ok := c.config.Profiles[c.ProfileName]
+	if !ok {
+		return newAnnotationValueError(c.annotationKey(AnnotationContainerProfile), fmt.Errorf("profile '%s' not found", c.ProfileName))
+	}
+
+	t := &Template{
+		Container: *p.Template.Container.DeepCopy(),
+	}
+
+	for _, v := range p.Template.Volumes {
+		t.Volumes = append(t.Volumes, *v.DeepCopy())
+	}
+
+	c.overrides = p.Overrides
+
+	return c.setTemplate(t, fmt.Sprintf("profile '%s'", c.ProfileName))
+}
+
+// validateOverrides returns an error for each annotation of the container
+// group overriding the profile without being allowed to.
+func (c *Container) validateOverrides() field.ErrorList {
+	var errs field.ErrorList
+
+	if c.ProfileName == "" {
+		return nil
+	}
+
+	for _, k := range sortedKeys(c.annotations) {
+		// The expansion only applies to the annotations allowed to override
+		if k == c.annotationKey(AnnotationContainerProfile) || k == c.annotationKey(AnnotationContainerExpandTemplates) {
+			continue
+		}
+
+		name := strings.TrimPrefix(k, c.annotationKey(DefaultAnnotationPrefix))
+
+		if !c.canOverride(name) {
+			errs = append(errs, field.Forbidden(annotationsPath.Key(k), fmt.Sprintf("profile '%s' cannot be overridden by this annotation", c.ProfileName)))
+		}
+	}
+
+	return errs
+}
+
+// canOverride checks if the annotation, without prefix, is allowed
+// to override the profile.
+func (c *Container) canOverride(name string) bool {
+	for _, override := range c.overrides {
+		if name == override {
+			return true
+		}
+
+		for _, family := range containerAnnotationFamilies {
+			if override == strings.TrimPrefix(family, DefaultAnnotationPrefix) && strings.HasPrefix(name, override+"-") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// templateAnnotation returns the annotation selecting the template of the container.
+func (c *Container) templateAnnotation() string {
+	if c.ProfileName != "" {
+		return AnnotationContainerProfile
+	}
+
+	return AnnotationContainerConfigMap
+}
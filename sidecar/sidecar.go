@@ -4,22 +4,45 @@ import (
 	//"errors"
 	"encoding/json"
 	"fmt"
-	"regexp"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 
 	//jsonpatch "github.com/evanphx/json-patch"
 	"github.com/spf13/cast"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
+const (
+	// DefaultTLSMountPath is the default path where the TLS secret is mounted.
+	DefaultTLSMountPath = "/etc/tls"
+
+	// DefaultServiceAccountTokenPath is the default path where the projected
+	// service account token is mounted.
+	DefaultServiceAccountTokenPath = "/var/run/secrets/tokens"
+
+	// ServiceAccountTokenReuse shares the service account token volume
+	// mounted in the application containers.
+	ServiceAccountTokenReuse = "reuse"
+
+	// ServiceAccountTokenProjected adds a projected service account token volume.
+	ServiceAccountTokenProjected = "projected"
+)
+
+// minServiceAccountTokenExpiration is the minimum expiration in seconds
+// of a projected service account token accepted by the API server.
+const minServiceAccountTokenExpiration = 600
+
 // Container defines the container to be injected in the pod
 type Container struct {
 	// Pod is the original Kubernetes pod spec.
 	Pod *corev1.Pod
 
-	// Annotations are the current pod annotations used to
-	// configure the Vault Agent container.
+	// Annotations are the current pod annotations in which the keys
+	// with a legacy prefix use the configured prefix.
 	Annotations map[string]string
 
 	// Inject is the flag used to determine if a container should be requested
@@ -31,15 +54,30 @@ type Container struct {
 	// mutation.
 	Status string
 
-	// ServiceAccountName is the Kubernetes service account name for the pod.
-	// This is used when we mount the service account to the  Vault Agent container(s).
+	// ServiceAccountName is the name of the volume holding the service account token
+	// of the pod. This is used when we mount the service account to the container.
 	ServiceAccountName string
 
 	// ServiceAccountPath is the path on disk where the service account JWT
 	// can be located.  This is used when we mount the service account to the
-	// Vault Agent container(s).
+	// container.
 	ServiceAccountPath string
 
+	// ServiceAccountToken is the way the service account token is mounted
+	// in the container: ServiceAccountTokenReuse, ServiceAccountTokenProjected
+	// or empty if it is not mounted.
+	ServiceAccountToken string
+
+	// ServiceAccountTokenAudience is the audience of the projected token.
+	ServiceAccountTokenAudience string
+
+	// ServiceAccountTokenExpiration is the expiration in seconds of the projected token.
+	ServiceAccountTokenExpiration *int64
+
+	// Group is the name of the annotation group configuring the container.
+	// It is empty for the default group using flat annotations.
+	Group string
+
 	// Name is the name of the container to inject
 	Name string
 
@@ -59,9 +97,26 @@ type Container struct {
 	// InitFirst tells whether the connainer is started before the others
 	InitFirst bool
 
+	// InitPosition is the index at which the init container is inserted.
+	// A negative value appends it after the existing init containers.
+	InitPosition int
+
+	// SidecarMode tells whether the container is injected as a regular container
+	// or as a native sidecar. It is ignored for init containers.
+	SidecarMode string
+
+	// StartupProbe is the json startup probe of the container.
+	StartupProbe string
+
 	// ImagePullPolicy is the pull policy
 	ImagePullPolicy string
 
+	// EnvFrom are the sources of environment variables of the container.
+	EnvFrom []corev1.EnvFromSource
+
+	// EnvOrder are the environment variables placed first in the container.
+	EnvOrder []string
+
 	// LimitsCPU is the upper CPU limit the sidecar container is allowed to consume.
 	LimitsCPU string
 
@@ -74,164 +129,520 @@ type Container struct {
 	// RequestsMem is the requested minimum memory amount required when being scheduled to deploy.
 	RequestsMem string
 
+	// LimitsEphemeralStorage is the upper ephemeral storage limit the sidecar
+	// container is allowed to consume.
+	LimitsEphemeralStorage string
+
+	// RequestsEphemeralStorage is the requested minimum ephemeral storage amount
+	// required when being scheduled to deploy.
+	RequestsEphemeralStorage string
+
+	// LimitsExtended are the limits of extended resources indexed by resource name.
+	LimitsExtended map[string]string
+
+	// RequestsExtended are the requests of extended resources indexed by resource name.
+	RequestsExtended map[string]string
+
 	// ConfigMapName is the name of the configmap containing
 	// container configuration
 	ConfigMapName string
 
-	// RunAsUser is the user ID to run the Vault agent container(s) as.
-	RunAsUser int64
+	// ProfileName is the name of the profile of the server configuration
+	// used as container template.
+	ProfileName string
+
+	// Template is the container template loaded from the configmap
+	// or the profile. Fields configured by annotations take precedence over it.
+	Template *Template
+
+	// RunAsUser is the user ID to run the container as.
+	RunAsUser *int64
+
+	// RunAsGroup is the group ID to run the container as.
+	RunAsGroup *int64
+
+	// RunAsNonRoot requires the container to run as a non-root user.
+	RunAsNonRoot *bool
+
+	// ReadOnlyRootFilesystem mounts the root filesystem of the container as read-only.
+	ReadOnlyRootFilesystem *bool
 
-	// RunAsGroup is the group ID to run the Vault agent container(s) as.
-	RunAsGroup int64
+	// AllowPrivilegeEscalation controls whether a process can gain more
+	// privileges than its parent process.
+	AllowPrivilegeEscalation *bool
+
+	// CapabilitiesAdd are the capabilities added to the container.
+	CapabilitiesAdd []string
+
+	// CapabilitiesDrop are the capabilities dropped from the container.
+	CapabilitiesDrop []string
+
+	// SeccompProfile is the seccomp profile of the container.
+	SeccompProfile *corev1.SeccompProfile
+
+	// SecurityContext is the json security context merged on top of
+	// the one built from the other security fields.
+	SecurityContext string
+
+	// InheritSecurityContext tells whether the security context of the first
+	// application container is used as a base.
+	InheritSecurityContext bool
+
+	// AppContainers are the names of the application containers receiving
+	// the app volume mounts. All containers receive them if it is empty.
+	AppContainers []string
 
 	// TLSSecret is the name of the Kubernetes secret containing
 	// client TLS certificates and keys
 	TLSSecret string
 
+	// TLSMountPath is the path where the TLS secret is mounted.
+	TLSMountPath string
+
+	// TLSItems maps the keys of the TLS secret to the paths
+	// where they are projected.
+	TLSItems map[string]string
+
+	// TLSDefaultMode is the mode of the files of the TLS secret.
+	TLSDefaultMode *int32
+
 	// Patches are all the mutations we will make to the pod request.
 	Patches []patchOperation
+
+	// volumeNames are the new names of the volumes colliding with the pod.
+	// An empty name means that the volume of the pod is used instead.
+	volumeNames map[string]string
+
+	// ports are the new numbers of the container ports colliding with the pod.
+	// A zero number means that the port is not declared.
+	ports map[int32]int32
+
+	// annotations are the annotations of the container group whose values
+	// are expanded with the pod metadata.
+	annotations map[string]string
+
+	// overrides are the annotations allowed to override the profile.
+	overrides []string
+
+	// config is the server configuration of the injection.
+	config *Config
 }
 
 // NewContainer creates a new container by parsing all Kubernetes annotations
+// of the default group.
 func NewContainer(pod *corev1.Pod) (*Container, error) {
-	c := &Container{}
+	return newContainer(pod, "", DefaultConfig())
+}
+
+// newContainer creates a new container by parsing the Kubernetes annotations
+// of the given group. The configuration gives the default values.
+func newContainer(pod *corev1.Pod, group string, config *Config) (*Container, error) {
+	c := &Container{
+		Group:        group,
+		InitPosition: -1,
+		SidecarMode:  config.SidecarMode,
+		TLSMountPath: DefaultTLSMountPath,
+		config:       config,
+	}
 
 	c.Pod = pod
+	c.Annotations = config.annotations(pod.Annotations)
 
-	if val, ok := pod.Annotations[AnnotationContainerInject]; ok {
+	if val, ok := c.Annotations[config.AnnotationKey(AnnotationContainerInject)]; ok {
 		c.Inject = cast.ToBool(val)
 	} else {
-		return nil, newAnnotationError(AnnotationContainerInject)
+		return nil, newAnnotationError(config.AnnotationKey(AnnotationContainerInject))
+	}
+
+	if err := c.expandAnnotations(); err != nil {
+		return nil, err
+	}
+
+	if val, ok := c.annotation(AnnotationContainerConfigMap); ok {
+		c.ConfigMapName = cast.ToString(val)
 	}
 
-	if val, ok := pod.Annotations[AnnotationContainerName]; ok {
+	if val, ok := c.annotation(AnnotationContainerProfile); ok {
+		if c.ConfigMapName != "" {
+			return nil, fmt.Errorf("Annotations '%s' and '%s' cannot be used together",
+				c.annotationKey(AnnotationContainerConfigMap), c.annotationKey(AnnotationContainerProfile))
+		}
+
+		c.ProfileName = cast.ToString(val)
+	}
+
+	if val, ok := c.annotation(AnnotationContainerEnvFrom); ok {
+		envFrom, err := parseEnvFromSources(val)
+		if err != nil {
+			return nil, newAnnotationValueError(c.annotationKey(AnnotationContainerEnvFrom), err)
+		}
+
+		c.EnvFrom = envFrom
+	}
+
+	if val, ok := c.annotation(AnnotationContainerEnvOrder); ok {
+		c.EnvOrder = splitList(cast.ToString(val))
+	}
+
+	// Name and image can be provided later by the configmap template or the profile
+	if val, ok := c.annotation(AnnotationContainerName); ok {
 		c.Name = cast.ToString(val)
-	} else {
-		return nil, newAnnotationError(AnnotationContainerName)
+	} else if c.ConfigMapName == "" && c.ProfileName == "" {
+		return nil, newAnnotationError(c.annotationKey(AnnotationContainerName))
 	}
 
-	if val, ok := pod.Annotations[AnnotationContainerImage]; ok {
+	if val, ok := c.annotation(AnnotationContainerImage); ok {
 		c.ImageName = cast.ToString(val)
-	} else {
-		return nil, newAnnotationError(AnnotationContainerImage)
+	} else if c.ConfigMapName == "" && c.ProfileName == "" {
+		return nil, newAnnotationError(c.annotationKey(AnnotationContainerImage))
 	}
 
-	if val, ok := pod.Annotations[AnnotationContainerCommand]; ok {
+	if val, ok := c.annotation(AnnotationContainerCommand); ok {
 		c.Command = cast.ToString(val)
 	}
 
-	if val, ok := pod.Annotations[AnnotationContainerArgs]; ok {
+	if val, ok := c.annotation(AnnotationContainerArgs); ok {
 		c.Args = cast.ToString(val)
 	}
 
-	if val, ok := pod.Annotations[AnnotationContainerInitContainer]; ok {
+	if val, ok := c.annotation(AnnotationContainerInitContainer); ok {
 		c.InitContainer = cast.ToBool(val)
 	}
 
-	if val, ok := pod.Annotations[AnnotationContainerInitFirst]; ok {
+	if val, ok := c.annotation(AnnotationContainerInitFirst); ok {
 		c.InitFirst = cast.ToBool(val)
 	}
 
-	if val, ok := pod.Annotations[AnnotationContainerPullPolicy]; ok {
-		c.ImagePullPolicy = cast.ToString(val)
+	if val, ok := c.annotation(AnnotationContainerInitPosition); ok {
+		if c.InitFirst {
+			return nil, fmt.Errorf("Annotations '%s' and '%s' cannot be used together",
+				c.annotationKey(AnnotationContainerInitFirst), c.annotationKey(AnnotationContainerInitPosition))
+		}
+
+		position, err := cast.ToIntE(val)
+		if err != nil {
+			return nil, newAnnotationValueError(c.annotationKey(AnnotationContainerInitPosition), err)
+		}
+
+		if position < 0 {
+			return nil, newAnnotationValueError(c.annotationKey(AnnotationContainerInitPosition), fmt.Errorf("position must be positive"))
+		}
+
+		c.InitPosition = position
 	}
 
-	if val, ok := pod.Annotations[AnnotationContainerConfigMap]; ok {
-		c.ConfigMapName = cast.ToString(val)
+	if val, ok := c.annotation(AnnotationContainerSidecarMode); ok {
+		c.SidecarMode = cast.ToString(val)
+	}
+
+	if val, ok := c.annotation(AnnotationContainerStartupProbe); ok {
+		if !json.Valid([]byte(val)) {
+			return nil, newAnnotationValueError(c.annotationKey(AnnotationContainerStartupProbe), fmt.Errorf("value must be json format"))
+		}
+
+		c.StartupProbe = val
+	}
+
+	if val, ok := c.annotation(AnnotationContainerPullPolicy); ok {
+		c.ImagePullPolicy = cast.ToString(val)
 	}
 
-	if val, ok := pod.Annotations[AnnotationContainerLimitsCPU]; ok {
+	if val, ok := c.annotation(AnnotationContainerLimitsCPU); ok {
 		c.LimitsCPU = cast.ToString(val)
 	}
 
-	if val, ok := pod.Annotations[AnnotationContainerLimitsMem]; ok {
+	if val, ok := c.annotation(AnnotationContainerLimitsMem); ok {
 		c.LimitsMem = cast.ToString(val)
 	}
 
-	if val, ok := pod.Annotations[AnnotationContainerRequestsCPU]; ok {
+	if val, ok := c.annotation(AnnotationContainerRequestsCPU); ok {
 		c.RequestsCPU = cast.ToString(val)
 	}
 
-	if val, ok := pod.Annotations[AnnotationContainerRequestsMem]; ok {
+	if val, ok := c.annotation(AnnotationContainerRequestsMem); ok {
 		c.RequestsMem = cast.ToString(val)
 	}
 
-	if val, ok := pod.Annotations[AnnotationContainerRunAsUser]; ok {
-		c.RunAsUser = cast.ToInt64(val)
+	if val, ok := c.annotation(AnnotationContainerLimitsEphemeralStorage); ok {
+		c.LimitsEphemeralStorage = cast.ToString(val)
+	}
+
+	if val, ok := c.annotation(AnnotationContainerRequestsEphemeralStorage); ok {
+		c.RequestsEphemeralStorage = cast.ToString(val)
+	}
+
+	if val, ok := c.annotation(AnnotationContainerLimits); ok {
+		limits, err := cast.ToStringMapStringE(val)
+		if err != nil {
+			return nil, newAnnotationValueError(c.annotationKey(AnnotationContainerLimits), err)
+		}
+
+		c.LimitsExtended = limits
+	}
+
+	if val, ok := c.annotation(AnnotationContainerRequests); ok {
+		requests, err := cast.ToStringMapStringE(val)
+		if err != nil {
+			return nil, newAnnotationValueError(c.annotationKey(AnnotationContainerRequests), err)
+		}
+
+		c.RequestsExtended = requests
+	}
+
+	if val, ok := c.annotation(AnnotationContainerRunAsUser); ok {
+		user, err := cast.ToInt64E(val)
+		if err != nil {
+			return nil, newAnnotationValueError(c.annotationKey(AnnotationContainerRunAsUser), err)
+		}
+
+		c.RunAsUser = &user
+	}
+
+	if val, ok := c.annotation(AnnotationContainerRunAsGroup); ok {
+		group, err := cast.ToInt64E(val)
+		if err != nil {
+			return nil, newAnnotationValueError(c.annotationKey(AnnotationContainerRunAsGroup), err)
+		}
+
+		c.RunAsGroup = &group
 	}
 
-	if val, ok := pod.Annotations[AnnotationContainerRunAsGroup]; ok {
-		c.RunAsGroup = cast.ToInt64(val)
+	if val, ok := c.annotation(AnnotationContainerRunAsNonRoot); ok {
+		nonRoot, err := cast.ToBoolE(val)
+		if err != nil {
+			return nil, newAnnotationValueError(c.annotationKey(AnnotationContainerRunAsNonRoot), err)
+		}
+
+		c.RunAsNonRoot = &nonRoot
 	}
 
-	if val, ok := pod.Annotations[AnnotationContainerTLSSecret]; ok {
+	if val, ok := c.annotation(AnnotationContainerReadOnlyRootFilesystem); ok {
+		readOnly, err := cast.ToBoolE(val)
+		if err != nil {
+			return nil, newAnnotationValueError(c.annotationKey(AnnotationContainerReadOnlyRootFilesystem), err)
+		}
+
+		c.ReadOnlyRootFilesystem = &readOnly
+	}
+
+	if val, ok := c.annotation(AnnotationContainerAllowPrivilegeEscalation); ok {
+		allow, err := cast.ToBoolE(val)
+		if err != nil {
+			return nil, newAnnotationValueError(c.annotationKey(AnnotationContainerAllowPrivilegeEscalation), err)
+		}
+
+		c.AllowPrivilegeEscalation = &allow
+	}
+
+	if val, ok := c.annotation(AnnotationContainerCapabilitiesAdd); ok {
+		c.CapabilitiesAdd = splitList(val)
+	}
+
+	if val, ok := c.annotation(AnnotationContainerCapabilitiesDrop); ok {
+		c.CapabilitiesDrop = splitList(val)
+	}
+
+	if val, ok := c.annotation(AnnotationContainerSeccompProfile); ok {
+		profile, err := parseSeccompProfile(val)
+		if err != nil {
+			return nil, newAnnotationValueError(c.annotationKey(AnnotationContainerSeccompProfile), err)
+		}
+
+		c.SeccompProfile = profile
+	}
+
+	if val, ok := c.annotation(AnnotationContainerSecurityContext); ok {
+		if !json.Valid([]byte(val)) {
+			return nil, newAnnotationValueError(c.annotationKey(AnnotationContainerSecurityContext), fmt.Errorf("value must be json format"))
+		}
+
+		c.SecurityContext = val
+	}
+
+	if val, ok := c.annotation(AnnotationContainerSecurityContextInherit); ok {
+		c.InheritSecurityContext = cast.ToBool(val)
+	}
+
+	if val, ok := c.annotation(AnnotationContainerAppContainers); ok {
+		c.AppContainers = splitList(val)
+	}
+
+	if val, ok := c.annotation(AnnotationContainerTLSSecret); ok {
 		c.TLSSecret = cast.ToString(val)
 	}
 
-	return c, nil
-}
+	if err := c.parseAnnotationsServiceAccount(); err != nil {
+		return nil, err
+	}
+
+	if val, ok := c.annotation(AnnotationContainerTLSMountPath); ok {
+		c.TLSMountPath = cast.ToString(val)
+	}
+
+	if val, ok := c.annotation(AnnotationContainerTLSItems); ok {
+		items, err := cast.ToStringMapStringE(val)
+		if err != nil {
+			return nil, newAnnotationValueError(c.annotationKey(AnnotationContainerTLSItems), err)
+		}
+
+		c.TLSItems = items
+	}
 
-// Validate verifies the coherence of all parameters specified by annotations
-// is correct.
-//func (c *Container) Validate() {
+	if val, ok := c.annotation(AnnotationContainerTLSDefaultMode); ok {
+		mode, err := strconv.ParseInt(val, 0, 32)
+		if err != nil {
+			return nil, newAnnotationValueError(c.annotationKey(AnnotationContainerTLSDefaultMode), err)
+		}
+
+		defaultMode := int32(mode)
+		c.TLSDefaultMode = &defaultMode
+	}
+
+	if c.ProfileName != "" {
+		if err := c.loadProfile(); err != nil {
+			return nil, err
+		}
+	}
 
-//}
+	return c, nil
+}
 
 // Patch creates the necessary pod patches to inject the container.
 func (c *Container) Patch() ([]byte, error) {
-	var patches []byte
+	s := c.sidecars()
 
-	container, err := c.createContainer()
-	if err != nil {
-		return patches, err
+	patches, err := s.Patch()
+	c.Patches = s.Patches
+
+	return patches, err
+}
+
+//
+// INTERNAL FUNCTIONS
+//
+
+// sidecars returns the container alone as the containers to inject.
+func (c *Container) sidecars() *Sidecars {
+	return &Sidecars{
+		Pod:         c.Pod,
+		Containers:  []*Container{c},
+		config:      c.config,
+		annotations: c.Annotations,
 	}
+}
 
-	volumes, err := c.parseAnnotationsVolumeSources()
+// annotationKey returns the key of the annotation, given with the default prefix,
+// for the container group with the configured prefix. Group annotations are formed
+// as "<prefix><group>.<name>".
+func (c *Container) annotationKey(annotation string) string {
+	if c.Group == "" {
+		return c.config.AnnotationKey(annotation)
+	}
+
+	return c.config.AnnotationKey(DefaultAnnotationPrefix + c.Group + "." + strings.TrimPrefix(annotation, DefaultAnnotationPrefix))
+}
+
+// groupName returns the name of the container group for messages.
+func (c *Container) groupName() string {
+	if c.Group == "" {
+		return "default"
+	}
+
+	return c.Group
+}
+
+// annotation returns the value of the annotation for the container group.
+func (c *Container) annotation(annotation string) (string, bool) {
+	val, ok := c.annotations[c.annotationKey(annotation)]
+
+	return val, ok
+}
+
+// patch creates the patches adding the container to the pod spec.
+// The spec is updated accordingly so that next patches are based on it.
+// A container of a previous injection is replaced in place, or moved when
+// it was injected as an init container and now is a regular one or vice versa.
+func (c *Container) patch(spec *corev1.PodSpec, injected bool) ([]patchOperation, error) {
+	var patches []patchOperation
+
+	container, err := c.createContainer()
 	if err != nil {
-		return patches, err
+		return nil, err
 	}
 
-	c.Patches = append(c.Patches, addVolumes(
-		c.Pod.Spec.Volumes,
-		volumes,
-		"/spec/volumes")...)
+	if injected {
+		names := map[string]bool{container.Name: true}
 
-	c.Patches = append(c.Patches, addContainers(
-		c.Pod.Spec.Containers,
-		[]corev1.Container{container},
-		"/spec/containers")...)
+		if i := findContainer(spec.InitContainers, container.Name); i >= 0 {
+			if c.injectedAsInit() {
+				spec.InitContainers[i] = container
+				return replaceValue(fmt.Sprintf("/spec/initContainers/%d", i), container), nil
+			}
+
+			patches = append(patches, removeContainers(spec.InitContainers, names, "/spec/initContainers")...)
+			spec.InitContainers = filterContainers(spec.InitContainers, names)
+		}
+
+		if i := findContainer(spec.Containers, container.Name); i >= 0 {
+			if !c.injectedAsInit() {
+				spec.Containers[i] = container
+				return replaceValue(fmt.Sprintf("/spec/containers/%d", i), container), nil
+			}
+
+			patches = append(patches, removeContainers(spec.Containers, names, "/spec/containers")...)
+			spec.Containers = filterContainers(spec.Containers, names)
+		}
+	}
 
-	// Add annotations so that we know we're injected
-	c.Patches = append(c.Patches, updateAnnotations(
-		c.Pod.Annotations,
-		map[string]string{AnnotationContainerStatus: "injected"})...)
+	if c.injectedAsInit() {
+		position := c.initPosition()
 
-	//fmt.Printf("%+v\n", c.Patches)
+		patches = append(patches, insertContainers(
+			spec.InitContainers,
+			[]corev1.Container{container},
+			"/spec/initContainers",
+			position)...)
 
-	// Generate the patch
-	if len(c.Patches) > 0 {
-		return json.Marshal(c.Patches)
+		if position < 0 || position >= len(spec.InitContainers) {
+			spec.InitContainers = append(spec.InitContainers, container)
+		} else {
+			spec.InitContainers = append(spec.InitContainers[:position],
+				append([]corev1.Container{container}, spec.InitContainers[position:]...)...)
+		}
+	} else {
+		patches = append(patches, addContainers(
+			spec.Containers,
+			[]corev1.Container{container},
+			"/spec/containers")...)
+
+		spec.Containers = append(spec.Containers, container)
 	}
 
 	return patches, nil
 }
 
-//
-// INTERNAL FUNCTIONS
-//
-
 func (c *Container) createContainer() (corev1.Container, error) {
 	var command []string
 	var args []string
-
-	re := regexp.MustCompile(`("[^"']+")|('[^"']+')|\S+`)
+	var err error
 
 	if c.Command != "" {
-		command = re.FindAllString(c.Command, -1)
+		command, err = splitWords(c.Command)
+		if err != nil {
+			return corev1.Container{}, newAnnotationValueError(c.annotationKey(AnnotationContainerCommand), err)
+		}
 	}
 
 	if c.Args != "" {
-		args = re.FindAllString(c.Args, -1)
+		shell := command
+		if shell == nil && c.Template != nil {
+			shell = c.Template.Container.Command
+		}
+
+		args, err = splitArgs(c.Args, shell)
+		if err != nil {
+			return corev1.Container{}, newAnnotationValueError(c.annotationKey(AnnotationContainerArgs), err)
+		}
 	}
 
 	envs, err := c.parseAnnotationsEnvVars()
@@ -244,36 +655,369 @@ func (c *Container) createContainer() (corev1.Container, error) {
 		return corev1.Container{}, err
 	}
 
-	return corev1.Container{
-		Name:            c.Name,
-		Image:           c.ImageName,
-		ImagePullPolicy: corev1.PullPolicy(c.ImagePullPolicy),
-		Env:             envs,
-		//Resources:       resources,
-		//SecurityContext: a.securityContext(),
-		VolumeMounts: volumeMounts,
-		//Lifecycle:       &lifecycle,
-		Command: command,
-		Args:    args,
+	if c.ServiceAccountToken != "" {
+		volumeMount, err := c.serviceAccountVolumeMount()
+		if err != nil {
+			return corev1.Container{}, err
+		}
+
+		volumeMounts = append(volumeMounts, volumeMount)
+	}
+
+	if c.TLSSecret != "" {
+		volumeMount, err := c.tlsVolumeMount()
+		if err != nil {
+			return corev1.Container{}, err
+		}
+
+		volumeMounts = append(volumeMounts, volumeMount)
+	}
+
+	resources, err := c.resources()
+	if err != nil {
+		return corev1.Container{}, err
+	}
+
+	securityContext, err := c.securityContext()
+	if err != nil {
+		return corev1.Container{}, err
+	}
+
+	startupProbe, err := c.startupProbe()
+	if err != nil {
+		return corev1.Container{}, err
+	}
+
+	container := corev1.Container{}
+	if c.Template != nil {
+		container = *c.Template.Container.DeepCopy()
+	}
+
+	container.Name = c.Name
+	container.Image = c.ImageName
+	container.Env = orderEnvVars(mergeEnvVars(container.Env, envs), c.EnvOrder)
+	container.EnvFrom = append(container.EnvFrom, c.EnvFrom...)
+	container.Resources = resources
+	container.SecurityContext = securityContext
+	container.VolumeMounts = mergeVolumeMounts(container.VolumeMounts, volumeMounts)
+	//container.Lifecycle = &lifecycle
+
+	for i := range container.VolumeMounts {
+		container.VolumeMounts[i].Name = c.volumeName(container.VolumeMounts[i].Name)
+	}
+
+	container.Ports = c.containerPorts(container.Ports)
+
+	if c.ImagePullPolicy != "" {
+		container.ImagePullPolicy = corev1.PullPolicy(c.ImagePullPolicy)
+	}
+
+	if command != nil {
+		container.Command = command
+	}
+
+	if args != nil {
+		container.Args = args
+	}
+
+	if startupProbe != nil {
+		container.StartupProbe = startupProbe
+	}
+
+	// A native sidecar is an init container running until the pod terminates
+	if c.native() {
+		restartPolicy := corev1.ContainerRestartPolicyAlways
+		container.RestartPolicy = &restartPolicy
+	}
+
+	return container, nil
+}
+
+// volumes returns the volumes used by the container. Volumes configured
+// by annotations take precedence over the ones of the template.
+func (c *Container) volumes() ([]corev1.Volume, error) {
+	var volumes []corev1.Volume
+
+	declared, err := c.declaredVolumes()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range declared {
+		if name, ok := c.volumeNames[v.Name]; ok {
+			if name == "" {
+				continue
+			}
+
+			v.Name = name
+		}
+
+		volumes = append(volumes, v)
+	}
+
+	if c.TLSSecret != "" {
+		volume, err := c.tlsVolume()
+		if err != nil {
+			return nil, err
+		}
+
+		volumes = append(volumes, volume)
+	}
+
+	if c.ServiceAccountToken == ServiceAccountTokenProjected {
+		volume, err := c.serviceAccountVolume()
+		if err != nil {
+			return nil, err
+		}
+
+		volumes = append(volumes, volume)
+	}
+
+	return volumes, nil
+}
+
+// parseAnnotationsServiceAccount determines how the service account token is mounted.
+// The token of the application containers is reused unless a projected token is
+// explicitly requested or no token is mounted in the pod.
+func (c *Container) parseAnnotationsServiceAccount() error {
+	val, ok := c.annotation(AnnotationContainerServiceAccountToken)
+	if !ok {
+		return nil
+	}
+
+	if val, ok := c.annotation(AnnotationContainerServiceAccountTokenAudience); ok {
+		c.ServiceAccountTokenAudience = cast.ToString(val)
+	}
+
+	if val, ok := c.annotation(AnnotationContainerServiceAccountTokenExpiration); ok {
+		expiration, err := cast.ToInt64E(val)
+		if err != nil {
+			return newAnnotationValueError(c.annotationKey(AnnotationContainerServiceAccountTokenExpiration), err)
+		}
+
+		if expiration < minServiceAccountTokenExpiration {
+			return newAnnotationValueError(c.annotationKey(AnnotationContainerServiceAccountTokenExpiration),
+				fmt.Errorf("expiration must be at least %d seconds", minServiceAccountTokenExpiration))
+		}
+
+		c.ServiceAccountTokenExpiration = &expiration
+	}
+
+	c.ServiceAccountName, c.ServiceAccountPath = getServiceAccount(c.Pod)
+	projected := c.ServiceAccountTokenAudience != "" || c.ServiceAccountTokenExpiration != nil
+
+	switch val {
+	case ServiceAccountTokenReuse:
+		if c.ServiceAccountName == "" {
+			return newAnnotationValueError(c.annotationKey(AnnotationContainerServiceAccountToken),
+				fmt.Errorf("no service account token mounted in the pod containers"))
+		}
+
+		if projected {
+			return newAnnotationValueError(c.annotationKey(AnnotationContainerServiceAccountToken),
+				fmt.Errorf("audience and expiration can only be set for projected tokens"))
+		}
+
+		c.ServiceAccountToken = ServiceAccountTokenReuse
+	case ServiceAccountTokenProjected:
+		c.ServiceAccountToken = ServiceAccountTokenProjected
+	default:
+		enabled, err := cast.ToBoolE(val)
+		if err != nil {
+			return newAnnotationValueError(c.annotationKey(AnnotationContainerServiceAccountToken), err)
+		}
+
+		if !enabled {
+			return nil
+		}
+
+		c.ServiceAccountToken = ServiceAccountTokenReuse
+		if projected || c.ServiceAccountName == "" {
+			c.ServiceAccountToken = ServiceAccountTokenProjected
+		}
+	}
+
+	if c.ServiceAccountToken == ServiceAccountTokenProjected {
+		c.ServiceAccountPath = DefaultServiceAccountTokenPath
+	}
+
+	if val, ok := c.annotation(AnnotationContainerServiceAccountTokenPath); ok {
+		c.ServiceAccountPath = cast.ToString(val)
+	}
+
+	return nil
+}
+
+// serviceAccountVolume returns the projected service account token volume.
+func (c *Container) serviceAccountVolume() (corev1.Volume, error) {
+	name, err := c.generateVolumeName("token")
+	if err != nil {
+		return corev1.Volume{}, err
+	}
+
+	return corev1.Volume{
+		Name: name,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{
+					{
+						ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+							Audience:          c.ServiceAccountTokenAudience,
+							ExpirationSeconds: c.ServiceAccountTokenExpiration,
+							Path:              "token",
+						},
+					},
+				},
+			},
+		},
 	}, nil
 }
 
+// serviceAccountVolumeMount returns the read-only mount of the service account token.
+func (c *Container) serviceAccountVolumeMount() (corev1.VolumeMount, error) {
+	name := c.ServiceAccountName
+
+	if c.ServiceAccountToken == ServiceAccountTokenProjected {
+		var err error
+
+		name, err = c.generateVolumeName("token")
+		if err != nil {
+			return corev1.VolumeMount{}, err
+		}
+	}
+
+	return corev1.VolumeMount{
+		Name:      name,
+		MountPath: c.ServiceAccountPath,
+		ReadOnly:  true,
+	}, nil
+}
+
+// tlsVolume returns the volume of the TLS secret. Projected keys
+// are sorted to keep the volume definition stable.
+func (c *Container) tlsVolume() (corev1.Volume, error) {
+	name, err := c.generateVolumeName("tls")
+	if err != nil {
+		return corev1.Volume{}, err
+	}
+
+	source := &corev1.SecretVolumeSource{
+		SecretName:  c.TLSSecret,
+		DefaultMode: c.TLSDefaultMode,
+	}
+
+	keys := make([]string, 0, len(c.TLSItems))
+	for key := range c.TLSItems {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		source.Items = append(source.Items, corev1.KeyToPath{
+			Key:  key,
+			Path: c.TLSItems[key],
+		})
+	}
+
+	return corev1.Volume{
+		Name: name,
+		VolumeSource: corev1.VolumeSource{
+			Secret: source,
+		},
+	}, nil
+}
+
+// tlsVolumeMount returns the read-only mount of the TLS secret volume.
+func (c *Container) tlsVolumeMount() (corev1.VolumeMount, error) {
+	name, err := c.generateVolumeName("tls")
+	if err != nil {
+		return corev1.VolumeMount{}, err
+	}
+
+	return corev1.VolumeMount{
+		Name:      name,
+		MountPath: c.TLSMountPath,
+		ReadOnly:  true,
+	}, nil
+}
+
+// generateVolumeName generates the name of a volume from the container name and
+// the given suffix such as "<name>-tls". A numeric suffix is added if the name is
+// already used by a volume of the pod or of the container.
+func (c *Container) generateVolumeName(suffix string) (string, error) {
+	used := map[string]bool{}
+	injected := injectedNames(c.Annotations, c.config.AnnotationKey(AnnotationContainerInjectedVolumes))
+
+	// Volumes of a previous injection are reused
+	for _, v := range c.Pod.Spec.Volumes {
+		if !injected[v.Name] {
+			used[v.Name] = true
+		}
+	}
+
+	volumes, err := c.parseAnnotationsVolumeSources()
+	if err != nil {
+		return "", err
+	}
+
+	if c.Template != nil {
+		volumes = append(volumes, c.Template.Volumes...)
+	}
+
+	for _, v := range volumes {
+		used[v.Name] = true
+	}
+
+	base := c.Name
+	if len(base) > 50 {
+		base = base[:50]
+	}
+
+	base = strings.TrimSuffix(base, "-") + "-" + suffix
+	name := base
+
+	for i := 1; used[name]; i++ {
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+
+	return name, nil
+}
+
 func (c *Container) parseAnnotationsEnvVars() ([]corev1.EnvVar, error) {
 	var envs []corev1.EnvVar
 
-	for k, v := range c.Pod.Annotations {
-		if strings.HasPrefix(k, AnnotationContainerEnv+"-") {
+	for _, k := range sortedKeys(c.annotations) {
+		v := c.annotations[k]
+
+		if k == c.annotationKey(AnnotationContainerEnvFrom) || k == c.annotationKey(AnnotationContainerEnvOrder) {
+			continue
+		}
+
+		if strings.HasPrefix(k, c.annotationKey(AnnotationContainerEnv)+"-") {
 			var envName string
 
-			_, err := fmt.Sscanf(k, AnnotationContainerEnv+"-%s", &envName)
+			_, err := fmt.Sscanf(k, c.annotationKey(AnnotationContainerEnv)+"-%s", &envName)
 			if err != nil {
 				return nil, err
 			}
 
-			envs = append(envs, corev1.EnvVar{
-				Name:  envName,
-				Value: v,
-			})
+			source, err := parseEnvVarSource(v)
+			if err != nil {
+				return nil, newAnnotationValueError(k, err)
+			}
+
+			env := corev1.EnvVar{
+				Name: envName,
+			}
+
+			if source != nil {
+				env.ValueFrom = source
+			} else {
+				env.Value = v
+			}
+
+			envs = append(envs, env)
 		}
 	}
 
@@ -283,11 +1027,13 @@ func (c *Container) parseAnnotationsEnvVars() ([]corev1.EnvVar, error) {
 func (c *Container) parseAnnotationsVolumeMounts() ([]corev1.VolumeMount, error) {
 	var volumeMounts []corev1.VolumeMount
 
-	for k, v := range c.Pod.Annotations {
-		if strings.HasPrefix(k, AnnotationContainerVolumeMount+"-") {
+	for _, k := range sortedKeys(c.annotations) {
+		v := c.annotations[k]
+
+		if strings.HasPrefix(k, c.annotationKey(AnnotationContainerVolumeMount)+"-") {
 			var volumeName string
 
-			_, err := fmt.Sscanf(k, AnnotationContainerVolumeMount+"-%s", &volumeName)
+			_, err := fmt.Sscanf(k, c.annotationKey(AnnotationContainerVolumeMount)+"-%s", &volumeName)
 			if err != nil {
 				return nil, err
 			}
@@ -297,7 +1043,7 @@ func (c *Container) parseAnnotationsVolumeMounts() ([]corev1.VolumeMount, error)
 
 				err := json.Unmarshal([]byte(v), &volM)
 				if err != nil {
-					return nil, err
+					return nil, newAnnotationValueError(k, err)
 				}
 
 				volM.Name = volumeName
@@ -314,27 +1060,89 @@ func (c *Container) parseAnnotationsVolumeMounts() ([]corev1.VolumeMount, error)
 	return volumeMounts, nil
 }
 
+// appVolumeMount is a volume mount to add to application containers.
+type appVolumeMount struct {
+	corev1.VolumeMount
+
+	// Containers are the names of the containers receiving the volume mount.
+	Containers []string `json:"containers,omitempty"`
+}
+
+// selects checks if the volume mount must be added to the given container.
+func (m appVolumeMount) selects(name string) bool {
+	if len(m.Containers) == 0 {
+		return true
+	}
+
+	for _, container := range m.Containers {
+		if container == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Container) parseAnnotationsAppVolumeMounts() ([]appVolumeMount, error) {
+	var volumeMounts []appVolumeMount
+
+	for _, k := range sortedKeys(c.annotations) {
+		v := c.annotations[k]
+
+		if strings.HasPrefix(k, c.annotationKey(AnnotationContainerAppVolumeMount)+"-") {
+			var volumeName string
+
+			_, err := fmt.Sscanf(k, c.annotationKey(AnnotationContainerAppVolumeMount)+"-%s", &volumeName)
+			if err != nil {
+				return nil, err
+			}
+
+			volM := appVolumeMount{}
+
+			if json.Valid([]byte(v)) {
+				err := json.Unmarshal([]byte(v), &volM)
+				if err != nil {
+					return nil, newAnnotationValueError(k, err)
+				}
+			} else {
+				volM.MountPath = v
+			}
+
+			if len(volM.Containers) == 0 {
+				volM.Containers = c.AppContainers
+			}
+
+			volM.Name = c.volumeName(volumeName)
+			volumeMounts = append(volumeMounts, volM)
+		}
+	}
+
+	return volumeMounts, nil
+}
+
 func (c *Container) parseAnnotationsVolumeSources() ([]corev1.Volume, error) {
 	var volumes []corev1.Volume
 
-	for k, v := range c.Pod.Annotations {
-		if strings.HasPrefix(k, AnnotationContainerVolumeSource+"-") {
+	for _, k := range sortedKeys(c.annotations) {
+		v := c.annotations[k]
+
+		if strings.HasPrefix(k, c.annotationKey(AnnotationContainerVolumeSource)+"-") {
 			var volumeName string
 
-			_, err := fmt.Sscanf(k, AnnotationContainerVolumeSource+"-%s", &volumeName)
+			_, err := fmt.Sscanf(k, c.annotationKey(AnnotationContainerVolumeSource)+"-%s", &volumeName)
 			if err != nil {
 				return nil, err
 			}
 
 			if !json.Valid([]byte(v)) {
-				return nil, fmt.Errorf("annotation for volume source must be json format")
+				return nil, newAnnotationValueError(k, fmt.Errorf("value must be json format"))
 			}
 
 			vol := corev1.Volume{}
 
 			err = json.Unmarshal([]byte(v), &vol)
 			if err != nil {
-				return nil, err
+				return nil, newAnnotationValueError(k, err)
 			}
 
 			vol.Name = volumeName
@@ -345,31 +1153,359 @@ func (c *Container) parseAnnotationsVolumeSources() ([]corev1.Volume, error) {
 	return volumes, nil
 }
 
-//func (c *Container) securityContext() *corev1.SecurityContext {
-//runAsNonRoot := true
-//if c.RunAsUser == 0 || c.RunAsGroup == 0 {
-//runAsNonRoot = false
-//}
+// declaredVolumes returns the volumes declared by annotations and by the template.
+func (c *Container) declaredVolumes() ([]corev1.Volume, error) {
+	volumes, err := c.parseAnnotationsVolumeSources()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Template != nil {
+		volumes = mergeVolumeSources(c.Template.Volumes, volumes)
+	}
+
+	return volumes, nil
+}
 
-//return &corev1.SecurityContext{
-//RunAsUser:    &c.RunAsUser,
-//RunAsGroup:   &c.RunAsGroup,
-//RunAsNonRoot: &runAsNonRoot,
-//}
-//}
+// volumeName returns the name of the volume after collisions are resolved.
+func (c *Container) volumeName(name string) string {
+	if newName := c.volumeNames[name]; newName != "" {
+		return newName
+	}
 
-//func getServiceAccount(pod *corev1.Pod) (string, string) {
-//for _, container := range pod.Spec.Containers {
-//for _, volumes := range container.VolumeMounts {
-//if strings.Contains(volumes.MountPath, "serviceaccount") {
-//return volumes.Name, volumes.MountPath
-//}
-//}
-//}
+	return name
+}
 
-//return "", ""
-//}
+// native tells whether the container is injected as a native sidecar.
+func (c *Container) native() bool {
+	return !c.InitContainer && c.SidecarMode == SidecarModeNative
+}
+
+// injectedAsInit tells whether the container is injected in "/spec/initContainers".
+func (c *Container) injectedAsInit() bool {
+	return c.InitContainer || c.native()
+}
+
+// startupProbe returns the startup probe configured by annotation if any.
+func (c *Container) startupProbe() (*corev1.Probe, error) {
+	if c.StartupProbe == "" {
+		return nil, nil
+	}
+
+	probe := &corev1.Probe{}
+	if err := json.Unmarshal([]byte(c.StartupProbe), probe); err != nil {
+		return nil, newAnnotationValueError(c.annotationKey(AnnotationContainerStartupProbe), err)
+	}
+
+	return probe, nil
+}
+
+// initPosition returns the index at which the init container is inserted.
+func (c *Container) initPosition() int {
+	if c.InitFirst {
+		return 0
+	}
+
+	return c.InitPosition
+}
+
+// resources builds the resource requirements of the container from
+// the limits and requests annotations. Requests cannot exceed limits.
+func (c *Container) resources() (corev1.ResourceRequirements, error) {
+	resources := corev1.ResourceRequirements{}
+	base := corev1.ResourceRequirements{}
+
+	if c.Template != nil {
+		base = c.Template.Container.Resources
+	}
+
+	limits, err := parseResourceList(base.Limits, []resourceAnnotation{
+		{corev1.ResourceCPU, c.annotationKey(AnnotationContainerLimitsCPU), c.LimitsCPU},
+		{corev1.ResourceMemory, c.annotationKey(AnnotationContainerLimitsMem), c.LimitsMem},
+		{corev1.ResourceEphemeralStorage, c.annotationKey(AnnotationContainerLimitsEphemeralStorage), c.LimitsEphemeralStorage},
+	}, c.annotationKey(AnnotationContainerLimits), c.LimitsExtended)
+	if err != nil {
+		return resources, err
+	}
+
+	requests, err := parseResourceList(base.Requests, []resourceAnnotation{
+		{corev1.ResourceCPU, c.annotationKey(AnnotationContainerRequestsCPU), c.RequestsCPU},
+		{corev1.ResourceMemory, c.annotationKey(AnnotationContainerRequestsMem), c.RequestsMem},
+		{corev1.ResourceEphemeralStorage, c.annotationKey(AnnotationContainerRequestsEphemeralStorage), c.RequestsEphemeralStorage},
+	}, c.annotationKey(AnnotationContainerRequests), c.RequestsExtended)
+	if err != nil {
+		return resources, err
+	}
+
+	for _, name := range sortedResourceNames(requests) {
+		request := requests[name]
+		if limit, ok := limits[name]; ok && request.Cmp(limit) > 0 {
+			return resources, newAnnotationValueError(c.requestsAnnotation(name),
+				fmt.Errorf("requested %s '%s' must be less than or equal to its limit '%s'", name, request.String(), limit.String()))
+		}
+	}
+
+	if len(limits) > 0 {
+		resources.Limits = limits
+	}
+
+	if len(requests) > 0 {
+		resources.Requests = requests
+	}
+
+	return resources, nil
+}
+
+// requestsAnnotation returns the key of the annotation setting the request of the resource.
+func (c *Container) requestsAnnotation(name corev1.ResourceName) string {
+	switch name {
+	case corev1.ResourceCPU:
+		return c.annotationKey(AnnotationContainerRequestsCPU)
+	case corev1.ResourceMemory:
+		return c.annotationKey(AnnotationContainerRequestsMem)
+	case corev1.ResourceEphemeralStorage:
+		return c.annotationKey(AnnotationContainerRequestsEphemeralStorage)
+	default:
+		return c.annotationKey(AnnotationContainerRequests)
+	}
+}
+
+// resourceAnnotation associates a resource with the annotation
+// and the value it is configured by.
+type resourceAnnotation struct {
+	name       corev1.ResourceName
+	annotation string
+	value      string
+}
+
+// parseResourceList parses the quantities of the dedicated resource annotations
+// and of the extended resources on top of the base list. Dedicated annotations
+// take precedence over extended resources with the same name.
+func parseResourceList(base corev1.ResourceList, dedicated []resourceAnnotation, extendedAnnotation string, extended map[string]string) (corev1.ResourceList, error) {
+	list := base.DeepCopy()
+	if list == nil {
+		list = corev1.ResourceList{}
+	}
+
+	for name, value := range extended {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, newAnnotationValueError(extendedAnnotation, fmt.Errorf("resource '%s': %s", name, err))
+		}
+
+		list[corev1.ResourceName(name)] = quantity
+	}
+
+	for _, r := range dedicated {
+		if r.value == "" {
+			continue
+		}
+
+		quantity, err := resource.ParseQuantity(r.value)
+		if err != nil {
+			return nil, newAnnotationValueError(r.annotation, err)
+		}
+
+		list[r.name] = quantity
+	}
+
+	return list, nil
+}
+
+func sortedResourceNames(list corev1.ResourceList) []corev1.ResourceName {
+	names := make([]corev1.ResourceName, 0, len(list))
+	for name := range list {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+
+	return names
+}
+
+// securityContext builds the security context of the container. The base is either
+// empty, the one of the template or the one of the first application container. The security
+// annotations are applied on it, then the json security context is merged on top.
+func (c *Container) securityContext() (*corev1.SecurityContext, error) {
+	sc := &corev1.SecurityContext{}
+
+	if c.Template != nil && c.Template.Container.SecurityContext != nil {
+		sc = c.Template.Container.SecurityContext.DeepCopy()
+	}
+
+	if c.InheritSecurityContext && len(c.Pod.Spec.Containers) > 0 && c.Pod.Spec.Containers[0].SecurityContext != nil {
+		sc = c.Pod.Spec.Containers[0].SecurityContext.DeepCopy()
+	}
+
+	if c.RunAsUser != nil {
+		sc.RunAsUser = c.RunAsUser
+	}
+
+	if c.RunAsGroup != nil {
+		sc.RunAsGroup = c.RunAsGroup
+	}
+
+	if c.RunAsNonRoot != nil {
+		sc.RunAsNonRoot = c.RunAsNonRoot
+	}
+
+	if c.ReadOnlyRootFilesystem != nil {
+		sc.ReadOnlyRootFilesystem = c.ReadOnlyRootFilesystem
+	}
+
+	if c.AllowPrivilegeEscalation != nil {
+		sc.AllowPrivilegeEscalation = c.AllowPrivilegeEscalation
+	}
+
+	if len(c.CapabilitiesAdd) > 0 || len(c.CapabilitiesDrop) > 0 {
+		if sc.Capabilities == nil {
+			sc.Capabilities = &corev1.Capabilities{}
+		}
+
+		if len(c.CapabilitiesAdd) > 0 {
+			sc.Capabilities.Add = toCapabilities(c.CapabilitiesAdd)
+		}
+
+		if len(c.CapabilitiesDrop) > 0 {
+			sc.Capabilities.Drop = toCapabilities(c.CapabilitiesDrop)
+		}
+	}
+
+	if c.SeccompProfile != nil {
+		sc.SeccompProfile = c.SeccompProfile.DeepCopy()
+	}
+
+	if c.SecurityContext != "" {
+		if err := json.Unmarshal([]byte(c.SecurityContext), sc); err != nil {
+			return nil, newAnnotationValueError(c.annotationKey(AnnotationContainerSecurityContext), err)
+		}
+	}
+
+	if reflect.DeepEqual(sc, &corev1.SecurityContext{}) {
+		return nil, nil
+	}
+
+	return sc, nil
+}
+
+// parseSeccompProfile parses a seccomp profile such as "runtime/default",
+// "unconfined" or "localhost/<path>".
+func parseSeccompProfile(val string) (*corev1.SeccompProfile, error) {
+	switch {
+	case val == "runtime/default":
+		return &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}, nil
+	case val == "unconfined":
+		return &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeUnconfined}, nil
+	case strings.HasPrefix(val, "localhost/") && len(val) > len("localhost/"):
+		path := strings.TrimPrefix(val, "localhost/")
+
+		return &corev1.SeccompProfile{
+			Type:             corev1.SeccompProfileTypeLocalhost,
+			LocalhostProfile: &path,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("must be 'runtime/default', 'unconfined' or 'localhost/<path>'")
+}
+
+func toCapabilities(names []string) []corev1.Capability {
+	capabilities := make([]corev1.Capability, 0, len(names))
+	for _, name := range names {
+		capabilities = append(capabilities, corev1.Capability(name))
+	}
+
+	return capabilities
+}
+
+// sortedKeys returns the keys of the map sorted so that the lists
+// built from annotations are the same from one request to another.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// orderEnvVars moves the environment variables listed in order to the front,
+// in the given order. Other variables keep their relative order.
+func orderEnvVars(envs []corev1.EnvVar, order []string) []corev1.EnvVar {
+	if len(order) == 0 {
+		return envs
+	}
+
+	result := make([]corev1.EnvVar, 0, len(envs))
+	used := make(map[string]bool)
+
+	for _, name := range order {
+		for _, env := range envs {
+			if env.Name == name && !used[name] {
+				result = append(result, env)
+				used[name] = true
+			}
+		}
+	}
+
+	for _, env := range envs {
+		if !used[env.Name] {
+			result = append(result, env)
+		}
+	}
+
+	return result
+}
+
+// splitList splits a comma-separated list and trims its elements.
+func splitList(s string) []string {
+	var list []string
+
+	for _, elem := range strings.Split(s, ",") {
+		if elem = strings.TrimSpace(elem); elem != "" {
+			list = append(list, elem)
+		}
+	}
+
+	return list
+}
+
+// getServiceAccount returns the volume name and the mount path of the
+// service account token mounted in the application containers, or else
+// in the init containers.
+func getServiceAccount(pod *corev1.Pod) (string, string) {
+	for _, containers := range [][]corev1.Container{pod.Spec.Containers, pod.Spec.InitContainers} {
+		for _, container := range containers {
+			for _, volumes := range container.VolumeMounts {
+				if strings.Contains(volumes.MountPath, "serviceaccount") {
+					return volumes.Name, volumes.MountPath
+				}
+			}
+		}
+	}
+
+	return "", ""
+}
 
 func newAnnotationError(annotation string) error {
 	return fmt.Errorf("Annotation '%s' not found", annotation)
 }
+
+func newAnnotationValueError(annotation string, err error) error {
+	return &annotationValueError{
+		annotation: annotation,
+		err:        err,
+	}
+}
+
+// annotationValueError is returned when the value of an annotation is invalid.
+type annotationValueError struct {
+	annotation string
+	err        error
+}
+
+func (e *annotationValueError) Error() string {
+	return fmt.Sprintf("Annotation '%s' has an invalid value: %s", e.annotation, e.err)
+}
@@ -1,14 +1,15 @@
+//go:build unit
 // +build unit
 
 package sidecar_test
 
 import (
 	"encoding/json"
-	//"fmt"
+	"fmt"
 	"strings"
 	"testing"
 
-	//jsonpatch "github.com/evanphx/json-patch"
+	jsonpatch "github.com/evanphx/json-patch"
 	//"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -109,6 +110,10 @@ func TestCreateContainerEnvVar(t *testing.T) {
 				"container-injector.uthng.me/env-ENV_NAME_1": "env_name_1",
 			},
 			[]corev1.EnvVar{
+				{
+					Name:  "ENV-NAME",
+					Value: "env-name",
+				},
 				{
 					Name:  "ENVNAME",
 					Value: "envname",
@@ -117,13 +122,40 @@ func TestCreateContainerEnvVar(t *testing.T) {
 					Name:  "ENV_NAME",
 					Value: "env_name",
 				},
+				{
+					Name:  "ENV_NAME_1",
+					Value: "env_name_1",
+				},
+			},
+		},
+		{
+			"OKContainerEnvVarsOrder",
+			map[string]string{
+				"container-injector.uthng.me/inject":         "true",
+				"container-injector.uthng.me/name":           "sleep",
+				"container-injector.uthng.me/image":          "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/env-ENVNAME":    "envname",
+				"container-injector.uthng.me/env-ENV_NAME":   "env_name",
+				"container-injector.uthng.me/env-ENV-NAME":   "env-name",
+				"container-injector.uthng.me/env-ENV_NAME_1": "$(ENVNAME)_1",
+				"container-injector.uthng.me/env-order":      "ENVNAME, ENV_NAME_1, UNKNOWN",
+			},
+			[]corev1.EnvVar{
+				{
+					Name:  "ENVNAME",
+					Value: "envname",
+				},
+				{
+					Name:  "ENV_NAME_1",
+					Value: "$(ENVNAME)_1",
+				},
 				{
 					Name:  "ENV-NAME",
 					Value: "env-name",
 				},
 				{
-					Name:  "ENV_NAME_1",
-					Value: "env_name_1",
+					Name:  "ENV_NAME",
+					Value: "env_name",
 				},
 			},
 		},
@@ -152,7 +184,7 @@ func TestCreateContainerEnvVar(t *testing.T) {
 			err = json.Unmarshal(jsonContainer, &result)
 			require.Nil(t, err)
 
-			require.ElementsMatch(t, tc.result, result.Env)
+			require.Equal(t, tc.result, result.Env)
 		})
 	}
 }
@@ -255,14 +287,6 @@ func TestCreateContainerVolumes(t *testing.T) {
 }`,
 			},
 			[]corev1.Volume{
-				{
-					Name: "volsecret",
-					VolumeSource: corev1.VolumeSource{
-						Secret: &corev1.SecretVolumeSource{
-							SecretName: "volsecret",
-						},
-					},
-				},
 				{
 					Name: "volconfigmap",
 					VolumeSource: corev1.VolumeSource{
@@ -273,6 +297,14 @@ func TestCreateContainerVolumes(t *testing.T) {
 						},
 					},
 				},
+				{
+					Name: "volsecret",
+					VolumeSource: corev1.VolumeSource{
+						Secret: &corev1.SecretVolumeSource{
+							SecretName: "volsecret",
+						},
+					},
+				},
 			},
 		},
 	}
@@ -303,7 +335,2721 @@ func TestCreateContainerVolumes(t *testing.T) {
 				}
 			}
 
-			require.ElementsMatch(t, tc.result, volumes)
+			require.Equal(t, tc.result, volumes)
+		})
+	}
+}
+
+func TestCreateContainerResources(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		result      interface{}
+	}{
+		{
+			"ErrContainerResourcesQuantity",
+			map[string]string{
+				"container-injector.uthng.me/inject":     "true",
+				"container-injector.uthng.me/name":       "sleep",
+				"container-injector.uthng.me/image":      "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/limits-cpu": "one",
+			},
+			"Annotation 'container-injector.uthng.me/limits-cpu' has an invalid value: quantities must match the regular expression '^([+-]?[0-9.]+)([eEinumkKMGTP]*[-+]?[0-9]*)$'",
+		},
+		{
+			"ErrContainerResourcesRequestsExceedLimits",
+			map[string]string{
+				"container-injector.uthng.me/inject":       "true",
+				"container-injector.uthng.me/name":         "sleep",
+				"container-injector.uthng.me/image":        "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/limits-mem":   "64Mi",
+				"container-injector.uthng.me/requests-mem": "128Mi",
+			},
+			"Annotation 'container-injector.uthng.me/requests-mem' has an invalid value: requested memory '128Mi' must be less than or equal to its limit '64Mi'",
+		},
+		{
+			"ErrContainerResourcesExtended",
+			map[string]string{
+				"container-injector.uthng.me/inject": "true",
+				"container-injector.uthng.me/name":   "sleep",
+				"container-injector.uthng.me/image":  "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/limits": `{"nvidia.com/gpu": "a lot"}`,
+			},
+			"Annotation 'container-injector.uthng.me/limits' has an invalid value: resource 'nvidia.com/gpu': quantities must match the regular expression '^([+-]?[0-9.]+)([eEinumkKMGTP]*[-+]?[0-9]*)$'",
+		},
+		{
+			"OKContainerResources",
+			map[string]string{
+				"container-injector.uthng.me/inject":                     "true",
+				"container-injector.uthng.me/name":                       "sleep",
+				"container-injector.uthng.me/image":                      "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/limits-cpu":                 "500m",
+				"container-injector.uthng.me/limits-mem":                 "128Mi",
+				"container-injector.uthng.me/limits-ephemeral-storage":   "1Gi",
+				"container-injector.uthng.me/requests-cpu":               "100m",
+				"container-injector.uthng.me/requests-mem":               "64Mi",
+				"container-injector.uthng.me/requests-ephemeral-storage": "512Mi",
+				"container-injector.uthng.me/limits":                     `{"nvidia.com/gpu": "1"}`,
+				"container-injector.uthng.me/requests":                   `{"nvidia.com/gpu": "1"}`,
+			},
+			`
+{
+	"limits": {
+		"cpu": "500m",
+		"memory": "128Mi",
+		"ephemeral-storage": "1Gi",
+		"nvidia.com/gpu": "1"
+	},
+	"requests": {
+		"cpu": "100m",
+		"memory": "64Mi",
+		"ephemeral-storage": "512Mi",
+		"nvidia.com/gpu": "1"
+	}
+}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tc.annotations,
+				},
+			}
+
+			container, err := sidecar.NewContainer(pod)
+			require.Nil(t, err)
+
+			_, err = container.Patch()
+			if strings.HasPrefix(tc.name, "Err") {
+				require.Equal(t, tc.result, err.Error())
+				return
+			}
+
+			require.Nil(t, err)
+
+			jsonResources, err := json.Marshal(container.Patches[0].Value.([]corev1.Container)[0].Resources)
+			require.Nil(t, err)
+			require.JSONEq(t, tc.result.(string), string(jsonResources))
+		})
+	}
+}
+
+func TestCreateInitContainer(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		result      interface{}
+	}{
+		{
+			"ErrInitContainerFirstAndPosition",
+			map[string]string{
+				"container-injector.uthng.me/inject":         "true",
+				"container-injector.uthng.me/name":           "migrate",
+				"container-injector.uthng.me/image":          "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/init-container": "true",
+				"container-injector.uthng.me/init-first":     "true",
+				"container-injector.uthng.me/init-position":  "1",
+			},
+			"Annotations 'container-injector.uthng.me/init-first' and 'container-injector.uthng.me/init-position' cannot be used together",
+		},
+		{
+			"ErrInitContainerPosition",
+			map[string]string{
+				"container-injector.uthng.me/inject":         "true",
+				"container-injector.uthng.me/name":           "migrate",
+				"container-injector.uthng.me/image":          "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/init-container": "true",
+				"container-injector.uthng.me/init-position":  "-1",
+			},
+			"Annotation 'container-injector.uthng.me/init-position' has an invalid value: position must be positive",
+		},
+		{
+			"OKInitContainerLast",
+			map[string]string{
+				"container-injector.uthng.me/inject":         "true",
+				"container-injector.uthng.me/name":           "migrate",
+				"container-injector.uthng.me/image":          "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/init-container": "true",
+			},
+			`{"op":"add","path":"/spec/initContainers/-","value":{"name":"migrate","image":"governmentpaas/curl-ssl","resources":{}}}`,
+		},
+		{
+			"OKInitContainerFirst",
+			map[string]string{
+				"container-injector.uthng.me/inject":         "true",
+				"container-injector.uthng.me/name":           "migrate",
+				"container-injector.uthng.me/image":          "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/init-container": "true",
+				"container-injector.uthng.me/init-first":     "true",
+			},
+			`{"op":"add","path":"/spec/initContainers/0","value":{"name":"migrate","image":"governmentpaas/curl-ssl","resources":{}}}`,
+		},
+		{
+			"OKInitContainerPosition",
+			map[string]string{
+				"container-injector.uthng.me/inject":         "true",
+				"container-injector.uthng.me/name":           "migrate",
+				"container-injector.uthng.me/image":          "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/init-container": "true",
+				"container-injector.uthng.me/init-position":  "1",
+			},
+			`{"op":"add","path":"/spec/initContainers/1","value":{"name":"migrate","image":"governmentpaas/curl-ssl","resources":{}}}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tc.annotations,
+				},
+				Spec: corev1.PodSpec{
+					InitContainers: []corev1.Container{
+						{Name: "web-init"},
+						{Name: "web-certs"},
+					},
+				},
+			}
+
+			container, err := sidecar.NewContainer(pod)
+			if strings.HasPrefix(tc.name, "Err") {
+				require.Equal(t, tc.result, err.Error())
+				return
+			}
+
+			_, err = container.Patch()
+			require.Nil(t, err)
+
+			jsonPatch, err := json.Marshal(container.Patches[0])
+			require.Nil(t, err)
+			require.JSONEq(t, tc.result.(string), string(jsonPatch))
+		})
+	}
+}
+
+func TestCreateNativeSidecar(t *testing.T) {
+	testCases := []struct {
+		name        string
+		mode        string
+		annotations map[string]string
+		result      interface{}
+	}{
+		{
+			"ErrNativeSidecarMode",
+			sidecar.SidecarModeClassic,
+			map[string]string{
+				"container-injector.uthng.me/inject":       "true",
+				"container-injector.uthng.me/name":         "proxy",
+				"container-injector.uthng.me/image":        "envoyproxy/envoy:v1",
+				"container-injector.uthng.me/sidecar-mode": "sidecar",
+			},
+			`metadata.annotations[container-injector.uthng.me/sidecar-mode]: Unsupported value: "sidecar": supported values: "classic", "native"`,
+		},
+		{
+			"ErrNativeSidecarStartupProbeInitContainer",
+			sidecar.SidecarModeNative,
+			map[string]string{
+				"container-injector.uthng.me/inject":         "true",
+				"container-injector.uthng.me/name":           "migrate",
+				"container-injector.uthng.me/image":          "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/init-container": "true",
+				"container-injector.uthng.me/startup-probe":  `{"exec": {"command": ["true"]}}`,
+			},
+			`metadata.annotations[container-injector.uthng.me/startup-probe]: Invalid value: "{\"exec\": {\"command\": [\"true\"]}}": is not supported by init containers`,
+		},
+		{
+			"OKNativeSidecarAnnotation",
+			sidecar.SidecarModeClassic,
+			map[string]string{
+				"container-injector.uthng.me/inject":        "true",
+				"container-injector.uthng.me/name":          "proxy",
+				"container-injector.uthng.me/image":         "envoyproxy/envoy:v1",
+				"container-injector.uthng.me/sidecar-mode":  "native",
+				"container-injector.uthng.me/init-first":    "true",
+				"container-injector.uthng.me/startup-probe": `{"httpGet": {"path": "/ready", "port": 9901}, "periodSeconds": 1}`,
+			},
+			`{"op":"add","path":"/spec/initContainers/0","value":{"name":"proxy","image":"envoyproxy/envoy:v1","resources":{},"startupProbe":{"httpGet":{"path":"/ready","port":9901},"periodSeconds":1},"restartPolicy":"Always"}}`,
+		},
+		{
+			"OKNativeSidecarConfig",
+			sidecar.SidecarModeNative,
+			map[string]string{
+				"container-injector.uthng.me/inject": "true",
+				"container-injector.uthng.me/name":   "proxy",
+				"container-injector.uthng.me/image":  "envoyproxy/envoy:v1",
+			},
+			`{"op":"add","path":"/spec/initContainers/-","value":{"name":"proxy","image":"envoyproxy/envoy:v1","resources":{},"restartPolicy":"Always"}}`,
+		},
+		{
+			"OKNativeSidecarClassic",
+			sidecar.SidecarModeNative,
+			map[string]string{
+				"container-injector.uthng.me/inject":        "true",
+				"container-injector.uthng.me/name":          "proxy",
+				"container-injector.uthng.me/image":         "envoyproxy/envoy:v1",
+				"container-injector.uthng.me/sidecar-mode":  "classic",
+				"container-injector.uthng.me/startup-probe": `{"tcpSocket": {"port": 8080}}`,
+			},
+			`{"op":"add","path":"/spec/containers/-","value":{"name":"proxy","image":"envoyproxy/envoy:v1","resources":{},"startupProbe":{"tcpSocket":{"port":8080}}}}`,
+		},
+		{
+			"OKNativeSidecarInitContainer",
+			sidecar.SidecarModeNative,
+			map[string]string{
+				"container-injector.uthng.me/inject":         "true",
+				"container-injector.uthng.me/name":           "migrate",
+				"container-injector.uthng.me/image":          "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/init-container": "true",
+			},
+			`{"op":"add","path":"/spec/initContainers/-","value":{"name":"migrate","image":"governmentpaas/curl-ssl","resources":{}}}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tc.annotations,
+				},
+				Spec: corev1.PodSpec{
+					InitContainers: []corev1.Container{
+						{Name: "web-init"},
+					},
+					Containers: []corev1.Container{
+						{Name: "web"},
+					},
+				},
+			}
+
+			sidecars, err := sidecar.NewSidecarsWithConfig(pod, &sidecar.Config{SidecarMode: tc.mode})
+			require.Nil(t, err)
+
+			err = sidecars.Validate()
+			if strings.HasPrefix(tc.name, "Err") {
+				require.Equal(t, tc.result, err.Error())
+				return
+			}
+
+			require.Nil(t, err)
+
+			_, err = sidecars.Patch()
+			require.Nil(t, err)
+
+			jsonPatch, err := json.Marshal(sidecars.Patches[0])
+			require.Nil(t, err)
+			require.JSONEq(t, tc.result.(string), string(jsonPatch))
+		})
+	}
+}
+
+func TestCreateContainerSecurityContext(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		result      interface{}
+	}{
+		{
+			"ErrContainerSecurityContextRunAsUser",
+			map[string]string{
+				"container-injector.uthng.me/inject":      "true",
+				"container-injector.uthng.me/name":        "sleep",
+				"container-injector.uthng.me/image":       "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/run-as-user": "nobody",
+			},
+			`Annotation 'container-injector.uthng.me/run-as-user' has an invalid value: unable to cast "nobody" of type string to int64`,
+		},
+		{
+			"ErrContainerSecurityContextJSON",
+			map[string]string{
+				"container-injector.uthng.me/inject":           "true",
+				"container-injector.uthng.me/name":             "sleep",
+				"container-injector.uthng.me/image":            "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/security-context": "privileged",
+			},
+			"Annotation 'container-injector.uthng.me/security-context' has an invalid value: value must be json format",
+		},
+		{
+			"ErrContainerSeccompProfile",
+			map[string]string{
+				"container-injector.uthng.me/inject":          "true",
+				"container-injector.uthng.me/name":            "sleep",
+				"container-injector.uthng.me/image":           "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/seccomp-profile": "docker/default",
+			},
+			"Annotation 'container-injector.uthng.me/seccomp-profile' has an invalid value: must be 'runtime/default', 'unconfined' or 'localhost/<path>'",
+		},
+		{
+			"ErrContainerSeccompProfileLocalhost",
+			map[string]string{
+				"container-injector.uthng.me/inject":          "true",
+				"container-injector.uthng.me/name":            "sleep",
+				"container-injector.uthng.me/image":           "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/seccomp-profile": "localhost/",
+			},
+			"Annotation 'container-injector.uthng.me/seccomp-profile' has an invalid value: must be 'runtime/default', 'unconfined' or 'localhost/<path>'",
+		},
+		{
+			"OKContainerSeccompProfileRuntimeDefault",
+			map[string]string{
+				"container-injector.uthng.me/inject":          "true",
+				"container-injector.uthng.me/name":            "sleep",
+				"container-injector.uthng.me/image":           "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/seccomp-profile": "runtime/default",
+			},
+			`{"seccompProfile": {"type": "RuntimeDefault"}}`,
+		},
+		{
+			"OKContainerSeccompProfileUnconfined",
+			map[string]string{
+				"container-injector.uthng.me/inject":          "true",
+				"container-injector.uthng.me/name":            "sleep",
+				"container-injector.uthng.me/image":           "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/seccomp-profile": "unconfined",
+			},
+			`{"seccompProfile": {"type": "Unconfined"}}`,
+		},
+		{
+			"OKContainerSeccompProfileLocalhost",
+			map[string]string{
+				"container-injector.uthng.me/inject":          "true",
+				"container-injector.uthng.me/name":            "sleep",
+				"container-injector.uthng.me/image":           "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/seccomp-profile": "localhost/profiles/audit.json",
+			},
+			`{"seccompProfile": {"type": "Localhost", "localhostProfile": "profiles/audit.json"}}`,
+		},
+		{
+			"OKContainerSecurityContextNone",
+			map[string]string{
+				"container-injector.uthng.me/inject": "true",
+				"container-injector.uthng.me/name":   "sleep",
+				"container-injector.uthng.me/image":  "governmentpaas/curl-ssl",
+			},
+			`null`,
+		},
+		{
+			"OKContainerSecurityContext",
+			map[string]string{
+				"container-injector.uthng.me/inject":                     "true",
+				"container-injector.uthng.me/name":                       "sleep",
+				"container-injector.uthng.me/image":                      "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/run-as-user":                "1000",
+				"container-injector.uthng.me/run-as-group":               "0",
+				"container-injector.uthng.me/run-as-non-root":            "true",
+				"container-injector.uthng.me/read-only-root-filesystem":  "true",
+				"container-injector.uthng.me/allow-privilege-escalation": "false",
+				"container-injector.uthng.me/capabilities-drop":          "ALL",
+				"container-injector.uthng.me/capabilities-add":           "NET_ADMIN, SYS_TIME",
+				"container-injector.uthng.me/security-context":           `{"runAsUser": 2000, "capabilities": {"add": ["NET_BIND_SERVICE"]}}`,
+			},
+			`
+{
+	"capabilities": {
+		"add": ["NET_BIND_SERVICE"],
+		"drop": ["ALL"]
+	},
+	"runAsUser": 2000,
+	"runAsGroup": 0,
+	"runAsNonRoot": true,
+	"readOnlyRootFilesystem": true,
+	"allowPrivilegeEscalation": false
+}`,
+		},
+		{
+			"OKContainerSecurityContextInherit",
+			map[string]string{
+				"container-injector.uthng.me/inject":                   "true",
+				"container-injector.uthng.me/name":                     "sleep",
+				"container-injector.uthng.me/image":                    "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/security-context-inherit": "true",
+				"container-injector.uthng.me/run-as-user":              "1000",
+			},
+			`
+{
+	"runAsUser": 1000,
+	"runAsNonRoot": true
+}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			runAsUser := int64(101)
+			runAsNonRoot := true
+
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tc.annotations,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+							SecurityContext: &corev1.SecurityContext{
+								RunAsUser:    &runAsUser,
+								RunAsNonRoot: &runAsNonRoot,
+							},
+						},
+					},
+				},
+			}
+
+			container, err := sidecar.NewContainer(pod)
+			if strings.HasPrefix(tc.name, "Err") {
+				require.Equal(t, tc.result, err.Error())
+				return
+			}
+
+			_, err = container.Patch()
+			require.Nil(t, err)
+
+			jsonSecurityContext, err := json.Marshal(container.Patches[0].Value.(corev1.Container).SecurityContext)
+			require.Nil(t, err)
+			require.JSONEq(t, tc.result.(string), string(jsonSecurityContext))
+
+			// Pod security context must not be modified when inherited
+			require.Equal(t, int64(101), *pod.Spec.Containers[0].SecurityContext.RunAsUser)
+		})
+	}
+}
+
+func TestNewSidecars(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		result      interface{}
+	}{
+		{
+			"ErrSidecarsGroupImage",
+			map[string]string{
+				"container-injector.uthng.me/inject":        "true",
+				"container-injector.uthng.me/git-sync.name": "git-sync",
+			},
+			"Annotation 'container-injector.uthng.me/git-sync.image' not found",
+		},
+		{
+			"ErrSidecarsDuplicateName",
+			map[string]string{
+				"container-injector.uthng.me/inject":         "true",
+				"container-injector.uthng.me/name":           "sleep",
+				"container-injector.uthng.me/image":          "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/git-sync.name":  "sleep",
+				"container-injector.uthng.me/git-sync.image": "k8s.gcr.io/git-sync:v3.1.3",
+			},
+			"container name 'sleep' is used by groups 'default' and 'git-sync'",
+		},
+		{
+			"ErrSidecarsVolumeConflict",
+			map[string]string{
+				"container-injector.uthng.me/inject":                      "true",
+				"container-injector.uthng.me/git-sync.name":               "git-sync",
+				"container-injector.uthng.me/git-sync.image":              "k8s.gcr.io/git-sync:v3.1.3",
+				"container-injector.uthng.me/git-sync.volume-source-data": `{"emptyDir": {}}`,
+				"container-injector.uthng.me/logs.name":                   "fluent-bit",
+				"container-injector.uthng.me/logs.image":                  "fluent/fluent-bit",
+				"container-injector.uthng.me/logs.volume-source-data":     `{"hostPath": {"path": "/data"}}`,
+			},
+			"volume 'data' is declared several times with different sources",
+		},
+		{
+			"OKSidecarsGroups",
+			map[string]string{
+				"container-injector.uthng.me/inject":                      "true",
+				"container-injector.uthng.me/name":                        "sleep",
+				"container-injector.uthng.me/image":                       "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/env-ENV.NAME":                "env",
+				"container-injector.uthng.me/logs.name":                   "fluent-bit",
+				"container-injector.uthng.me/logs.image":                  "fluent/fluent-bit",
+				"container-injector.uthng.me/logs.env-LOG_LEVEL":          "debug",
+				"container-injector.uthng.me/logs.volume-mount-data":      "/var/log/app",
+				"container-injector.uthng.me/logs.volume-source-data":     `{"emptyDir": {}}`,
+				"container-injector.uthng.me/git-sync.name":               "git-sync",
+				"container-injector.uthng.me/git-sync.image":              "k8s.gcr.io/git-sync:v3.1.3",
+				"container-injector.uthng.me/git-sync.volume-mount-data":  "/tmp/git",
+				"container-injector.uthng.me/git-sync.volume-source-data": `{"emptyDir": {}}`,
+			},
+			`[
+	{"op":"add","path":"/spec/volumes","value":[{"name":"data","emptyDir":{}}]},
+	{"op":"add","path":"/spec/containers/-","value":{"name":"sleep","image":"governmentpaas/curl-ssl","env":[{"name":"ENV.NAME","value":"env"}],"resources":{}}},
+	{"op":"add","path":"/spec/containers/-","value":{"name":"git-sync","image":"k8s.gcr.io/git-sync:v3.1.3","resources":{},"volumeMounts":[{"name":"data","mountPath":"/tmp/git"}]}},
+	{"op":"add","path":"/spec/containers/-","value":{"name":"fluent-bit","image":"fluent/fluent-bit","env":[{"name":"LOG_LEVEL","value":"debug"}],"resources":{},"volumeMounts":[{"name":"data","mountPath":"/var/log/app"}]}},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"fluent-bit,git-sync,sleep"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-volumes","value":"data"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"d59007761d277db2"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}
+]`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tc.annotations,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "web"},
+					},
+				},
+			}
+
+			sidecars, err := sidecar.NewSidecars(pod)
+			if err == nil {
+				_, err = sidecars.Patch()
+			}
+
+			if strings.HasPrefix(tc.name, "Err") {
+				require.Equal(t, tc.result, err.Error())
+				return
+			}
+
+			require.Nil(t, err)
+
+			jsonPatch, err := json.Marshal(sidecars.Patches)
+			require.Nil(t, err)
+			require.JSONEq(t, tc.result.(string), string(jsonPatch))
+		})
+	}
+}
+
+func TestLoadTemplates(t *testing.T) {
+	configMaps := map[string]*corev1.ConfigMap{
+		"fluent-bit": {
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "fluent-bit",
+			},
+			Data: map[string]string{
+				"container": `
+name: fluent-bit
+image: fluent/fluent-bit:1.4
+command: ["/fluent-bit/bin/fluent-bit"]
+env:
+- name: LOG_LEVEL
+  value: info
+- name: OUTPUT
+  value: stdout
+volumeMounts:
+- name: config
+  mountPath: /fluent-bit/etc
+resources:
+  limits:
+    memory: 128Mi
+`,
+				"volumes": `
+- name: config
+  configMap:
+    name: fluent-bit-config
+`,
+			},
+		},
+		"noname": {
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "noname",
+			},
+			Data: map[string]string{
+				"container": `image: fluent/fluent-bit:1.4`,
+			},
+		},
+	}
+
+	getter := func(name string) (*corev1.ConfigMap, error) {
+		if cm, ok := configMaps[name]; ok {
+			return cm, nil
+		}
+
+		return nil, fmt.Errorf("configmaps \"%s\" not found", name)
+	}
+
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		result      interface{}
+	}{
+		{
+			"ErrTemplateNotFound",
+			map[string]string{
+				"container-injector.uthng.me/inject":    "true",
+				"container-injector.uthng.me/configmap": "unknown",
+			},
+			`error getting configmap 'unknown': configmaps "unknown" not found`,
+		},
+		{
+			"ErrTemplateName",
+			map[string]string{
+				"container-injector.uthng.me/inject":    "true",
+				"container-injector.uthng.me/configmap": "noname",
+			},
+			"container name not found in annotation 'container-injector.uthng.me/name' nor configmap 'noname'",
+		},
+		{
+			"OKTemplateOverrides",
+			map[string]string{
+				"container-injector.uthng.me/inject":                 "true",
+				"container-injector.uthng.me/configmap":              "fluent-bit",
+				"container-injector.uthng.me/image":                  "fluent/fluent-bit:1.5",
+				"container-injector.uthng.me/env-LOG_LEVEL":          "debug",
+				"container-injector.uthng.me/requests-mem":           "64Mi",
+				"container-injector.uthng.me/volume-mount-logs":      "/var/log/app",
+				"container-injector.uthng.me/volume-source-logs":     `{"emptyDir": {}}`,
+				"container-injector.uthng.me/logs.configmap":         "fluent-bit",
+				"container-injector.uthng.me/logs.name":              "fluent-bit-logs",
+				"container-injector.uthng.me/logs.env-OUTPUT":        "forward",
+				"container-injector.uthng.me/logs.volume-mount-logs": "/var/log/app",
+			},
+			`[
+	{"op":"add","path":"/spec/volumes","value":[{"name":"config","configMap":{"name":"fluent-bit-config"}}]},
+	{"op":"add","path":"/spec/volumes/-","value":{"name":"logs","emptyDir":{}}},
+	{"op":"add","path":"/spec/containers/-","value":{"name":"fluent-bit","image":"fluent/fluent-bit:1.5","command":["/fluent-bit/bin/fluent-bit"],"env":[{"name":"LOG_LEVEL","value":"debug"},{"name":"OUTPUT","value":"stdout"}],"resources":{"limits":{"memory":"128Mi"},"requests":{"memory":"64Mi"}},"volumeMounts":[{"name":"config","mountPath":"/fluent-bit/etc"},{"name":"logs","mountPath":"/var/log/app"}]}},
+	{"op":"add","path":"/spec/containers/-","value":{"name":"fluent-bit-logs","image":"fluent/fluent-bit:1.4","command":["/fluent-bit/bin/fluent-bit"],"env":[{"name":"LOG_LEVEL","value":"info"},{"name":"OUTPUT","value":"forward"}],"resources":{"limits":{"memory":"128Mi"}},"volumeMounts":[{"name":"config","mountPath":"/fluent-bit/etc"},{"name":"logs","mountPath":"/var/log/app"}]}},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"fluent-bit,fluent-bit-logs"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-volumes","value":"config,logs"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"9ad30f90d436de64"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}
+]`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tc.annotations,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "web"},
+					},
+				},
+			}
+
+			sidecars, err := sidecar.NewSidecars(pod)
+			require.Nil(t, err)
+
+			err = sidecars.LoadTemplates(getter)
+			if err == nil {
+				_, err = sidecars.Patch()
+			}
+
+			if strings.HasPrefix(tc.name, "Err") {
+				require.Equal(t, tc.result, err.Error())
+				return
+			}
+
+			require.Nil(t, err)
+
+			jsonPatch, err := json.Marshal(sidecars.Patches)
+			require.Nil(t, err)
+			require.JSONEq(t, tc.result.(string), string(jsonPatch))
+		})
+	}
+}
+
+func TestCreateContainerTLSSecret(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		result      interface{}
+	}{
+		{
+			"ErrContainerTLSDefaultMode",
+			map[string]string{
+				"container-injector.uthng.me/inject":           "true",
+				"container-injector.uthng.me/name":             "proxy",
+				"container-injector.uthng.me/image":            "envoyproxy/envoy",
+				"container-injector.uthng.me/tls-secret":       "proxy-tls",
+				"container-injector.uthng.me/tls-default-mode": "rw",
+			},
+			`Annotation 'container-injector.uthng.me/tls-default-mode' has an invalid value: strconv.ParseInt: parsing "rw": invalid syntax`,
+		},
+		{
+			"OKContainerTLSSecretDefault",
+			map[string]string{
+				"container-injector.uthng.me/inject":     "true",
+				"container-injector.uthng.me/name":       "proxy",
+				"container-injector.uthng.me/image":      "envoyproxy/envoy",
+				"container-injector.uthng.me/tls-secret": "proxy-tls",
+			},
+			`[
+	{"op":"add","path":"/spec/volumes/-","value":{"name":"proxy-tls","secret":{"secretName":"proxy-tls"}}},
+	{"op":"add","path":"/spec/containers/-","value":{"name":"proxy","image":"envoyproxy/envoy","resources":{},"volumeMounts":[{"name":"proxy-tls","readOnly":true,"mountPath":"/etc/tls"}]}},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"proxy"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-volumes","value":"proxy-tls"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"2b9d21c25eb71a5b"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}
+]`,
+		},
+		{
+			"OKContainerTLSSecretCollision",
+			map[string]string{
+				"container-injector.uthng.me/inject":                  "true",
+				"container-injector.uthng.me/name":                    "app",
+				"container-injector.uthng.me/image":                   "envoyproxy/envoy",
+				"container-injector.uthng.me/volume-source-app-tls-1": `{"emptyDir": {}}`,
+				"container-injector.uthng.me/tls-secret":              "proxy-tls",
+				"container-injector.uthng.me/tls-mount-path":          "/var/run/tls",
+				"container-injector.uthng.me/tls-items":               `{"tls.key": "key.pem", "tls.crt": "cert.pem", "ca.crt": "ca.pem"}`,
+				"container-injector.uthng.me/tls-default-mode":        "0440",
+			},
+			`[
+	{"op":"add","path":"/spec/volumes/-","value":{"name":"app-tls-1","emptyDir":{}}},
+	{"op":"add","path":"/spec/volumes/-","value":{"name":"app-tls-2","secret":{"secretName":"proxy-tls","items":[{"key":"ca.crt","path":"ca.pem"},{"key":"tls.crt","path":"cert.pem"},{"key":"tls.key","path":"key.pem"}],"defaultMode":288}}},
+	{"op":"add","path":"/spec/containers/-","value":{"name":"app","image":"envoyproxy/envoy","resources":{},"volumeMounts":[{"name":"app-tls-2","readOnly":true,"mountPath":"/var/run/tls"}]}},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"app"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-volumes","value":"app-tls-1,app-tls-2"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"8c7f0b7abcfede26"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}
+]`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tc.annotations,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "web"},
+					},
+					Volumes: []corev1.Volume{
+						{Name: "app-tls"},
+					},
+				},
+			}
+
+			container, err := sidecar.NewContainer(pod)
+			if strings.HasPrefix(tc.name, "Err") {
+				require.Equal(t, tc.result, err.Error())
+				return
+			}
+
+			_, err = container.Patch()
+			require.Nil(t, err)
+
+			jsonPatch, err := json.Marshal(container.Patches)
+			require.Nil(t, err)
+			require.JSONEq(t, tc.result.(string), string(jsonPatch))
+		})
+	}
+}
+
+func TestCreateContainerServiceAccountToken(t *testing.T) {
+	tokenMount := corev1.VolumeMount{
+		Name:      "default-token-x2v4p",
+		MountPath: "/var/run/secrets/kubernetes.io/serviceaccount",
+		ReadOnly:  true,
+	}
+
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		mounts      []corev1.VolumeMount
+		initMounts  []corev1.VolumeMount
+		result      interface{}
+	}{
+		{
+			"ErrServiceAccountTokenReuseNoMount",
+			map[string]string{
+				"container-injector.uthng.me/inject":                "true",
+				"container-injector.uthng.me/name":                  "proxy",
+				"container-injector.uthng.me/image":                 "envoyproxy/envoy",
+				"container-injector.uthng.me/service-account-token": "reuse",
+			},
+			nil,
+			nil,
+			"Annotation 'container-injector.uthng.me/service-account-token' has an invalid value: no service account token mounted in the pod containers",
+		},
+		{
+			"ErrServiceAccountTokenValue",
+			map[string]string{
+				"container-injector.uthng.me/inject":                "true",
+				"container-injector.uthng.me/name":                  "proxy",
+				"container-injector.uthng.me/image":                 "envoyproxy/envoy",
+				"container-injector.uthng.me/service-account-token": "copy",
+			},
+			nil,
+			nil,
+			`Annotation 'container-injector.uthng.me/service-account-token' has an invalid value: strconv.ParseBool: parsing "copy": invalid syntax`,
+		},
+		{
+			"ErrServiceAccountTokenExpiration",
+			map[string]string{
+				"container-injector.uthng.me/inject":                           "true",
+				"container-injector.uthng.me/name":                             "proxy",
+				"container-injector.uthng.me/image":                            "envoyproxy/envoy",
+				"container-injector.uthng.me/service-account-token":            "projected",
+				"container-injector.uthng.me/service-account-token-expiration": "300",
+			},
+			nil,
+			nil,
+			"Annotation 'container-injector.uthng.me/service-account-token-expiration' has an invalid value: expiration must be at least 600 seconds",
+		},
+		{
+			"OKServiceAccountTokenReuse",
+			map[string]string{
+				"container-injector.uthng.me/inject":                "true",
+				"container-injector.uthng.me/name":                  "proxy",
+				"container-injector.uthng.me/image":                 "envoyproxy/envoy",
+				"container-injector.uthng.me/service-account-token": "true",
+			},
+			[]corev1.VolumeMount{tokenMount},
+			nil,
+			`[
+	{"op":"add","path":"/spec/containers/-","value":{"name":"proxy","image":"envoyproxy/envoy","resources":{},"volumeMounts":[{"name":"default-token-x2v4p","readOnly":true,"mountPath":"/var/run/secrets/kubernetes.io/serviceaccount"}]}},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"proxy"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"3ee95a8b8cd98ff0"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}
+]`,
+		},
+		{
+			"OKServiceAccountTokenReuseInitContainer",
+			map[string]string{
+				"container-injector.uthng.me/inject":                "true",
+				"container-injector.uthng.me/name":                  "proxy",
+				"container-injector.uthng.me/image":                 "envoyproxy/envoy",
+				"container-injector.uthng.me/service-account-token": "reuse",
+			},
+			nil,
+			[]corev1.VolumeMount{tokenMount},
+			`[
+	{"op":"add","path":"/spec/containers/-","value":{"name":"proxy","image":"envoyproxy/envoy","resources":{},"volumeMounts":[{"name":"default-token-x2v4p","readOnly":true,"mountPath":"/var/run/secrets/kubernetes.io/serviceaccount"}]}},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"proxy"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"3ee95a8b8cd98ff0"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}
+]`,
+		},
+		{
+			"OKServiceAccountTokenProjected",
+			map[string]string{
+				"container-injector.uthng.me/inject":                           "true",
+				"container-injector.uthng.me/name":                             "proxy",
+				"container-injector.uthng.me/image":                            "envoyproxy/envoy",
+				"container-injector.uthng.me/service-account-token":            "true",
+				"container-injector.uthng.me/service-account-token-audience":   "vault",
+				"container-injector.uthng.me/service-account-token-expiration": "3600",
+			},
+			[]corev1.VolumeMount{tokenMount},
+			nil,
+			`[
+	{"op":"add","path":"/spec/volumes","value":[{"name":"proxy-token","projected":{"sources":[{"serviceAccountToken":{"audience":"vault","expirationSeconds":3600,"path":"token"}}]}}]},
+	{"op":"add","path":"/spec/containers/-","value":{"name":"proxy","image":"envoyproxy/envoy","resources":{},"volumeMounts":[{"name":"proxy-token","readOnly":true,"mountPath":"/var/run/secrets/tokens"}]}},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"proxy"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-volumes","value":"proxy-token"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"ce4997b9d7aa1a6c"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}
+]`,
+		},
+		{
+			"OKServiceAccountTokenProjectedNoMount",
+			map[string]string{
+				"container-injector.uthng.me/inject":                     "true",
+				"container-injector.uthng.me/name":                       "proxy",
+				"container-injector.uthng.me/image":                      "envoyproxy/envoy",
+				"container-injector.uthng.me/service-account-token":      "true",
+				"container-injector.uthng.me/service-account-token-path": "/var/run/secrets/proxy",
+			},
+			nil,
+			nil,
+			`[
+	{"op":"add","path":"/spec/volumes","value":[{"name":"proxy-token","projected":{"sources":[{"serviceAccountToken":{"path":"token"}}]}}]},
+	{"op":"add","path":"/spec/containers/-","value":{"name":"proxy","image":"envoyproxy/envoy","resources":{},"volumeMounts":[{"name":"proxy-token","readOnly":true,"mountPath":"/var/run/secrets/proxy"}]}},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"proxy"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-volumes","value":"proxy-token"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"c04c83e885a1b18f"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}
+]`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tc.annotations,
+				},
+				Spec: corev1.PodSpec{
+					InitContainers: []corev1.Container{
+						{
+							Name:         "init",
+							VolumeMounts: tc.initMounts,
+						},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:         "web",
+							VolumeMounts: tc.mounts,
+						},
+					},
+				},
+			}
+
+			container, err := sidecar.NewContainer(pod)
+			if strings.HasPrefix(tc.name, "Err") {
+				require.Equal(t, tc.result, err.Error())
+				return
+			}
+
+			_, err = container.Patch()
+			require.Nil(t, err)
+
+			jsonPatch, err := json.Marshal(container.Patches)
+			require.Nil(t, err)
+			require.JSONEq(t, tc.result.(string), string(jsonPatch))
+		})
+	}
+}
+
+func TestPatchAppVolumeMounts(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		result      interface{}
+	}{
+		{
+			"ErrAppVolumeMountCollision",
+			map[string]string{
+				"container-injector.uthng.me/inject":                    "true",
+				"container-injector.uthng.me/name":                      "git-sync",
+				"container-injector.uthng.me/image":                     "k8s.gcr.io/git-sync:v3.1.3",
+				"container-injector.uthng.me/volume-source-markdown":    `{"emptyDir": {}}`,
+				"container-injector.uthng.me/app-volume-mount-markdown": "/usr/share/nginx/html",
+			},
+			"mount path '/usr/share/nginx/html' of volume 'markdown' is already used by volume 'html' in container 'web'",
+		},
+		{
+			"OKAppVolumeMountAll",
+			map[string]string{
+				"container-injector.uthng.me/inject":                    "true",
+				"container-injector.uthng.me/name":                      "git-sync",
+				"container-injector.uthng.me/image":                     "k8s.gcr.io/git-sync:v3.1.3",
+				"container-injector.uthng.me/volume-mount-markdown":     "/tmp/git",
+				"container-injector.uthng.me/volume-source-markdown":    `{"emptyDir": {}}`,
+				"container-injector.uthng.me/app-volume-mount-markdown": "/srv/markdown",
+			},
+			`[
+	{"op":"add","path":"/spec/volumes/-","value":{"name":"markdown","emptyDir":{}}},
+	{"op":"add","path":"/spec/initContainers/0/volumeMounts","value":[{"name":"markdown","mountPath":"/srv/markdown"}]},
+	{"op":"add","path":"/spec/containers/0/volumeMounts/-","value":{"name":"markdown","mountPath":"/srv/markdown"}},
+	{"op":"add","path":"/spec/containers/1/volumeMounts","value":[{"name":"markdown","mountPath":"/srv/markdown"}]},
+	{"op":"add","path":"/spec/containers/-","value":{"name":"git-sync","image":"k8s.gcr.io/git-sync:v3.1.3","resources":{},"volumeMounts":[{"name":"markdown","mountPath":"/tmp/git"}]}},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"git-sync"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-volumes","value":"markdown"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"aeee355f8cb863b1"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}
+]`,
+		},
+		{
+			"OKAppVolumeMountFiltered",
+			map[string]string{
+				"container-injector.uthng.me/inject":                 "true",
+				"container-injector.uthng.me/name":                   "git-sync",
+				"container-injector.uthng.me/image":                  "k8s.gcr.io/git-sync:v3.1.3",
+				"container-injector.uthng.me/volume-source-markdown": `{"emptyDir": {}}`,
+				"container-injector.uthng.me/app-containers":         "worker",
+				"container-injector.uthng.me/app-volume-mount-markdown": `
+{
+	"mountPath": "/usr/share/nginx/html",
+	"readOnly": true,
+	"containers": ["web-init"]
+}`,
+			},
+			`[
+	{"op":"add","path":"/spec/volumes/-","value":{"name":"markdown","emptyDir":{}}},
+	{"op":"add","path":"/spec/initContainers/0/volumeMounts","value":[{"name":"markdown","readOnly":true,"mountPath":"/usr/share/nginx/html"}]},
+	{"op":"add","path":"/spec/containers/-","value":{"name":"git-sync","image":"k8s.gcr.io/git-sync:v3.1.3","resources":{}}},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"git-sync"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-volumes","value":"markdown"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"e10429530486a2b5"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}
+]`,
+		},
+		{
+			"OKAppVolumeMountAppContainers",
+			map[string]string{
+				"container-injector.uthng.me/inject":                  "true",
+				"container-injector.uthng.me/name":                    "git-sync",
+				"container-injector.uthng.me/image":                   "k8s.gcr.io/git-sync:v3.1.3",
+				"container-injector.uthng.me/volume-source-config":    `{"emptyDir": {}}`,
+				"container-injector.uthng.me/app-containers":          "worker",
+				"container-injector.uthng.me/app-volume-mount-config": "/etc/config",
+			},
+			`[
+	{"op":"add","path":"/spec/volumes/-","value":{"name":"config","emptyDir":{}}},
+	{"op":"add","path":"/spec/containers/1/volumeMounts","value":[{"name":"config","mountPath":"/etc/config"}]},
+	{"op":"add","path":"/spec/containers/-","value":{"name":"git-sync","image":"k8s.gcr.io/git-sync:v3.1.3","resources":{}}},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"git-sync"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-volumes","value":"config"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"611d36a11a29a695"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}
+]`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tc.annotations,
+				},
+				Spec: corev1.PodSpec{
+					InitContainers: []corev1.Container{
+						{Name: "web-init"},
+					},
+					Containers: []corev1.Container{
+						{
+							Name: "web",
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      "html",
+									MountPath: "/usr/share/nginx/html",
+								},
+							},
+						},
+						{Name: "worker"},
+					},
+					Volumes: []corev1.Volume{
+						{Name: "html"},
+					},
+				},
+			}
+
+			container, err := sidecar.NewContainer(pod)
+			require.Nil(t, err)
+
+			_, err = container.Patch()
+			if strings.HasPrefix(tc.name, "Err") {
+				require.Equal(t, tc.result, err.Error())
+				return
+			}
+
+			require.Nil(t, err)
+
+			jsonPatch, err := json.Marshal(container.Patches)
+			require.Nil(t, err)
+			require.JSONEq(t, tc.result.(string), string(jsonPatch))
+		})
+	}
+}
+
+func TestCreateContainerEnvVarSources(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		result      interface{}
+	}{
+		{
+			"ErrContainerEnvVarSecretRef",
+			map[string]string{
+				"container-injector.uthng.me/inject":       "true",
+				"container-injector.uthng.me/name":         "sleep",
+				"container-injector.uthng.me/image":        "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/env-PASSWORD": "secret:db",
+			},
+			"Annotation 'container-injector.uthng.me/env-PASSWORD' has an invalid value: reference 'db' must be formed as '<name>/<key>'",
+		},
+		{
+			"ErrContainerEnvVarJSONSource",
+			map[string]string{
+				"container-injector.uthng.me/inject":       "true",
+				"container-injector.uthng.me/name":         "sleep",
+				"container-injector.uthng.me/image":        "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/env-PASSWORD": `{"secretKeyRef": {"nme": "db", "key": "pw"}}`,
+			},
+			`Annotation 'container-injector.uthng.me/env-PASSWORD' has an invalid value: invalid json source: json: unknown field "nme"`,
+		},
+		{
+			"ErrContainerEnvVarJSONSourceKey",
+			map[string]string{
+				"container-injector.uthng.me/inject":       "true",
+				"container-injector.uthng.me/name":         "sleep",
+				"container-injector.uthng.me/image":        "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/env-PASSWORD": `{"secretKeyRf": {"name": "db", "key": "pw"}}`,
+			},
+			`Annotation 'container-injector.uthng.me/env-PASSWORD' has an invalid value: invalid json source: json: unknown field "secretKeyRf"`,
+		},
+		{
+			"ErrContainerEnvVarJSONSourceEmpty",
+			map[string]string{
+				"container-injector.uthng.me/inject":       "true",
+				"container-injector.uthng.me/name":         "sleep",
+				"container-injector.uthng.me/image":        "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/env-PASSWORD": `{"secretKeyRef": null}`,
+			},
+			"Annotation 'container-injector.uthng.me/env-PASSWORD' has an invalid value: json source must not be empty",
+		},
+		{
+			"ErrContainerEnvFrom",
+			map[string]string{
+				"container-injector.uthng.me/inject":   "true",
+				"container-injector.uthng.me/name":     "sleep",
+				"container-injector.uthng.me/image":    "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/env-from": "secret:db,vault:db",
+			},
+			"Annotation 'container-injector.uthng.me/env-from' has an invalid value: source 'vault:db' must be formed as 'secret:<name>' or 'configmap:<name>'",
+		},
+		{
+			"OKContainerEnvVarSources",
+			map[string]string{
+				"container-injector.uthng.me/inject":        "true",
+				"container-injector.uthng.me/name":          "sleep",
+				"container-injector.uthng.me/image":         "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/env-PASSWORD":  "secret:db/password",
+				"container-injector.uthng.me/env-LOG_LEVEL": "configmap:app-config/log-level",
+				"container-injector.uthng.me/env-POD_NS":    "field:metadata.namespace",
+				"container-injector.uthng.me/env-CPU":       "resource:limits.cpu",
+				"container-injector.uthng.me/env-POD_IP":    `{"fieldRef": {"fieldPath": "status.podIP"}}`,
+				"container-injector.uthng.me/env-CONFIG":    `{level: debug}`,
+				"container-injector.uthng.me/env-WAIT":      "10",
+				"container-injector.uthng.me/env-from":      "secret:db, configmap:app-config",
+			},
+			`
+{
+	"name": "sleep",
+	"image": "governmentpaas/curl-ssl",
+	"envFrom": [
+		{"secretRef": {"name": "db"}},
+		{"configMapRef": {"name": "app-config"}}
+	],
+	"env": [
+		{"name": "CONFIG", "value": "{level: debug}"},
+		{"name": "CPU", "valueFrom": {"resourceFieldRef": {"resource": "limits.cpu", "divisor": "1"}}},
+		{"name": "LOG_LEVEL", "valueFrom": {"configMapKeyRef": {"name": "app-config", "key": "log-level"}}},
+		{"name": "PASSWORD", "valueFrom": {"secretKeyRef": {"name": "db", "key": "password"}}},
+		{"name": "POD_IP", "valueFrom": {"fieldRef": {"fieldPath": "status.podIP"}}},
+		{"name": "POD_NS", "valueFrom": {"fieldRef": {"fieldPath": "metadata.namespace"}}},
+		{"name": "WAIT", "value": "10"}
+	],
+	"resources": {}
+}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tc.annotations,
+				},
+			}
+
+			container, err := sidecar.NewContainer(pod)
+			if err == nil {
+				_, err = container.Patch()
+			}
+
+			if strings.HasPrefix(tc.name, "Err") {
+				require.Equal(t, tc.result, err.Error())
+				return
+			}
+
+			require.Nil(t, err)
+
+			result := container.Patches[0].Value.([]corev1.Container)[0]
+
+			jsonContainer, err := json.Marshal(result)
+			require.Nil(t, err)
+			require.JSONEq(t, tc.result.(string), string(jsonContainer))
+		})
+	}
+}
+
+func TestCreateContainerCommandArgs(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		result      interface{}
+	}{
+		{
+			"ErrContainerCommandQuote",
+			map[string]string{
+				"container-injector.uthng.me/inject":  "true",
+				"container-injector.uthng.me/name":    "sleep",
+				"container-injector.uthng.me/image":   "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/command": "/bin/sh -c 'echo hi",
+			},
+			"Annotation 'container-injector.uthng.me/command' has an invalid value: unterminated single quote in '/bin/sh -c 'echo hi'",
+		},
+		{
+			"ErrContainerArgsJSON",
+			map[string]string{
+				"container-injector.uthng.me/inject": "true",
+				"container-injector.uthng.me/name":   "sleep",
+				"container-injector.uthng.me/image":  "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/args":   `["-c", 1]`,
+			},
+			`Annotation 'container-injector.uthng.me/args' has an invalid value: '["-c", 1]' must be a json array of strings`,
+		},
+		{
+			"OKContainerCommandShellWords",
+			map[string]string{
+				"container-injector.uthng.me/inject":  "true",
+				"container-injector.uthng.me/name":    "sleep",
+				"container-injector.uthng.me/image":   "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/command": `/bin/sh -ec 'echo "hello world"'`,
+				"container-injector.uthng.me/args":    `a\ b "c \"d\" \$e" ''`,
+			},
+			[]interface{}{
+				[]string{"/bin/sh", "-ec", `echo "hello world"`},
+				[]string{"a b", `c "d" $e`, ""},
+			},
+		},
+		{
+			"OKContainerCommandJSON",
+			map[string]string{
+				"container-injector.uthng.me/inject":  "true",
+				"container-injector.uthng.me/name":    "sleep",
+				"container-injector.uthng.me/image":   "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/command": `["/bin/sh", "-c", "echo 'hi'"]`,
+			},
+			[]interface{}{
+				[]string{"/bin/sh", "-c", "echo 'hi'"},
+				[]string(nil),
+			},
+		},
+		{
+			"OKContainerCommandBracket",
+			map[string]string{
+				"container-injector.uthng.me/inject":  "true",
+				"container-injector.uthng.me/name":    "sleep",
+				"container-injector.uthng.me/image":   "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/command": "[ -f /ready ]",
+				"container-injector.uthng.me/args":    `["$MODE" = "ready"]`,
+			},
+			[]interface{}{
+				[]string{"[", "-f", "/ready", "]"},
+				[]string{"[$MODE", "=", "ready]"},
+			},
+		},
+		{
+			"OKContainerArgsMultiLine",
+			map[string]string{
+				"container-injector.uthng.me/inject":  "true",
+				"container-injector.uthng.me/name":    "sleep",
+				"container-injector.uthng.me/image":   "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/command": "/bin/sh",
+				"container-injector.uthng.me/args":    "-ec\n'set -x\necho \"$HOME\"\n'\n",
+			},
+			[]interface{}{
+				[]string{"/bin/sh"},
+				[]string{"-ec", "set -x\necho \"$HOME\"\n"},
+			},
+		},
+		{
+			"OKContainerArgsShellScript",
+			map[string]string{
+				"container-injector.uthng.me/inject":  "true",
+				"container-injector.uthng.me/name":    "sleep",
+				"container-injector.uthng.me/image":   "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/command": "/bin/sh -ec",
+				"container-injector.uthng.me/args":    "echo a\necho \"$HOME\"\n",
+			},
+			[]interface{}{
+				[]string{"/bin/sh", "-ec"},
+				[]string{"echo a\necho \"$HOME\"\n"},
+			},
+		},
+		{
+			"OKContainerArgsShellScriptJSON",
+			map[string]string{
+				"container-injector.uthng.me/inject":  "true",
+				"container-injector.uthng.me/name":    "sleep",
+				"container-injector.uthng.me/image":   "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/command": "/bin/sh -c",
+				"container-injector.uthng.me/args":    "[\n\"echo a\",\n\"b\"\n]",
+			},
+			[]interface{}{
+				[]string{"/bin/sh", "-c"},
+				[]string{"echo a", "b"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tc.annotations,
+				},
+			}
+
+			container, err := sidecar.NewContainer(pod)
+			if err == nil {
+				_, err = container.Patch()
+			}
+
+			if strings.HasPrefix(tc.name, "Err") {
+				require.Equal(t, tc.result, err.Error())
+				return
+			}
+
+			require.Nil(t, err)
+
+			result := container.Patches[0].Value.([]corev1.Container)[0]
+			require.Equal(t, tc.result, []interface{}{result.Command, result.Args})
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	spec := corev1.PodSpec{
+		Containers: []corev1.Container{
+			{
+				Name: "web",
+			},
+		},
+		Volumes: []corev1.Volume{
+			{
+				Name: "shared",
+			},
+		},
+	}
+
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		result      interface{}
+	}{
+		{
+			"ErrContainerNameDuplicate",
+			map[string]string{
+				"container-injector.uthng.me/inject": "true",
+				"container-injector.uthng.me/name":   "web",
+				"container-injector.uthng.me/image":  "governmentpaas/curl-ssl",
+			},
+			`metadata.annotations[container-injector.uthng.me/name]: Duplicate value: "web"`,
+		},
+		{
+			"ErrContainerImage",
+			map[string]string{
+				"container-injector.uthng.me/inject": "true",
+				"container-injector.uthng.me/name":   "sleep",
+				"container-injector.uthng.me/image":  "Governmentpaas/curl-ssl:",
+			},
+			`metadata.annotations[container-injector.uthng.me/image]: Invalid value: "Governmentpaas/curl-ssl:": must be a valid image reference`,
+		},
+		{
+			"ErrContainerResources",
+			map[string]string{
+				"container-injector.uthng.me/inject":       "true",
+				"container-injector.uthng.me/name":         "sleep",
+				"container-injector.uthng.me/image":        "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/requests-mem": "lots",
+				"container-injector.uthng.me/limits":       `{"nvidia.com/gpu": "one"}`,
+			},
+			"[" +
+				`metadata.annotations[container-injector.uthng.me/requests-mem]: Invalid value: "lots": quantities must match the regular expression '^([+-]?[0-9.]+)([eEinumkKMGTP]*[-+]?[0-9]*)$', ` +
+				`metadata.annotations[container-injector.uthng.me/limits][nvidia.com/gpu]: Invalid value: "one": quantities must match the regular expression '^([+-]?[0-9.]+)([eEinumkKMGTP]*[-+]?[0-9]*)$'` +
+				"]",
+		},
+		{
+			"ErrContainerRequestsLimits",
+			map[string]string{
+				"container-injector.uthng.me/inject":       "true",
+				"container-injector.uthng.me/name":         "sleep",
+				"container-injector.uthng.me/image":        "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/limits-cpu":   "100m",
+				"container-injector.uthng.me/requests-cpu": "200m",
+			},
+			`metadata.annotations[container-injector.uthng.me/requests-cpu]: Invalid value: "200m": requested cpu '200m' must be less than or equal to its limit '100m'`,
+		},
+		{
+			"ErrContainerVolumes",
+			map[string]string{
+				"container-injector.uthng.me/inject":                "true",
+				"container-injector.uthng.me/name":                  "sleep",
+				"container-injector.uthng.me/image":                 "governmentpaas/curl-ssl",
+				"container-injector.uthng.me/volume-source-Cache":   `{"emptyDir": {}}`,
+				"container-injector.uthng.me/volume-mount-Cache":    "/cache",
+				"container-injector.uthng.me/volume-mount-data":     "/data",
+				"container-injector.uthng.me/app-volume-mount-logs": "logs",
+				"container-injector.uthng.me/tls-secret":            "tls",
+				"container-injector.uthng.me/tls-mount-path":        "tls",
+			},
+			"[" +
+				`metadata.annotations[container-injector.uthng.me/volume-source-Cache]: Invalid value: "Cache": a lowercase RFC 1123 label must consist of lower case alphanumeric characters or '-', and must start and end with an alphanumeric character (e.g. 'my-name',  or '123-abc', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?'), ` +
+				`metadata.annotations[container-injector.uthng.me/volume-mount-Cache]: Invalid value: "Cache": a lowercase RFC 1123 label must consist of lower case alphanumeric characters or '-', and must start and end with an alphanumeric character (e.g. 'my-name',  or '123-abc', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?'), ` +
+				`metadata.annotations[container-injector.uthng.me/volume-mount-data]: Not found: "data", ` +
+				`metadata.annotations[container-injector.uthng.me/app-volume-mount-logs]: Not found: "logs", ` +
+				`metadata.annotations[container-injector.uthng.me/app-volume-mount-logs]: Invalid value: "logs": must be an absolute path, ` +
+				`metadata.annotations[container-injector.uthng.me/tls-mount-path]: Invalid value: "tls": must be an absolute path` +
+				"]",
+		},
+		{
+			"OKContainerVolumes",
+			map[string]string{
+				"container-injector.uthng.me/inject":                    "true",
+				"container-injector.uthng.me/name":                      "sleep",
+				"container-injector.uthng.me/image":                     "registry.example.com:5000/governmentpaas/curl-ssl:1.0",
+				"container-injector.uthng.me/pull-policy":               "IfNotPresent",
+				"container-injector.uthng.me/volume-mount-shared":       "/shared",
+				"container-injector.uthng.me/app-volume-mount-cache":    "/cache",
+				"container-injector.uthng.me/proxy.name":                "proxy",
+				"container-injector.uthng.me/proxy.image":               "envoyproxy/envoy@sha256:0123456789abcdef0123456789abcdef",
+				"container-injector.uthng.me/proxy.volume-source-cache": `{"emptyDir": {}}`,
+			},
+			nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tc.annotations,
+				},
+				Spec: spec,
+			}
+
+			sidecars, err := sidecar.NewSidecars(pod)
+			require.Nil(t, err)
+
+			err = sidecars.Validate()
+			if strings.HasPrefix(tc.name, "Err") {
+				require.Equal(t, tc.result, err.Error())
+				return
+			}
+
+			require.Nil(t, err)
+		})
+	}
+}
+
+func TestPatchReinjection(t *testing.T) {
+	spec := corev1.PodSpec{
+		Containers: []corev1.Container{
+			{
+				Name: "web",
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "cache", MountPath: "/cache"},
+				},
+			},
+			{
+				Name:  "proxy",
+				Image: "envoyproxy/envoy:v1",
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "proxy-tls", MountPath: "/etc/tls", ReadOnly: true},
+				},
+			},
+		},
+		Volumes: []corev1.Volume{
+			{Name: "cache"},
+			{Name: "proxy-tls"},
+		},
+	}
+
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		result      interface{}
+	}{
+		{
+			"ErrReinjectionNotRecorded",
+			map[string]string{
+				"container-injector.uthng.me/inject": "true",
+				"container-injector.uthng.me/name":   "proxy",
+				"container-injector.uthng.me/image":  "envoyproxy/envoy:v2",
+			},
+			`metadata.annotations[container-injector.uthng.me/name]: Duplicate value: "proxy"`,
+		},
+		{
+			"OKReinjectionInitContainer",
+			map[string]string{
+				"container-injector.uthng.me/inject":              "true",
+				"container-injector.uthng.me/name":                "proxy",
+				"container-injector.uthng.me/image":               "envoyproxy/envoy:v2",
+				"container-injector.uthng.me/init-container":      "true",
+				"container-injector.uthng.me/injected-containers": "proxy",
+			},
+			`[
+	{"op":"remove","path":"/spec/containers/1"},
+	{"op":"add","path":"/spec/initContainers","value":[{"name":"proxy","image":"envoyproxy/envoy:v2","resources":{}}]},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"proxy"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"d918d3f29ca424cb"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}
+]`,
+		},
+		{
+			"OKReinjection",
+			map[string]string{
+				"container-injector.uthng.me/inject":                 "true",
+				"container-injector.uthng.me/name":                   "proxy",
+				"container-injector.uthng.me/image":                  "envoyproxy/envoy:v2",
+				"container-injector.uthng.me/tls-secret":             "proxy-tls",
+				"container-injector.uthng.me/volume-source-cache":    `{"emptyDir": {}}`,
+				"container-injector.uthng.me/app-volume-mount-cache": `{"mountPath": "/cache", "readOnly": true, "containers": ["web"]}`,
+				"container-injector.uthng.me/injected-containers":    "proxy",
+				"container-injector.uthng.me/injected-volumes":       "cache,proxy-tls",
+			},
+			`[
+	{"op":"replace","path":"/spec/volumes/0","value":{"name":"cache","emptyDir":{}}},
+	{"op":"replace","path":"/spec/volumes/1","value":{"name":"proxy-tls","secret":{"secretName":"proxy-tls"}}},
+	{"op":"replace","path":"/spec/containers/0/volumeMounts/0","value":{"name":"cache","readOnly":true,"mountPath":"/cache"}},
+	{"op":"replace","path":"/spec/containers/1","value":{"name":"proxy","image":"envoyproxy/envoy:v2","resources":{},"volumeMounts":[{"name":"proxy-tls","readOnly":true,"mountPath":"/etc/tls"}]}},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"proxy"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-volumes","value":"cache,proxy-tls"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"666696f841ffc28e"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}
+]`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tc.annotations,
+				},
+				Spec: spec,
+			}
+
+			sidecars, err := sidecar.NewSidecars(pod)
+			require.Nil(t, err)
+
+			err = sidecars.Validate()
+			if err == nil {
+				_, err = sidecars.Patch()
+			}
+
+			if strings.HasPrefix(tc.name, "Err") {
+				require.Equal(t, tc.result, err.Error())
+				return
+			}
+
+			require.Nil(t, err)
+
+			jsonPatch, err := json.Marshal(sidecars.Patches)
+			require.Nil(t, err)
+			require.JSONEq(t, tc.result.(string), string(jsonPatch))
+		})
+	}
+}
+
+func TestUninject(t *testing.T) {
+	spec := corev1.PodSpec{
+		InitContainers: []corev1.Container{
+			{Name: "init"},
+		},
+		Containers: []corev1.Container{
+			{
+				Name: "web",
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "data", MountPath: "/data"},
+				},
+			},
+		},
+		Volumes: []corev1.Volume{
+			{Name: "data"},
+		},
+	}
+
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		result      interface{}
+	}{
+		{
+			"OKUninjectContainer",
+			map[string]string{
+				"container-injector.uthng.me/name":                   "proxy",
+				"container-injector.uthng.me/image":                  "envoyproxy/envoy",
+				"container-injector.uthng.me/tls-secret":             "proxy-tls",
+				"container-injector.uthng.me/seccomp-profile":        "runtime/default",
+				"container-injector.uthng.me/volume-source-cache":    `{"emptyDir": {}}`,
+				"container-injector.uthng.me/app-volume-mount-cache": "/cache",
+			},
+			`[
+	{"op":"remove","path":"/spec/initContainers/0/volumeMounts"},
+	{"op":"remove","path":"/spec/containers/0/volumeMounts/1"},
+	{"op":"remove","path":"/spec/containers/1"},
+	{"op":"remove","path":"/spec/volumes/2"},
+	{"op":"remove","path":"/spec/volumes/1"},
+	{"op":"remove","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers"},
+	{"op":"remove","path":"/metadata/annotations/container-injector.uthng.me~1injected-volumes"},
+	{"op":"remove","path":"/metadata/annotations/container-injector.uthng.me~1status"},
+	{"op":"remove","path":"/metadata/annotations/container-injector.uthng.me~1status-hash"},
+	{"op":"remove","path":"/metadata/annotations/container-injector.uthng.me~1status-version"}
+]`,
+		},
+		{
+			"OKUninjectGroups",
+			map[string]string{
+				"container-injector.uthng.me/migrate.name":           "migrate",
+				"container-injector.uthng.me/migrate.image":          "migrate/migrate",
+				"container-injector.uthng.me/migrate.init-container": "true",
+				"container-injector.uthng.me/migrate.init-first":     "true",
+				"container-injector.uthng.me/logs.name":              "fluent-bit",
+				"container-injector.uthng.me/logs.image":             "fluent/fluent-bit",
+			},
+			`[
+	{"op":"remove","path":"/spec/initContainers/0"},
+	{"op":"remove","path":"/spec/containers/1"},
+	{"op":"remove","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers"},
+	{"op":"remove","path":"/metadata/annotations/container-injector.uthng.me~1status"},
+	{"op":"remove","path":"/metadata/annotations/container-injector.uthng.me~1status-hash"},
+	{"op":"remove","path":"/metadata/annotations/container-injector.uthng.me~1status-version"}
+]`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			annotations := map[string]string{
+				"container-injector.uthng.me/inject": "true",
+			}
+
+			for k, v := range tc.annotations {
+				annotations[k] = v
+			}
+
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: annotations,
+				},
+				Spec: *spec.DeepCopy(),
+			}
+
+			sidecars, err := sidecar.NewSidecars(pod)
+			require.Nil(t, err)
+
+			patch, err := sidecars.Patch()
+			require.Nil(t, err)
+
+			// Disable injection on both the original and the injected pods
+			pod.Annotations["container-injector.uthng.me/inject"] = "false"
+
+			injectedPod := applyPatch(t, pod, patch)
+			require.True(t, sidecar.IsInjected(injectedPod))
+
+			patch, err = sidecar.Uninject(injectedPod)
+			require.Nil(t, err)
+			require.JSONEq(t, tc.result.(string), string(patch))
+
+			jsonPod, err := json.Marshal(pod)
+			require.Nil(t, err)
+
+			jsonUninjectedPod, err := json.Marshal(applyPatch(t, injectedPod, patch))
+			require.Nil(t, err)
+			require.JSONEq(t, string(jsonPod), string(jsonUninjectedPod))
+		})
+	}
+}
+
+func applyPatch(t *testing.T, pod *corev1.Pod, patch []byte) *corev1.Pod {
+	jsonPod, err := json.Marshal(pod)
+	require.Nil(t, err)
+
+	p, err := jsonpatch.DecodePatch(patch)
+	require.Nil(t, err)
+
+	jsonPod, err = p.Apply(jsonPod)
+	require.Nil(t, err)
+
+	result := &corev1.Pod{}
+	require.Nil(t, json.Unmarshal(jsonPod, result))
+
+	return result
+}
+
+func TestPatchStatusHash(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				"container-injector.uthng.me/inject":     "true",
+				"container-injector.uthng.me/name":       "proxy",
+				"container-injector.uthng.me/image":      "envoyproxy/envoy:v1",
+				"container-injector.uthng.me/tls-secret": "proxy-tls",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "web"},
+			},
+		},
+	}
+
+	sidecars, err := sidecar.NewSidecars(pod)
+	require.Nil(t, err)
+
+	patch, err := sidecars.Patch()
+	require.Nil(t, err)
+
+	injectedPod := applyPatch(t, pod, patch)
+
+	status := sidecar.GetStatus(injectedPod)
+	require.Equal(t, "injected", status.Status)
+	require.Equal(t, "dev", status.Version)
+	require.Len(t, status.Hash, 16)
+	require.Equal(t, []string{"proxy"}, status.Containers)
+	require.Equal(t, []string{"proxy-tls"}, status.Volumes)
+
+	// Forcing a new injection without changes only restores the status
+	delete(injectedPod.Annotations, "container-injector.uthng.me/status")
+
+	sidecars, err = sidecar.NewSidecars(injectedPod)
+	require.Nil(t, err)
+
+	patch, err = sidecars.Patch()
+	require.Nil(t, err)
+	require.JSONEq(t, `[{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"}]`, string(patch))
+
+	// Changing an annotation replaces the container with a new hash
+	injectedPod.Annotations["container-injector.uthng.me/image"] = "envoyproxy/envoy:v2"
+
+	sidecars, err = sidecar.NewSidecars(injectedPod)
+	require.Nil(t, err)
+
+	patch, err = sidecars.Patch()
+	require.Nil(t, err)
+
+	reinjectedPod := applyPatch(t, injectedPod, patch)
+	require.Equal(t, "envoyproxy/envoy:v2", reinjectedPod.Spec.Containers[1].Image)
+	require.Len(t, reinjectedPod.Spec.Containers, 2)
+	require.Len(t, reinjectedPod.Spec.Volumes, 1)
+	require.NotEqual(t, status.Hash, sidecar.GetStatus(reinjectedPod).Hash)
+}
+
+func TestCollisions(t *testing.T) {
+	configMaps := map[string]*corev1.ConfigMap{
+		"proxy": {
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "proxy",
+			},
+			Data: map[string]string{
+				"container": `
+name: proxy
+image: envoyproxy/envoy:v1
+ports:
+- containerPort: 8080
+- containerPort: 9901
+volumeMounts:
+- name: config
+  mountPath: /etc/envoy
+`,
+				"volumes": `
+- name: config
+  configMap:
+    name: proxy-config
+`,
+			},
+		},
+	}
+
+	getter := func(name string) (*corev1.ConfigMap, error) {
+		if cm, ok := configMaps[name]; ok {
+			return cm, nil
+		}
+
+		return nil, fmt.Errorf("configmaps \"%s\" not found", name)
+	}
+
+	spec := corev1.PodSpec{
+		Containers: []corev1.Container{
+			{
+				Name: "proxy",
+				Ports: []corev1.ContainerPort{
+					{ContainerPort: 8080},
+				},
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "config", MountPath: "/config"},
+				},
+			},
+		},
+		Volumes: []corev1.Volume{
+			{Name: "config"},
+		},
+	}
+
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		result      interface{}
+	}{
+		{
+			"ErrCollisionStrategy",
+			map[string]string{
+				"container-injector.uthng.me/inject":       "true",
+				"container-injector.uthng.me/configmap":    "proxy",
+				"container-injector.uthng.me/on-collision": "rename",
+			},
+			`metadata.annotations[container-injector.uthng.me/on-collision]: Unsupported value: "rename": supported values: "fail", "reuse", "suffix"`,
+		},
+		{
+			"ErrCollisionFail",
+			map[string]string{
+				"container-injector.uthng.me/inject":    "true",
+				"container-injector.uthng.me/configmap": "proxy",
+			},
+			`[metadata.annotations[container-injector.uthng.me/name]: Duplicate value: "proxy", metadata.annotations[container-injector.uthng.me/configmap]: Duplicate value: "config", metadata.annotations[container-injector.uthng.me/configmap].ports: Duplicate value: 8080]`,
+		},
+		{
+			"ErrCollisionFailVolumeSource",
+			map[string]string{
+				"container-injector.uthng.me/inject":               "true",
+				"container-injector.uthng.me/configmap":            "proxy",
+				"container-injector.uthng.me/name":                 "envoy",
+				"container-injector.uthng.me/volume-source-config": `{"emptyDir": {}}`,
+			},
+			`[metadata.annotations[container-injector.uthng.me/volume-source-config]: Duplicate value: "config", metadata.annotations[container-injector.uthng.me/configmap].ports: Duplicate value: 8080]`,
+		},
+		{
+			"OKCollisionReuseContainer",
+			map[string]string{
+				"container-injector.uthng.me/inject":       "true",
+				"container-injector.uthng.me/configmap":    "proxy",
+				"container-injector.uthng.me/on-collision": "reuse",
+			},
+			`[
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"c1abc5b2aaf8a3e7"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}
+]`,
+		},
+		{
+			"OKCollisionReuse",
+			map[string]string{
+				"container-injector.uthng.me/inject":       "true",
+				"container-injector.uthng.me/configmap":    "proxy",
+				"container-injector.uthng.me/name":         "envoy",
+				"container-injector.uthng.me/on-collision": "reuse",
+			},
+			`[
+	{"op":"add","path":"/spec/containers/-","value":{"name":"envoy","image":"envoyproxy/envoy:v1","ports":[{"containerPort":9901}],"resources":{},"volumeMounts":[{"name":"config","mountPath":"/etc/envoy"}]}},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"envoy"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"4cb23bc9efd87c0b"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}
+]`,
+		},
+		{
+			"OKCollisionSuffix",
+			map[string]string{
+				"container-injector.uthng.me/inject":                  "true",
+				"container-injector.uthng.me/configmap":               "proxy",
+				"container-injector.uthng.me/on-collision":            "suffix",
+				"container-injector.uthng.me/app-volume-mount-config": `{"mountPath": "/envoy", "containers": ["proxy"]}`,
+			},
+			`[
+	{"op":"add","path":"/spec/volumes/-","value":{"name":"config-1","configMap":{"name":"proxy-config"}}},
+	{"op":"add","path":"/spec/containers/0/volumeMounts/-","value":{"name":"config-1","mountPath":"/envoy"}},
+	{"op":"add","path":"/spec/containers/-","value":{"name":"proxy-1","image":"envoyproxy/envoy:v1","ports":[{"containerPort":8081},{"containerPort":9901}],"resources":{},"volumeMounts":[{"name":"config-1","mountPath":"/etc/envoy"}]}},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"proxy-1"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-volumes","value":"config-1"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"57b793333f1a6423"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}
+]`,
+		},
+		{
+			"OKCollisionSuffixSharedVolume",
+			map[string]string{
+				"container-injector.uthng.me/inject":                 "true",
+				"container-injector.uthng.me/on-collision":           "suffix",
+				"container-injector.uthng.me/a.name":                 "a",
+				"container-injector.uthng.me/a.image":                "busybox",
+				"container-injector.uthng.me/a.volume-source-config": `{"emptyDir": {}}`,
+				"container-injector.uthng.me/a.volume-mount-config":  "/a",
+				"container-injector.uthng.me/b.name":                 "b",
+				"container-injector.uthng.me/b.image":                "busybox",
+				"container-injector.uthng.me/b.volume-source-config": `{"emptyDir": {}}`,
+				"container-injector.uthng.me/b.volume-mount-config":  "/b",
+			},
+			`[
+	{"op":"add","path":"/spec/volumes/-","value":{"name":"config-1","emptyDir":{}}},
+	{"op":"add","path":"/spec/containers/-","value":{"name":"a","image":"busybox","resources":{},"volumeMounts":[{"name":"config-1","mountPath":"/a"}]}},
+	{"op":"add","path":"/spec/containers/-","value":{"name":"b","image":"busybox","resources":{},"volumeMounts":[{"name":"config-1","mountPath":"/b"}]}},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-containers","value":"a,b"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1injected-volumes","value":"config-1"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"2556cfaa7a9c3c63"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}
+]`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tc.annotations,
+				},
+				Spec: spec,
+			}
+
+			sidecars, err := sidecar.NewSidecars(pod)
+			require.Nil(t, err)
+
+			err = sidecars.LoadTemplates(getter)
+			require.Nil(t, err)
+
+			err = sidecars.Validate()
+			if err == nil {
+				_, err = sidecars.Patch()
+			}
+
+			if strings.HasPrefix(tc.name, "Err") {
+				require.Equal(t, tc.result, err.Error())
+				return
+			}
+
+			require.Nil(t, err)
+
+			jsonPatch, err := json.Marshal(sidecars.Patches)
+			require.Nil(t, err)
+			require.JSONEq(t, tc.result.(string), string(jsonPatch))
+		})
+	}
+}
+
+func TestExpandAnnotations(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		result      interface{}
+	}{
+		{
+			"OKExpandAnnotations",
+			map[string]string{
+				"container-injector.uthng.me/inject":               "true",
+				"container-injector.uthng.me/name":                 "{{ .Labels.app }}-proxy",
+				"container-injector.uthng.me/image":                "envoyproxy/envoy:v1",
+				"container-injector.uthng.me/args":                 `--service={{ .Labels.app }} --cluster='{{ .Annotations.cluster | default "local" }}'`,
+				"container-injector.uthng.me/env-POD":              "{{ .GenerateName | trunc 3 }}.{{ .Namespace }}",
+				"container-injector.uthng.me/env-SA":               `{{ .ServiceAccountName | replace "-" "_" | lower }}`,
+				"container-injector.uthng.me/env-IMAGE":            "{{ .Images.web }}",
+				"container-injector.uthng.me/volume-mount-config":  "/etc/{{ .Labels.app }}",
+				"container-injector.uthng.me/volume-source-config": `{"configMap": {"name": "{{ .Labels.app }}-config"}}`,
+			},
+			corev1.Container{
+				Name:  "web-proxy",
+				Image: "envoyproxy/envoy:v1",
+				Args:  []string{"--service=web", "--cluster=local"},
+				Env: []corev1.EnvVar{
+					{Name: "IMAGE", Value: "nginx:1.19"},
+					{Name: "POD", Value: "web.default"},
+					{Name: "SA", Value: "web_app"},
+				},
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "config", MountPath: "/etc/web"},
+				},
+			},
+		},
+		{
+			"OKExpandAnnotationsEscape",
+			map[string]string{
+				"container-injector.uthng.me/inject":  "true",
+				"container-injector.uthng.me/name":    "proxy",
+				"container-injector.uthng.me/image":   "envoyproxy/envoy:v1",
+				"container-injector.uthng.me/env-FMT": `{{"{{"}} .Level }} {{ .Labels.app }}`,
+			},
+			corev1.Container{
+				Name:  "proxy",
+				Image: "envoyproxy/envoy:v1",
+				Env: []corev1.EnvVar{
+					{Name: "FMT", Value: "{{ .Level }} web"},
+				},
+			},
+		},
+		{
+			"OKExpandAnnotationsDisabled",
+			map[string]string{
+				"container-injector.uthng.me/inject":           "true",
+				"container-injector.uthng.me/name":             "proxy",
+				"container-injector.uthng.me/image":            "envoyproxy/envoy:v1",
+				"container-injector.uthng.me/expand-templates": "false",
+				"container-injector.uthng.me/args":             "--format={{.Level}}",
+				"container-injector.uthng.me/env-FMT":          "{{ .Labels.app ",
+			},
+			corev1.Container{
+				Name:  "proxy",
+				Image: "envoyproxy/envoy:v1",
+				Args:  []string{"--format={{.Level}}"},
+				Env: []corev1.EnvVar{
+					{Name: "FMT", Value: "{{ .Labels.app "},
+				},
+			},
+		},
+		{
+			"ErrExpandAnnotationsParse",
+			map[string]string{
+				"container-injector.uthng.me/inject":  "true",
+				"container-injector.uthng.me/name":    "proxy",
+				"container-injector.uthng.me/image":   "envoyproxy/envoy:v1",
+				"container-injector.uthng.me/env-APP": "{{ .Labels.app ",
+			},
+			"Annotation 'container-injector.uthng.me/env-APP' has an invalid value: template: container-injector.uthng.me/env-APP:1: unclosed action",
+		},
+		{
+			"ErrExpandAnnotationsExecute",
+			map[string]string{
+				"container-injector.uthng.me/inject": "true",
+				"container-injector.uthng.me/name":   "proxy",
+				"container-injector.uthng.me/image":  "envoyproxy/envoy:v1",
+				"container-injector.uthng.me/args":   "{{ .Node }}",
+			},
+			`Annotation 'container-injector.uthng.me/args' has an invalid value: template: container-injector.uthng.me/args:1:3: executing "container-injector.uthng.me/args" at <.Node>: can't evaluate field Node in type *sidecar.templateData`,
+		},
+		{
+			"ErrExpandAnnotationsTimeout",
+			map[string]string{
+				"container-injector.uthng.me/inject": "true",
+				"container-injector.uthng.me/name":   "proxy",
+				"container-injector.uthng.me/image":  "envoyproxy/envoy:v1",
+				"container-injector.uthng.me/args":   "{{ range 1000000000 }}{{ end }}",
+			},
+			"Annotation 'container-injector.uthng.me/args' has an invalid value: expansion takes longer than 100ms",
+		},
+		{
+			"ErrExpandAnnotationsTimeoutTemplate",
+			map[string]string{
+				"container-injector.uthng.me/inject": "true",
+				"container-injector.uthng.me/name":   "proxy",
+				"container-injector.uthng.me/image":  "envoyproxy/envoy:v1",
+				"container-injector.uthng.me/args":   `{{ define "a" }}{{ template "b" }}{{ template "b" }}{{ end }}{{ define "b" }}{{ template "a" }}{{ template "a" }}{{ end }}{{ template "a" }}`,
+			},
+			"Annotation 'container-injector.uthng.me/args' has an invalid value: expansion takes longer than 100ms",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					GenerateName: "web-7d9f-",
+					Namespace:    "default",
+					Labels: map[string]string{
+						"app": "web",
+					},
+					Annotations: tc.annotations,
+				},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: "Web-App",
+					Containers: []corev1.Container{
+						{Name: "web", Image: "nginx:1.19"},
+					},
+				},
+			}
+
+			container, err := sidecar.NewContainer(pod)
+			if strings.HasPrefix(tc.name, "Err") {
+				require.Equal(t, tc.result, err.Error())
+				return
+			}
+
+			require.Nil(t, err)
+
+			container.Patch()
+
+			var jsonContainer []byte
+			for _, patch := range container.Patches {
+				if patch.Path == "/spec/containers/-" {
+					jsonContainer, err = json.Marshal(patch.Value)
+					require.Nil(t, err)
+				}
+			}
+
+			result := corev1.Container{}
+			err = json.Unmarshal(jsonContainer, &result)
+			require.Nil(t, err)
+
+			require.Equal(t, tc.result, result)
+		})
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	profile, err := sidecar.NewProfile(`
+name: fluent-bit
+image: fluent/fluent-bit:1.4
+env:
+- name: LOG_LEVEL
+  value: info
+volumeMounts:
+- name: fluent-bit-config
+  mountPath: /fluent-bit/etc
+resources:
+  limits:
+    memory: 128Mi
+`, `
+- name: fluent-bit-config
+  configMap:
+    name: fluent-bit-config
+`, []string{"image", "env", "limits-mem"})
+	require.Nil(t, err)
+
+	_, err = sidecar.NewProfile(`name: [fluent-bit`, "", nil)
+	require.NotNil(t, err)
+
+	config := &sidecar.Config{
+		SidecarMode: sidecar.SidecarModeClassic,
+		Profiles: map[string]*sidecar.Profile{
+			"log-shipper": profile,
+		},
+	}
+
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		result      interface{}
+	}{
+		{
+			"ErrProfileNotFound",
+			map[string]string{
+				"container-injector.uthng.me/inject":  "true",
+				"container-injector.uthng.me/profile": "metrics",
+			},
+			"Annotation 'container-injector.uthng.me/profile' has an invalid value: profile 'metrics' not found",
+		},
+		{
+			"ErrProfileConfigMap",
+			map[string]string{
+				"container-injector.uthng.me/inject":    "true",
+				"container-injector.uthng.me/profile":   "log-shipper",
+				"container-injector.uthng.me/configmap": "fluent-bit",
+			},
+			"Annotations 'container-injector.uthng.me/configmap' and 'container-injector.uthng.me/profile' cannot be used together",
+		},
+		{
+			"ErrProfileOverrides",
+			map[string]string{
+				"container-injector.uthng.me/inject":       "true",
+				"container-injector.uthng.me/profile":      "log-shipper",
+				"container-injector.uthng.me/limits-cpu":   "1",
+				"container-injector.uthng.me/pull-policy":  "Always",
+				"container-injector.uthng.me/env-LOG_FILE": "/var/log/app.log",
+			},
+			"[metadata.annotations[container-injector.uthng.me/limits-cpu]: Forbidden: profile 'log-shipper' cannot be overridden by this annotation, metadata.annotations[container-injector.uthng.me/pull-policy]: Forbidden: profile 'log-shipper' cannot be overridden by this annotation]",
+		},
+		{
+			"OKProfile",
+			map[string]string{
+				"container-injector.uthng.me/inject":  "true",
+				"container-injector.uthng.me/profile": "log-shipper",
+			},
+			`[
+	{"op":"add","path":"/spec/volumes","value":[{"name":"fluent-bit-config","configMap":{"name":"fluent-bit-config"}}]},
+	{"op":"add","path":"/spec/containers/-","value":{"name":"fluent-bit","image":"fluent/fluent-bit:1.4","env":[{"name":"LOG_LEVEL","value":"info"}],"resources":{"limits":{"memory":"128Mi"}},"volumeMounts":[{"name":"fluent-bit-config","mountPath":"/fluent-bit/etc"}]}}
+]`,
+		},
+		{
+			"OKProfileOverrides",
+			map[string]string{
+				"container-injector.uthng.me/inject":             "true",
+				"container-injector.uthng.me/logs.profile":       "log-shipper",
+				"container-injector.uthng.me/logs.image":         "fluent/fluent-bit:1.5",
+				"container-injector.uthng.me/logs.limits-mem":    "256Mi",
+				"container-injector.uthng.me/logs.env-LOG_LEVEL": "debug",
+			},
+			`[
+	{"op":"add","path":"/spec/volumes","value":[{"name":"fluent-bit-config","configMap":{"name":"fluent-bit-config"}}]},
+	{"op":"add","path":"/spec/containers/-","value":{"name":"fluent-bit","image":"fluent/fluent-bit:1.5","env":[{"name":"LOG_LEVEL","value":"debug"}],"resources":{"limits":{"memory":"256Mi"}},"volumeMounts":[{"name":"fluent-bit-config","mountPath":"/fluent-bit/etc"}]}}
+]`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tc.annotations,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "web"},
+					},
+				},
+			}
+
+			sidecars, err := sidecar.NewSidecarsWithConfig(pod, config)
+			if err == nil {
+				err = sidecars.Validate()
+			}
+
+			if strings.HasPrefix(tc.name, "Err") {
+				require.Equal(t, tc.result, err.Error())
+				return
+			}
+
+			require.Nil(t, err)
+
+			_, err = sidecars.Patch()
+			require.Nil(t, err)
+
+			// Only the volumes and the container are checked
+			jsonPatch, err := json.Marshal(sidecars.Patches[:2])
+			require.Nil(t, err)
+			require.JSONEq(t, tc.result.(string), string(jsonPatch))
+		})
+	}
+}
+
+func TestAnnotationPrefix(t *testing.T) {
+	config := &sidecar.Config{
+		SidecarMode:              sidecar.SidecarModeClassic,
+		AnnotationPrefix:         "sidecar.example.com/",
+		LegacyAnnotationPrefixes: []string{"container-injector.uthng.me/"},
+	}
+
+	require.Nil(t, config.Validate())
+	require.Equal(t, "sidecar.example.com/inject", config.AnnotationKey(sidecar.AnnotationContainerInject))
+
+	err := (&sidecar.Config{SidecarMode: sidecar.SidecarModeClassic, AnnotationPrefix: "sidecar.example.com"}).Validate()
+	require.Equal(t, "invalid annotation prefix 'sidecar.example.com': must end with '/'", err.Error())
+
+	err = (&sidecar.Config{SidecarMode: sidecar.SidecarModeClassic, LegacyAnnotationPrefixes: []string{"Sidecar/"}}).Validate()
+	require.NotNil(t, err)
+
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		result      interface{}
+	}{
+		{
+			"ErrPrefixInjectMissing",
+			map[string]string{
+				"other.example.com/inject": "true",
+				"other.example.com/name":   "proxy",
+				"other.example.com/image":  "envoyproxy/envoy",
+			},
+			"Annotation 'sidecar.example.com/inject' not found",
+		},
+		{
+			"ErrPrefixInvalidValue",
+			map[string]string{
+				"sidecar.example.com/inject":      "true",
+				"sidecar.example.com/name":        "proxy",
+				"sidecar.example.com/image":       "envoyproxy/envoy",
+				"sidecar.example.com/pull-policy": "Sometimes",
+			},
+			`metadata.annotations[sidecar.example.com/pull-policy]: Unsupported value: "Sometimes": supported values: "Always", "IfNotPresent", "Never"`,
+		},
+		{
+			"OKPrefix",
+			map[string]string{
+				"sidecar.example.com/inject": "true",
+				"sidecar.example.com/name":   "proxy",
+				"sidecar.example.com/image":  "envoyproxy/envoy",
+			},
+			`[
+	{"op":"add","path":"/spec/containers/-","value":{"name":"proxy","image":"envoyproxy/envoy","resources":{}}},
+	{"op":"add","path":"/metadata/annotations/sidecar.example.com~1injected-containers","value":"proxy"},
+	{"op":"add","path":"/metadata/annotations/sidecar.example.com~1status","value":"injected"},
+	{"op":"add","path":"/metadata/annotations/sidecar.example.com~1status-hash","value":"eb5ee9b02da5b5fb"},
+	{"op":"add","path":"/metadata/annotations/sidecar.example.com~1status-version","value":"dev"}
+]`,
+		},
+		{
+			"OKLegacyPrefix",
+			map[string]string{
+				"container-injector.uthng.me/inject": "true",
+				"container-injector.uthng.me/name":   "proxy",
+				"container-injector.uthng.me/image":  "envoyproxy/envoy",
+			},
+			`[
+	{"op":"add","path":"/spec/containers/-","value":{"name":"proxy","image":"envoyproxy/envoy","resources":{}}},
+	{"op":"add","path":"/metadata/annotations/sidecar.example.com~1injected-containers","value":"proxy"},
+	{"op":"add","path":"/metadata/annotations/sidecar.example.com~1status","value":"injected"},
+	{"op":"add","path":"/metadata/annotations/sidecar.example.com~1status-hash","value":"eb5ee9b02da5b5fb"},
+	{"op":"add","path":"/metadata/annotations/sidecar.example.com~1status-version","value":"dev"}
+]`,
+		},
+		{
+			"OKPrefixPrecedence",
+			map[string]string{
+				"sidecar.example.com/inject":             "true",
+				"sidecar.example.com/name":               "proxy",
+				"sidecar.example.com/image":              "envoyproxy/envoy:v1.14",
+				"container-injector.uthng.me/image":      "envoyproxy/envoy",
+				"container-injector.uthng.me/logs.name":  "fluent-bit",
+				"container-injector.uthng.me/logs.image": "fluent/fluent-bit",
+			},
+			`[
+	{"op":"add","path":"/spec/containers/-","value":{"name":"proxy","image":"envoyproxy/envoy:v1.14","resources":{}}},
+	{"op":"add","path":"/spec/containers/-","value":{"name":"fluent-bit","image":"fluent/fluent-bit","resources":{}}},
+	{"op":"add","path":"/metadata/annotations/sidecar.example.com~1injected-containers","value":"fluent-bit,proxy"},
+	{"op":"add","path":"/metadata/annotations/sidecar.example.com~1status","value":"injected"},
+	{"op":"add","path":"/metadata/annotations/sidecar.example.com~1status-hash","value":"61ef6d681babd964"},
+	{"op":"add","path":"/metadata/annotations/sidecar.example.com~1status-version","value":"dev"}
+]`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tc.annotations,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "web"},
+					},
+				},
+			}
+
+			sidecars, err := sidecar.NewSidecarsWithConfig(pod, config)
+			if err == nil {
+				err = sidecars.Validate()
+			}
+
+			if strings.HasPrefix(tc.name, "Err") {
+				require.Equal(t, tc.result, err.Error())
+				return
+			}
+
+			require.Nil(t, err)
+
+			patch, err := sidecars.Patch()
+			require.Nil(t, err)
+			require.JSONEq(t, tc.result.(string), string(patch))
+		})
+	}
+
+	// A pod injected with the legacy prefix is uninjected with the configured one
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				"container-injector.uthng.me/inject": "true",
+				"container-injector.uthng.me/name":   "proxy",
+				"container-injector.uthng.me/image":  "envoyproxy/envoy",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "web"},
+			},
+		},
+	}
+
+	container, err := sidecar.NewContainer(pod)
+	require.Nil(t, err)
+
+	patch, err := container.Patch()
+	require.Nil(t, err)
+
+	injectedPod := applyPatch(t, pod, patch)
+	require.True(t, config.IsInjected(injectedPod))
+	require.Equal(t, []string{"proxy"}, config.GetStatus(injectedPod).Containers)
+
+	patch, err = config.Uninject(injectedPod)
+	require.Nil(t, err)
+
+	jsonPod, err := json.Marshal(pod)
+	require.Nil(t, err)
+
+	jsonUninjectedPod, err := json.Marshal(applyPatch(t, injectedPod, patch))
+	require.Nil(t, err)
+	require.JSONEq(t, string(jsonPod), string(jsonUninjectedPod))
+}
+
+func TestPatchImages(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		result      interface{}
+	}{
+		{
+			"OKSameImages",
+			map[string]string{
+				"container-injector.uthng.me/image":      "envoyproxy/envoy",
+				"container-injector.uthng.me/init.image": "busybox",
+			},
+			"",
+		},
+		{
+			"OKNewImages",
+			map[string]string{
+				"container-injector.uthng.me/image":      "envoyproxy/envoy:v1.14",
+				"container-injector.uthng.me/init.image": "busybox:1.31",
+			},
+			`[
+	{"op":"replace","path":"/spec/containers/1/image","value":"envoyproxy/envoy:v1.14"},
+	{"op":"replace","path":"/spec/initContainers/0/image","value":"busybox:1.31"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"ffc03f66f8c1c546"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}
+]`,
+		},
+		{
+			"OKOutdatedHash",
+			map[string]string{
+				"container-injector.uthng.me/image":       "envoyproxy/envoy",
+				"container-injector.uthng.me/init.image":  "busybox",
+				"container-injector.uthng.me/status-hash": "0123456789abcdef",
+			},
+			`[
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status","value":"injected"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-hash","value":"a0bdc3fdaef747c3"},
+	{"op":"add","path":"/metadata/annotations/container-injector.uthng.me~1status-version","value":"dev"}
+]`,
+		},
+		{
+			"OKNewContainer",
+			map[string]string{
+				"container-injector.uthng.me/image":      "envoyproxy/envoy",
+				"container-injector.uthng.me/init.image": "busybox",
+				"container-injector.uthng.me/logs.name":  "fluent-bit",
+				"container-injector.uthng.me/logs.image": "fluent/fluent-bit",
+			},
+			"",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			annotations := map[string]string{
+				"container-injector.uthng.me/inject":              "true",
+				"container-injector.uthng.me/name":                "proxy",
+				"container-injector.uthng.me/init.name":           "init",
+				"container-injector.uthng.me/init.init-container": "true",
+				"container-injector.uthng.me/status":              "injected",
+				"container-injector.uthng.me/injected-containers": "init,proxy",
+				"container-injector.uthng.me/status-hash":         "a0bdc3fdaef747c3",
+			}
+
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{},
+				},
+				Spec: corev1.PodSpec{
+					InitContainers: []corev1.Container{
+						{Name: "init", Image: "busybox"},
+					},
+					Containers: []corev1.Container{
+						{Name: "web"},
+						{Name: "proxy", Image: "envoyproxy/envoy"},
+					},
+				},
+			}
+
+			// The old pod is the one of the injection
+			old := pod.DeepCopy()
+			old.Annotations["container-injector.uthng.me/image"] = "envoyproxy/envoy"
+			old.Annotations["container-injector.uthng.me/init.image"] = "busybox"
+
+			for k, v := range annotations {
+				old.Annotations[k] = v
+				pod.Annotations[k] = v
+			}
+
+			for k, v := range tc.annotations {
+				pod.Annotations[k] = v
+			}
+
+			config := sidecar.DefaultConfig()
+			require.Equal(t, tc.name != "OKSameImages" && tc.name != "OKOutdatedHash", config.AnnotationsChanged(old, pod))
+
+			sidecars, err := sidecar.NewSidecars(pod)
+			require.Nil(t, err)
+
+			patch, err := sidecars.PatchImages()
+			require.Nil(t, err)
+
+			if tc.result.(string) == "" {
+				require.Empty(t, patch)
+				return
+			}
+
+			require.JSONEq(t, tc.result.(string), string(patch))
+		})
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	config := &sidecar.Config{
+		SidecarMode:              sidecar.SidecarModeClassic,
+		AnnotationPrefix:         "sidecar.example.com/",
+		LegacyAnnotationPrefixes: []string{"container-injector.uthng.me/"},
+	}
+
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		result      []string
+	}{
+		{
+			"OKNoWarning",
+			map[string]string{
+				"sidecar.example.com/inject":       "true",
+				"sidecar.example.com/on-collision": "skip",
+				"sidecar.example.com/name":         "proxy",
+				"sidecar.example.com/image":        "envoyproxy/envoy",
+				"sidecar.example.com/log.name":     "log",
+				"sidecar.example.com/log.image":    "busybox",
+				"other.example.com/name":           "other",
+			},
+			nil,
+		},
+		{
+			"OKDeprecatedAnnotation",
+			map[string]string{
+				"sidecar.example.com/inject":        "true",
+				"container-injector.uthng.me/name":  "proxy",
+				"container-injector.uthng.me/image": "envoyproxy/envoy",
+			},
+			[]string{
+				"annotation 'container-injector.uthng.me/image' is deprecated, use 'sidecar.example.com/image' instead",
+				"annotation 'container-injector.uthng.me/name' is deprecated, use 'sidecar.example.com/name' instead",
+			},
+		},
+		{
+			"OKUnknownAnnotation",
+			map[string]string{
+				"sidecar.example.com/inject":         "true",
+				"sidecar.example.com/name":           "proxy",
+				"sidecar.example.com/image":          "envoyproxy/envoy",
+				"sidecar.example.com/imag":           "envoyproxy/envoy",
+				"container-injector.uthng.me/memory": "64Mi",
+			},
+			[]string{
+				"annotation 'container-injector.uthng.me/memory' is deprecated, use 'sidecar.example.com/memory' instead",
+				"unknown annotation 'container-injector.uthng.me/memory' is ignored",
+				"unknown annotation 'sidecar.example.com/imag' is ignored",
+			},
+		},
+		{
+			"OKIgnoredSettings",
+			map[string]string{
+				"sidecar.example.com/inject":              "true",
+				"sidecar.example.com/name":                "proxy",
+				"sidecar.example.com/image":               "envoyproxy/envoy",
+				"sidecar.example.com/init-first":          "true",
+				"sidecar.example.com/init.name":           "init",
+				"sidecar.example.com/init.image":          "busybox",
+				"sidecar.example.com/init.init-container": "true",
+				"sidecar.example.com/init.sidecar-mode":   "native",
+			},
+			[]string{
+				"annotation 'sidecar.example.com/init-first' is ignored by regular containers",
+				"annotation 'sidecar.example.com/init.sidecar-mode' is ignored by init containers",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tc.annotations,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "web"},
+					},
+				},
+			}
+
+			sidecars, err := sidecar.NewSidecarsWithConfig(pod, config)
+			require.Nil(t, err)
+
+			warnings := append(config.Warnings(pod), sidecars.Warnings()...)
+			require.Equal(t, tc.result, warnings)
+		})
+	}
+}
+
+func TestOnErrorMode(t *testing.T) {
+	config := sidecar.DefaultConfig()
+	config.OnError = sidecar.OnErrorAllowSilently
+
+	require.Nil(t, config.Validate())
+
+	err := (&sidecar.Config{SidecarMode: sidecar.SidecarModeClassic, OnError: "allow"}).Validate()
+	require.Equal(t, "invalid failure mode 'allow': must be one of [deny allow-with-warning allow-silently]", err.Error())
+
+	testCases := []struct {
+		name      string
+		pod       map[string]string
+		namespace map[string]string
+		result    interface{}
+	}{
+		{
+			"OKServer",
+			nil,
+			nil,
+			sidecar.OnErrorAllowSilently,
+		},
+		{
+			"OKNamespace",
+			nil,
+			map[string]string{
+				sidecar.AnnotationContainerOnError: sidecar.OnErrorAllowWithWarning,
+			},
+			sidecar.OnErrorAllowWithWarning,
+		},
+		{
+			"OKPod",
+			map[string]string{
+				sidecar.AnnotationContainerOnError: sidecar.OnErrorDeny,
+			},
+			map[string]string{
+				sidecar.AnnotationContainerOnError: sidecar.OnErrorAllowWithWarning,
+			},
+			sidecar.OnErrorDeny,
+		},
+		{
+			"ErrPodInvalidMode",
+			map[string]string{
+				sidecar.AnnotationContainerOnError: "allow",
+			},
+			map[string]string{
+				sidecar.AnnotationContainerOnError: sidecar.OnErrorAllowWithWarning,
+			},
+			"invalid failure mode 'allow' in annotation 'container-injector.uthng.me/on-error' of the pod: must be one of [deny allow-with-warning allow-silently]",
+		},
+		{
+			"ErrNamespaceInvalidMode",
+			nil,
+			map[string]string{
+				sidecar.AnnotationContainerOnError: "warn",
+			},
+			"invalid failure mode 'warn' in annotation 'container-injector.uthng.me/on-error' of the namespace default: must be one of [deny allow-with-warning allow-silently]",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tc.pod,
+				},
+			}
+
+			namespace := &corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "default",
+					Annotations: tc.namespace,
+				},
+			}
+
+			mode, err := config.OnErrorMode(pod, func() *corev1.Namespace {
+				return namespace
+			})
+
+			if strings.HasPrefix(tc.name, "Err") {
+				require.NotNil(t, err)
+				require.Equal(t, tc.result.(string), err.Error())
+				return
+			}
+
+			require.Nil(t, err)
+			require.Equal(t, tc.result.(string), mode)
 		})
 	}
 }
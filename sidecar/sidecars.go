@@ -0,0 +1,608 @@
+package sidecar
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Sidecars defines all containers to be injected in the pod
+type Sidecars struct {
+	// Pod is the original Kubernetes pod spec.
+	Pod *corev1.Pod
+
+	// Containers are the containers to inject, one per annotation group.
+	// The default group, if any, comes first and the others are sorted by name.
+	Containers []*Container
+
+	// Patches are all the mutations we will make to the pod request.
+	Patches []patchOperation
+
+	// config is the server configuration of the injection.
+	config *Config
+
+	// annotations are the pod annotations in which the keys with
+	// a legacy prefix use the configured prefix.
+	annotations map[string]string
+}
+
+// NewSidecars creates the containers of all annotation groups. The default group
+// uses flat annotations such as "container-injector.uthng.me/image" while named
+// groups use annotations such as "container-injector.uthng.me/<group>.image".
+func NewSidecars(pod *corev1.Pod) (*Sidecars, error) {
+	return NewSidecarsWithConfig(pod, DefaultConfig())
+}
+
+// NewSidecarsWithConfig creates the containers of all annotation groups
+// using the server configuration for the values not set by annotations.
+func NewSidecarsWithConfig(pod *corev1.Pod, config *Config) (*Sidecars, error) {
+	s := &Sidecars{
+		Pod:         pod,
+		config:      config,
+		annotations: config.annotations(pod.Annotations),
+	}
+
+	groups, hasDefault := config.annotationGroups(s.annotations)
+
+	// Without named groups, the default group is mandatory
+	if hasDefault || len(groups) == 0 {
+		groups = append([]string{""}, groups...)
+	}
+
+	for _, group := range groups {
+		c, err := newContainer(pod, group, config)
+		if err != nil {
+			return nil, err
+		}
+
+		s.Containers = append(s.Containers, c)
+	}
+
+	if err := s.checkNames(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// LoadTemplates loads the templates of the containers configured
+// with a configmap using the given getter.
+func (s *Sidecars) LoadTemplates(get ConfigMapGetter) error {
+	for _, c := range s.Containers {
+		if c.ConfigMapName == "" {
+			continue
+		}
+
+		cm, err := get(c.ConfigMapName)
+		if err != nil {
+			return fmt.Errorf("error getting configmap '%s': %s", c.ConfigMapName, err)
+		}
+
+		if err := c.LoadTemplate(cm); err != nil {
+			return err
+		}
+	}
+
+	return s.checkNames()
+}
+
+// Patch creates the necessary pod patches to inject all containers.
+// Volumes declared by several groups are added only once.
+func (s *Sidecars) Patch() ([]byte, error) {
+	var patches []byte
+	var volumes []corev1.Volume
+
+	spec := s.Pod.Spec.DeepCopy()
+	annotations := map[string]string{}
+
+	injectedContainers := s.injectedNames(AnnotationContainerInjectedContainers)
+	injectedVolumes := s.injectedNames(AnnotationContainerInjectedVolumes)
+
+	if errs := s.resolveCollisions(); len(errs) > 0 {
+		return patches, errs.ToAggregate()
+	}
+
+	for _, c := range s.Containers {
+		vols, err := c.volumes()
+		if err != nil {
+			return patches, err
+		}
+
+		volumes, err = mergeVolumes(volumes, vols)
+		if err != nil {
+			return patches, err
+		}
+	}
+
+	// Containers and volumes of a previous injection which are not
+	// configured anymore are removed
+	stalePatches := s.removeStale(spec, injectedContainers, injectedVolumes, volumes)
+	s.Patches = append(s.Patches, stalePatches...)
+
+	// Volumes of a previous injection are replaced
+	var added []corev1.Volume
+
+	for _, v := range volumes {
+		if i := findVolume(spec.Volumes, v.Name); i >= 0 && injectedVolumes[v.Name] {
+			s.Patches = append(s.Patches, replaceValue(fmt.Sprintf("/spec/volumes/%d", i), v)...)
+			spec.Volumes[i] = v
+		} else {
+			added = append(added, v)
+		}
+	}
+
+	s.Patches = append(s.Patches, addVolumes(
+		spec.Volumes,
+		added,
+		"/spec/volumes")...)
+
+	spec.Volumes = append(spec.Volumes, added...)
+
+	// Application containers are patched before injecting containers
+	// so that their indexes are not shifted.
+	appPatches, err := s.patchAppVolumeMounts(spec)
+	if err != nil {
+		return patches, err
+	}
+
+	s.Patches = append(s.Patches, appPatches...)
+
+	for _, c := range s.Containers {
+		containerPatches, err := c.patch(spec, injectedContainers[c.Name])
+		if err != nil {
+			return patches, err
+		}
+
+		s.Patches = append(s.Patches, containerPatches...)
+	}
+
+	hash, err := s.hash(spec, volumes)
+	if err != nil {
+		return patches, err
+	}
+
+	// Nothing changed since the previous injection
+	if s.annotations[s.config.AnnotationKey(AnnotationContainerStatusHash)] == hash && s.injected(injectedContainers) && len(stalePatches) == 0 {
+		s.Patches = updateAnnotations(s.Pod.Annotations, map[string]string{
+			s.config.AnnotationKey(AnnotationContainerStatus): "injected",
+		})
+
+		return json.Marshal(s.Patches)
+	}
+
+	annotations[s.config.AnnotationKey(AnnotationContainerStatusHash)] = hash
+	annotations[s.config.AnnotationKey(AnnotationContainerStatusVersion)] = Version
+
+	// Record injected containers and volumes for a next injection
+	for _, c := range s.Containers {
+		injectedContainers[c.Name] = true
+	}
+
+	for _, v := range volumes {
+		injectedVolumes[v.Name] = true
+	}
+
+	s.recordNames(annotations, s.config.AnnotationKey(AnnotationContainerInjectedContainers), injectedContainers, func(name string) bool {
+		return findContainer(spec.InitContainers, name) >= 0 || findContainer(spec.Containers, name) >= 0
+	})
+
+	s.recordNames(annotations, s.config.AnnotationKey(AnnotationContainerInjectedVolumes), injectedVolumes, func(name string) bool {
+		return findVolume(spec.Volumes, name) >= 0
+	})
+
+	// Lists emptied by the removal of stale containers or volumes are removed
+	var emptied []string
+
+	for _, annotation := range []string{AnnotationContainerInjectedContainers, AnnotationContainerInjectedVolumes} {
+		key := s.config.AnnotationKey(annotation)
+		if v, ok := annotations[key]; ok && v == "" && len(stalePatches) > 0 {
+			delete(annotations, key)
+			emptied = append(emptied, key)
+		}
+	}
+
+	// Add annotations so that we know we're injected
+	annotations[s.config.AnnotationKey(AnnotationContainerStatus)] = "injected"
+
+	s.Patches = append(s.Patches, updateAnnotations(
+		s.Pod.Annotations,
+		annotations)...)
+
+	s.Patches = append(s.Patches, removeAnnotations(s.Pod.Annotations, emptied)...)
+
+	// Annotations recorded with a legacy prefix are replaced
+	s.Patches = append(s.Patches, removeAnnotations(
+		s.Pod.Annotations,
+		s.config.legacyKeys(statusAnnotations...))...)
+
+	// The error of a previous failed injection is removed
+	s.Patches = append(s.Patches, removeAnnotations(
+		s.Pod.Annotations,
+		[]string{s.config.AnnotationKey(AnnotationContainerInjectionError)})...)
+
+	// Generate the patch
+	if len(s.Patches) > 0 {
+		return json.Marshal(s.Patches)
+	}
+
+	return patches, nil
+}
+
+// removeStale creates the patches removing the containers and the volumes of
+// a previous injection which are not configured anymore, and the mounts of these
+// volumes in the other containers. The spec is updated with the patches.
+func (s *Sidecars) removeStale(spec *corev1.PodSpec, injectedContainers, injectedVolumes map[string]bool, volumes []corev1.Volume) []patchOperation {
+	var patches []patchOperation
+
+	containers := map[string]bool{}
+	for name := range injectedContainers {
+		containers[name] = true
+	}
+
+	for _, c := range s.Containers {
+		delete(containers, c.Name)
+	}
+
+	vols := map[string]bool{}
+	for name := range injectedVolumes {
+		vols[name] = true
+	}
+
+	for _, v := range volumes {
+		delete(vols, v.Name)
+	}
+
+	if len(containers) == 0 && len(vols) == 0 {
+		return nil
+	}
+
+	// Volume mounts are removed first so that container indexes are not shifted
+	for i := range spec.InitContainers {
+		if !containers[spec.InitContainers[i].Name] {
+			patches = append(patches, removeVolumeMounts(
+				spec.InitContainers[i].VolumeMounts,
+				vols,
+				fmt.Sprintf("/spec/initContainers/%d/volumeMounts", i))...)
+
+			spec.InitContainers[i].VolumeMounts = filterVolumeMounts(spec.InitContainers[i].VolumeMounts, vols)
+		}
+	}
+
+	for i := range spec.Containers {
+		if !containers[spec.Containers[i].Name] {
+			patches = append(patches, removeVolumeMounts(
+				spec.Containers[i].VolumeMounts,
+				vols,
+				fmt.Sprintf("/spec/containers/%d/volumeMounts", i))...)
+
+			spec.Containers[i].VolumeMounts = filterVolumeMounts(spec.Containers[i].VolumeMounts, vols)
+		}
+	}
+
+	patches = append(patches, removeContainers(spec.InitContainers, containers, "/spec/initContainers")...)
+	patches = append(patches, removeContainers(spec.Containers, containers, "/spec/containers")...)
+	patches = append(patches, removeVolumes(spec.Volumes, vols, "/spec/volumes")...)
+
+	spec.InitContainers = filterContainers(spec.InitContainers, containers)
+	spec.Containers = filterContainers(spec.Containers, containers)
+	spec.Volumes = filterVolumes(spec.Volumes, vols)
+
+	return patches
+}
+
+// PatchImages creates the patches updating the images of the containers of
+// a previous injection which are still in the pod, and the status recording
+// them. It is used when the pod is updated since the containers and the volumes
+// of a pod cannot be changed anymore.
+func (s *Sidecars) PatchImages() ([]byte, error) {
+	var volumes []corev1.Volume
+
+	spec := s.Pod.Spec.DeepCopy()
+
+	injectedContainers := s.injectedNames(AnnotationContainerInjectedContainers)
+
+	if errs := s.resolveCollisions(); len(errs) > 0 {
+		return nil, errs.ToAggregate()
+	}
+
+	for _, c := range s.Containers {
+		vols, err := c.volumes()
+		if err != nil {
+			return nil, err
+		}
+
+		volumes, err = mergeVolumes(volumes, vols)
+		if err != nil {
+			return nil, err
+		}
+
+		if !injectedContainers[c.Name] {
+			continue
+		}
+
+		container, err := c.createContainer()
+		if err != nil {
+			return nil, err
+		}
+
+		if i := findContainer(spec.InitContainers, c.Name); i >= 0 && spec.InitContainers[i].Image != container.Image {
+			s.Patches = append(s.Patches, replaceValue(fmt.Sprintf("/spec/initContainers/%d/image", i), container.Image)...)
+			spec.InitContainers[i].Image = container.Image
+		}
+
+		if i := findContainer(spec.Containers, c.Name); i >= 0 && spec.Containers[i].Image != container.Image {
+			s.Patches = append(s.Patches, replaceValue(fmt.Sprintf("/spec/containers/%d/image", i), container.Image)...)
+			spec.Containers[i].Image = container.Image
+		}
+	}
+
+	hash, err := s.hash(spec, volumes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing changed since the previous injection
+	if len(s.Patches) == 0 && s.annotations[s.config.AnnotationKey(AnnotationContainerStatusHash)] == hash &&
+		s.annotations[s.config.AnnotationKey(AnnotationContainerStatus)] == "injected" {
+		return nil, nil
+	}
+
+	s.Patches = append(s.Patches, updateAnnotations(s.Pod.Annotations, map[string]string{
+		s.config.AnnotationKey(AnnotationContainerStatus):        "injected",
+		s.config.AnnotationKey(AnnotationContainerStatusHash):    hash,
+		s.config.AnnotationKey(AnnotationContainerStatusVersion): Version,
+	})...)
+
+	return json.Marshal(s.Patches)
+}
+
+// patchAppVolumeMounts creates the patches adding the app volume mounts of all
+// injected containers to the existing containers and init containers of the pod.
+func (s *Sidecars) patchAppVolumeMounts(spec *corev1.PodSpec) ([]patchOperation, error) {
+	var patches []patchOperation
+
+	for _, c := range s.Containers {
+		mounts, err := c.parseAnnotationsAppVolumeMounts()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, mount := range mounts {
+			for i := range spec.InitContainers {
+				p, err := addAppVolumeMount(&spec.InitContainers[i], mount,
+					fmt.Sprintf("/spec/initContainers/%d/volumeMounts", i))
+				if err != nil {
+					return nil, err
+				}
+
+				patches = append(patches, p...)
+			}
+
+			for i := range spec.Containers {
+				p, err := addAppVolumeMount(&spec.Containers[i], mount,
+					fmt.Sprintf("/spec/containers/%d/volumeMounts", i))
+				if err != nil {
+					return nil, err
+				}
+
+				patches = append(patches, p...)
+			}
+		}
+	}
+
+	return patches, nil
+}
+
+// addAppVolumeMount adds the volume mount to the container if it is selected.
+// The mount path must not be already used in the container.
+func addAppVolumeMount(container *corev1.Container, mount appVolumeMount, base string) ([]patchOperation, error) {
+	if !mount.selects(container.Name) {
+		return nil, nil
+	}
+
+	for i, m := range container.VolumeMounts {
+		// Mounted by a previous injection
+		if m.MountPath == mount.MountPath && m.Name == mount.Name {
+			container.VolumeMounts[i] = mount.VolumeMount
+			return replaceValue(fmt.Sprintf("%s/%d", base, i), mount.VolumeMount), nil
+		}
+
+		if m.MountPath == mount.MountPath {
+			return nil, fmt.Errorf("mount path '%s' of volume '%s' is already used by volume '%s' in container '%s'",
+				mount.MountPath, mount.Name, m.Name, container.Name)
+		}
+	}
+
+	patches := addVolumeMounts(container.VolumeMounts, []corev1.VolumeMount{mount.VolumeMount}, base)
+	container.VolumeMounts = append(container.VolumeMounts, mount.VolumeMount)
+
+	return patches, nil
+}
+
+// hash returns the hash of the injected containers found in the spec, the volumes
+// and the app volume mounts.
+func (s *Sidecars) hash(spec *corev1.PodSpec, volumes []corev1.Volume) (string, error) {
+	i := &injection{
+		Volumes: volumes,
+	}
+
+	for _, c := range s.Containers {
+		if idx := findContainer(spec.InitContainers, c.Name); idx >= 0 {
+			i.Containers = append(i.Containers, spec.InitContainers[idx])
+		} else if idx := findContainer(spec.Containers, c.Name); idx >= 0 {
+			i.Containers = append(i.Containers, spec.Containers[idx])
+		}
+
+		mounts, err := c.parseAnnotationsAppVolumeMounts()
+		if err != nil {
+			return "", err
+		}
+
+		i.AppVolumeMounts = append(i.AppVolumeMounts, mounts...)
+	}
+
+	return i.hash()
+}
+
+// injected checks if all containers were injected by a previous injection
+// and are still in the pod.
+func (s *Sidecars) injected(injectedContainers map[string]bool) bool {
+	for _, c := range s.Containers {
+		if !injectedContainers[c.Name] {
+			return false
+		}
+
+		if findContainer(s.Pod.Spec.InitContainers, c.Name) < 0 && findContainer(s.Pod.Spec.Containers, c.Name) < 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// recordNames sets the annotation to the sorted list of names which are still in the pod.
+// The annotation is not added if the list is empty and it was not already in the pod.
+func (s *Sidecars) recordNames(annotations map[string]string, annotation string, names map[string]bool, present func(string) bool) {
+	var list []string
+
+	for name := range names {
+		if present(name) {
+			list = append(list, name)
+		}
+	}
+
+	sort.Strings(list)
+
+	if _, ok := s.annotations[annotation]; ok || len(list) > 0 {
+		annotations[annotation] = strings.Join(list, ",")
+	}
+}
+
+// injectedNames returns the names recorded in the annotation, given with
+// the default prefix, by a previous injection.
+func (s *Sidecars) injectedNames(annotation string) map[string]bool {
+	return injectedNames(s.annotations, s.config.AnnotationKey(annotation))
+}
+
+// injectedNames returns the names recorded in the annotation by a previous injection.
+func injectedNames(annotations map[string]string, key string) map[string]bool {
+	names := map[string]bool{}
+
+	for _, name := range splitList(annotations[key]) {
+		names[name] = true
+	}
+
+	return names
+}
+
+// filterContainers returns the containers whose name is not in names. The result
+// is nil if none is left, as the array removed by removeContainers.
+func filterContainers(containers []corev1.Container, names map[string]bool) []corev1.Container {
+	var result []corev1.Container
+
+	for _, c := range containers {
+		if !names[c.Name] {
+			result = append(result, c)
+		}
+	}
+
+	return result
+}
+
+// filterVolumes returns the volumes whose name is not in names.
+func filterVolumes(volumes []corev1.Volume, names map[string]bool) []corev1.Volume {
+	var result []corev1.Volume
+
+	for _, v := range volumes {
+		if !names[v.Name] {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
+
+// filterVolumeMounts returns the mounts of the volumes whose name is not in names.
+func filterVolumeMounts(mounts []corev1.VolumeMount, names map[string]bool) []corev1.VolumeMount {
+	var result []corev1.VolumeMount
+
+	for _, m := range mounts {
+		if !names[m.Name] {
+			result = append(result, m)
+		}
+	}
+
+	return result
+}
+
+// findContainer returns the index of the container with the given name or -1.
+func findContainer(containers []corev1.Container, name string) int {
+	for i, container := range containers {
+		if container.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// findVolume returns the index of the volume with the given name or -1.
+func findVolume(volumes []corev1.Volume, name string) int {
+	for i, volume := range volumes {
+		if volume.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// checkNames verifies that container names are unique among groups.
+// Containers whose name comes from a template not loaded yet are skipped.
+func (s *Sidecars) checkNames() error {
+	names := map[string]string{}
+
+	for _, c := range s.Containers {
+		if c.Name == "" {
+			continue
+		}
+
+		if other, ok := names[c.Name]; ok {
+			return fmt.Errorf("container name '%s' is used by groups '%s' and '%s'", c.Name, other, c.groupName())
+		}
+
+		names[c.Name] = c.groupName()
+	}
+
+	return nil
+}
+
+// mergeVolumes appends the volumes to the target if they are not already there.
+// A volume already present with a different definition is an error.
+func mergeVolumes(target, volumes []corev1.Volume) ([]corev1.Volume, error) {
+	for _, v := range volumes {
+		found := false
+
+		for _, t := range target {
+			if t.Name != v.Name {
+				continue
+			}
+
+			if !reflect.DeepEqual(t, v) {
+				return nil, fmt.Errorf("volume '%s' is declared several times with different sources", v.Name)
+			}
+
+			found = true
+		}
+
+		if !found {
+			target = append(target, v)
+		}
+	}
+
+	return target, nil
+}
@@ -0,0 +1,79 @@
+package sidecar
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Version is the version of the container-injector recorded in injected pods.
+// It is set at build time.
+var Version = "dev"
+
+// Status is the injection status recorded in the annotations of a pod.
+type Status struct {
+	// Status is "injected" once the pod is injected.
+	Status string
+
+	// Version is the version of the container-injector which injected the pod.
+	Version string
+
+	// Hash is the hash of the injected containers, volumes and volume mounts.
+	Hash string
+
+	// Containers are the names of the injected containers.
+	Containers []string
+
+	// Volumes are the names of the injected volumes.
+	Volumes []string
+}
+
+// statusAnnotations are the annotations recording the injection in the pod.
+var statusAnnotations = []string{
+	AnnotationContainerInjectedContainers,
+	AnnotationContainerInjectedVolumes,
+	AnnotationContainerStatus,
+	AnnotationContainerStatusHash,
+	AnnotationContainerStatusVersion,
+	AnnotationContainerInjectionError,
+}
+
+// GetStatus returns the injection status recorded in the annotations of the pod.
+func GetStatus(pod *corev1.Pod) *Status {
+	return DefaultConfig().GetStatus(pod)
+}
+
+// GetStatus returns the injection status recorded in the annotations of the pod
+// with the configured prefix or else with a legacy one.
+func (c *Config) GetStatus(pod *corev1.Pod) *Status {
+	annotations := c.annotations(pod.Annotations)
+
+	return &Status{
+		Status:     annotations[c.AnnotationKey(AnnotationContainerStatus)],
+		Version:    annotations[c.AnnotationKey(AnnotationContainerStatusVersion)],
+		Hash:       annotations[c.AnnotationKey(AnnotationContainerStatusHash)],
+		Containers: splitList(annotations[c.AnnotationKey(AnnotationContainerInjectedContainers)]),
+		Volumes:    splitList(annotations[c.AnnotationKey(AnnotationContainerInjectedVolumes)]),
+	}
+}
+
+// injection is the effective result of an injection whose hash is recorded.
+type injection struct {
+	Containers      []corev1.Container `json:"containers"`
+	Volumes         []corev1.Volume    `json:"volumes,omitempty"`
+	AppVolumeMounts []appVolumeMount   `json:"appVolumeMounts,omitempty"`
+}
+
+// hash returns the first 16 hexadecimal characters of the sha256 of the injection.
+func (i *injection) hash() (string, error) {
+	data, err := json.Marshal(i)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])[:16], nil
+}
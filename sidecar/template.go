@@ -0,0 +1,150 @@
+package sidecar
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// ConfigMapKeyContainer is the key of the configmap containing the
+	// yaml or json definition of the container template.
+	ConfigMapKeyContainer = "container"
+
+	// ConfigMapKeyVolumes is the key of the configmap containing the
+	// yaml or json list of volumes used by the container template.
+	ConfigMapKeyVolumes = "volumes"
+)
+
+// Template is a container definition loaded from a configmap.
+type Template struct {
+	// Container is the base definition of the container to inject.
+	Container corev1.Container
+
+	// Volumes are the volumes to add to the pod for the container.
+	Volumes []corev1.Volume
+}
+
+// ConfigMapGetter returns the configmap of the given name
+// in the namespace of the pod.
+type ConfigMapGetter func(name string) (*corev1.ConfigMap, error)
+
+// LoadTemplate parses the container template of the configmap.
+// The name and the image of the template are used if they are not
+// set by annotations.
+func (c *Container) LoadTemplate(cm *corev1.ConfigMap) error {
+	t := &Template{}
+
+	data, ok := cm.Data[ConfigMapKeyContainer]
+	if !ok {
+		return fmt.Errorf("key '%s' not found in configmap '%s'", ConfigMapKeyContainer, cm.Name)
+	}
+
+	if err := yaml.Unmarshal([]byte(data), &t.Container); err != nil {
+		return fmt.Errorf("error parsing key '%s' of configmap '%s': %s", ConfigMapKeyContainer, cm.Name, err)
+	}
+
+	if data, ok := cm.Data[ConfigMapKeyVolumes]; ok {
+		if err := yaml.Unmarshal([]byte(data), &t.Volumes); err != nil {
+			return fmt.Errorf("error parsing key '%s' of configmap '%s': %s", ConfigMapKeyVolumes, cm.Name, err)
+		}
+	}
+
+	return c.setTemplate(t, fmt.Sprintf("configmap '%s'", cm.Name))
+}
+
+// setTemplate uses the template for the container. The name and the image
+// of the template are used if they are not set by annotations.
+func (c *Container) setTemplate(t *Template, source string) error {
+	c.Template = t
+
+	if c.Name == "" {
+		c.Name = t.Container.Name
+	}
+
+	if c.ImageName == "" {
+		c.ImageName = t.Container.Image
+	}
+
+	if c.Name == "" {
+		return fmt.Errorf("container name not found in annotation '%s' nor %s",
+			c.annotationKey(AnnotationContainerName), source)
+	}
+
+	if c.ImageName == "" {
+		return fmt.Errorf("container image not found in annotation '%s' nor %s",
+			c.annotationKey(AnnotationContainerImage), source)
+	}
+
+	return nil
+}
+
+// mergeEnvVars overrides the environment variables of the base by the ones
+// with the same name and appends the others.
+func mergeEnvVars(base, envs []corev1.EnvVar) []corev1.EnvVar {
+	result := append([]corev1.EnvVar(nil), base...)
+
+	for _, env := range envs {
+		found := false
+
+		for i := range result {
+			if result[i].Name == env.Name {
+				result[i] = env
+				found = true
+			}
+		}
+
+		if !found {
+			result = append(result, env)
+		}
+	}
+
+	return result
+}
+
+// mergeVolumeMounts overrides the volume mounts of the base by the ones
+// of the same volume and appends the others.
+func mergeVolumeMounts(base, mounts []corev1.VolumeMount) []corev1.VolumeMount {
+	result := append([]corev1.VolumeMount(nil), base...)
+
+	for _, mount := range mounts {
+		found := false
+
+		for i := range result {
+			if result[i].Name == mount.Name {
+				result[i] = mount
+				found = true
+			}
+		}
+
+		if !found {
+			result = append(result, mount)
+		}
+	}
+
+	return result
+}
+
+// mergeVolumeSources overrides the volumes of the base by the ones
+// with the same name and appends the others.
+func mergeVolumeSources(base, volumes []corev1.Volume) []corev1.Volume {
+	result := append([]corev1.Volume(nil), base...)
+
+	for _, volume := range volumes {
+		found := false
+
+		for i := range result {
+			if result[i].Name == volume.Name {
+				result[i] = volume
+				found = true
+			}
+		}
+
+		if !found {
+			result = append(result, volume)
+		}
+	}
+
+	return result
+}
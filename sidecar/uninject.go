@@ -0,0 +1,78 @@
+package sidecar
+
+import (
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// IsInjected checks if the pod records containers or volumes of a previous injection.
+func IsInjected(pod *corev1.Pod) bool {
+	return DefaultConfig().IsInjected(pod)
+}
+
+// IsInjected checks if the pod records containers or volumes of a previous injection
+// with the configured prefix or else with a legacy one.
+func (c *Config) IsInjected(pod *corev1.Pod) bool {
+	_, containers := c.Annotation(pod, AnnotationContainerInjectedContainers)
+	_, volumes := c.Annotation(pod, AnnotationContainerInjectedVolumes)
+
+	return containers || volumes
+}
+
+// Uninject creates the patches removing the containers and volumes recorded by
+// a previous injection, the mounts of these volumes in the application containers
+// and the annotations added by the injection.
+func Uninject(pod *corev1.Pod) ([]byte, error) {
+	return DefaultConfig().Uninject(pod)
+}
+
+// Uninject removes a previous injection recorded in the annotations with the
+// configured prefix or else with a legacy one. Annotations with both are removed.
+func (c *Config) Uninject(pod *corev1.Pod) ([]byte, error) {
+	var patches []patchOperation
+
+	podAnnotations := c.annotations(pod.Annotations)
+	containers := injectedNames(podAnnotations, c.AnnotationKey(AnnotationContainerInjectedContainers))
+	volumes := injectedNames(podAnnotations, c.AnnotationKey(AnnotationContainerInjectedVolumes))
+
+	// Volume mounts are removed first so that container indexes are not shifted
+	for i, container := range pod.Spec.InitContainers {
+		if !containers[container.Name] {
+			patches = append(patches, removeVolumeMounts(
+				container.VolumeMounts,
+				volumes,
+				fmt.Sprintf("/spec/initContainers/%d/volumeMounts", i))...)
+		}
+	}
+
+	for i, container := range pod.Spec.Containers {
+		if !containers[container.Name] {
+			patches = append(patches, removeVolumeMounts(
+				container.VolumeMounts,
+				volumes,
+				fmt.Sprintf("/spec/containers/%d/volumeMounts", i))...)
+		}
+	}
+
+	patches = append(patches, removeContainers(pod.Spec.InitContainers, containers, "/spec/initContainers")...)
+	patches = append(patches, removeContainers(pod.Spec.Containers, containers, "/spec/containers")...)
+	patches = append(patches, removeVolumes(pod.Spec.Volumes, volumes, "/spec/volumes")...)
+
+	var annotations []string
+
+	for _, annotation := range statusAnnotations {
+		annotations = append(annotations, c.AnnotationKey(annotation))
+	}
+
+	annotations = append(annotations, c.legacyKeys(statusAnnotations...)...)
+
+	patches = append(patches, removeAnnotations(pod.Annotations, annotations)...)
+
+	if len(patches) == 0 {
+		return nil, nil
+	}
+
+	return json.Marshal(patches)
+}
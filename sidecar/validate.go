@@ -0,0 +1,285 @@
+package sidecar
+
+import (
+	"errors"
+	"path"
+	"regexp"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// annotationsPath is the field path of the pod annotations. Validation errors
+// are reported on the annotation that configures the invalid value.
+var annotationsPath = field.NewPath("metadata", "annotations")
+
+// reImageReference matches a docker image reference such as
+// "registry.example.com:5000/org/image:tag@sha256:<digest>".
+var reImageReference = func() *regexp.Regexp {
+	nameComponent := `[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*`
+	domainComponent := `(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])`
+	domain := domainComponent + `(?:\.` + domainComponent + `)*(?::[0-9]+)?`
+	name := `(?:` + domain + `/)?` + nameComponent + `(?:/` + nameComponent + `)*`
+	tag := `[\w][\w.-]{0,127}`
+	digest := `[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}`
+
+	return regexp.MustCompile(`^` + name + `(?::` + tag + `)?(?:@` + digest + `)?$`)
+}()
+
+var pullPolicies = []string{
+	string(corev1.PullAlways),
+	string(corev1.PullIfNotPresent),
+	string(corev1.PullNever),
+}
+
+// Validate verifies the coherence of all parameters specified by annotations.
+// It must be called after loading the template. All problems are returned
+// together as an aggregate of errors addressed by annotation.
+func (c *Container) Validate() error {
+	return c.sidecars().Validate()
+}
+
+// Validate verifies the parameters of all containers before patching the pod.
+// Volume mounts can refer to the volumes of the pod or of any injected container.
+func (s *Sidecars) Validate() error {
+	// Collisions with the pod are resolved or reported first
+	errs := s.resolveCollisions()
+
+	volumes := map[string]bool{}
+	names := map[string]bool{}
+
+	for _, v := range s.Pod.Spec.Volumes {
+		volumes[v.Name] = true
+	}
+
+	for _, c := range s.Containers {
+		vols, err := c.volumes()
+		if err != nil {
+			// Volumes are unknown so their existence cannot be checked
+			errs = append(errs, c.fieldError(err))
+			volumes = nil
+		}
+
+		for _, v := range vols {
+			if volumes != nil {
+				volumes[v.Name] = true
+			}
+		}
+	}
+
+	for _, c := range s.Containers {
+		if names[c.Name] {
+			errs = append(errs, field.Duplicate(c.fieldPath(AnnotationContainerName), c.Name))
+		}
+
+		names[c.Name] = true
+
+		errs = append(errs, c.validate(volumes)...)
+	}
+
+	return errs.ToAggregate()
+}
+
+// validate returns all the errors of the container parameters.
+func (c *Container) validate(volumes map[string]bool) field.ErrorList {
+	var errs field.ErrorList
+
+	for _, msg := range validation.IsDNS1123Label(c.Name) {
+		errs = append(errs, field.Invalid(c.fieldPath(AnnotationContainerName), c.Name, msg))
+	}
+
+	if !reImageReference.MatchString(c.ImageName) {
+		errs = append(errs, field.Invalid(c.fieldPath(AnnotationContainerImage), c.ImageName, "must be a valid image reference"))
+	}
+
+	if c.ImagePullPolicy != "" {
+		valid := false
+
+		for _, policy := range pullPolicies {
+			if c.ImagePullPolicy == policy {
+				valid = true
+			}
+		}
+
+		if !valid {
+			errs = append(errs, field.NotSupported(c.fieldPath(AnnotationContainerPullPolicy), c.ImagePullPolicy, pullPolicies))
+		}
+	}
+
+	if !isSidecarMode(c.SidecarMode) {
+		errs = append(errs, field.NotSupported(c.fieldPath(AnnotationContainerSidecarMode), c.SidecarMode, sidecarModes))
+	}
+
+	if _, err := c.startupProbe(); err != nil {
+		errs = append(errs, c.fieldError(err))
+	} else if c.StartupProbe != "" && c.InitContainer {
+		errs = append(errs, field.Invalid(c.fieldPath(AnnotationContainerStartupProbe), c.StartupProbe, "is not supported by init containers"))
+	}
+
+	if c.Command != "" {
+		if _, err := splitWords(c.Command); err != nil {
+			errs = append(errs, field.Invalid(c.fieldPath(AnnotationContainerCommand), c.Command, err.Error()))
+		}
+	}
+
+	if c.Args != "" {
+		if _, err := splitWords(c.Args); err != nil {
+			errs = append(errs, field.Invalid(c.fieldPath(AnnotationContainerArgs), c.Args, err.Error()))
+		}
+	}
+
+	errs = append(errs, c.validateResources()...)
+
+	if _, err := c.securityContext(); err != nil {
+		errs = append(errs, c.fieldError(err))
+	}
+
+	if _, err := c.parseAnnotationsEnvVars(); err != nil {
+		errs = append(errs, c.fieldError(err))
+	}
+
+	errs = append(errs, c.validateVolumeMounts(volumes)...)
+	errs = append(errs, c.validateOverrides()...)
+
+	return errs
+}
+
+// validateResources checks every quantity so that all invalid ones are reported.
+// Requests are compared to limits only when all quantities are valid.
+func (c *Container) validateResources() field.ErrorList {
+	var errs field.ErrorList
+
+	quantities := []resourceAnnotation{
+		{corev1.ResourceCPU, AnnotationContainerLimitsCPU, c.LimitsCPU},
+		{corev1.ResourceMemory, AnnotationContainerLimitsMem, c.LimitsMem},
+		{corev1.ResourceEphemeralStorage, AnnotationContainerLimitsEphemeralStorage, c.LimitsEphemeralStorage},
+		{corev1.ResourceCPU, AnnotationContainerRequestsCPU, c.RequestsCPU},
+		{corev1.ResourceMemory, AnnotationContainerRequestsMem, c.RequestsMem},
+		{corev1.ResourceEphemeralStorage, AnnotationContainerRequestsEphemeralStorage, c.RequestsEphemeralStorage},
+	}
+
+	for _, q := range quantities {
+		if q.value == "" {
+			continue
+		}
+
+		if _, err := resource.ParseQuantity(q.value); err != nil {
+			errs = append(errs, field.Invalid(c.fieldPath(q.annotation), q.value, err.Error()))
+		}
+	}
+
+	extended := []struct {
+		annotation string
+		list       map[string]string
+	}{
+		{AnnotationContainerLimits, c.LimitsExtended},
+		{AnnotationContainerRequests, c.RequestsExtended},
+	}
+
+	for _, e := range extended {
+		for _, name := range sortedKeys(e.list) {
+			if _, err := resource.ParseQuantity(e.list[name]); err != nil {
+				errs = append(errs, field.Invalid(c.fieldPath(e.annotation).Key(name), e.list[name], err.Error()))
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		if _, err := c.resources(); err != nil {
+			errs = append(errs, c.fieldError(err))
+		}
+	}
+
+	return errs
+}
+
+// validateVolumeMounts checks the names and paths of the volume mounts of the
+// container and of the application containers. Their volumes must exist unless
+// volumes is nil.
+func (c *Container) validateVolumeMounts(volumes map[string]bool) field.ErrorList {
+	var errs field.ErrorList
+
+	// Errors of volume sources are reported with the volumes of the pod
+	sources, _ := c.parseAnnotationsVolumeSources()
+
+	for _, v := range sources {
+		fldPath := annotationsPath.Key(c.annotationKey(AnnotationContainerVolumeSource) + "-" + v.Name)
+
+		for _, msg := range validation.IsDNS1123Label(v.Name) {
+			errs = append(errs, field.Invalid(fldPath, v.Name, msg))
+		}
+	}
+
+	mounts, err := c.parseAnnotationsVolumeMounts()
+	if err != nil {
+		errs = append(errs, c.fieldError(err))
+	}
+
+	for _, m := range mounts {
+		fldPath := annotationsPath.Key(c.annotationKey(AnnotationContainerVolumeMount) + "-" + m.Name)
+		m.Name = c.volumeName(m.Name)
+		errs = append(errs, validateVolumeMount(fldPath, m, volumes)...)
+	}
+
+	appMounts, err := c.parseAnnotationsAppVolumeMounts()
+	if err != nil {
+		errs = append(errs, c.fieldError(err))
+	}
+
+	for _, m := range appMounts {
+		fldPath := annotationsPath.Key(c.annotationKey(AnnotationContainerAppVolumeMount) + "-" + m.Name)
+		errs = append(errs, validateVolumeMount(fldPath, m.VolumeMount, volumes)...)
+	}
+
+	if c.TLSSecret != "" && !path.IsAbs(c.TLSMountPath) {
+		errs = append(errs, field.Invalid(c.fieldPath(AnnotationContainerTLSMountPath), c.TLSMountPath, "must be an absolute path"))
+	}
+
+	if _, ok := c.annotation(AnnotationContainerServiceAccountTokenPath); ok && c.ServiceAccountToken != "" && !path.IsAbs(c.ServiceAccountPath) {
+		errs = append(errs, field.Invalid(c.fieldPath(AnnotationContainerServiceAccountTokenPath), c.ServiceAccountPath, "must be an absolute path"))
+	}
+
+	return errs
+}
+
+func validateVolumeMount(fldPath *field.Path, mount corev1.VolumeMount, volumes map[string]bool) field.ErrorList {
+	var errs field.ErrorList
+
+	for _, msg := range validation.IsDNS1123Label(mount.Name) {
+		errs = append(errs, field.Invalid(fldPath, mount.Name, msg))
+	}
+
+	if volumes != nil && !volumes[mount.Name] {
+		errs = append(errs, field.NotFound(fldPath, mount.Name))
+	}
+
+	if !path.IsAbs(mount.MountPath) {
+		errs = append(errs, field.Invalid(fldPath, mount.MountPath, "must be an absolute path"))
+	}
+
+	return errs
+}
+
+// fieldPath returns the field path of the annotation for the container group.
+func (c *Container) fieldPath(annotation string) *field.Path {
+	return annotationsPath.Key(c.annotationKey(annotation))
+}
+
+// fieldError converts an error returned while parsing annotations
+// to a validation error.
+func (c *Container) fieldError(err error) *field.Error {
+	var valueErr *annotationValueError
+
+	if errors.As(err, &valueErr) {
+		value, ok := c.annotations[valueErr.annotation]
+		if !ok {
+			value = c.Annotations[valueErr.annotation]
+		}
+
+		return field.Invalid(annotationsPath.Key(valueErr.annotation), value, valueErr.err.Error())
+	}
+
+	return field.InternalError(annotationsPath, err)
+}
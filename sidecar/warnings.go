@@ -0,0 +1,94 @@
+package sidecar
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// podLevelAnnotations are the annotations configuring the whole injection
+// or recording it, as opposed to the annotations of a container.
+var podLevelAnnotations = append([]string{
+	AnnotationContainerInject,
+	AnnotationContainerOnCollision,
+	AnnotationContainerOnError,
+}, statusAnnotations...)
+
+// Warnings returns the warnings about the annotations of the pod: annotations
+// with a legacy prefix, which are deprecated, and unknown annotations with
+// the configured prefix, which are ignored.
+func (c *Config) Warnings(pod *corev1.Pod) []string {
+	var warnings []string
+
+	for _, k := range sortedKeys(pod.Annotations) {
+		key := k
+
+		if legacy, ok := c.legacyPrefix(k); ok {
+			key = c.prefix() + strings.TrimPrefix(k, legacy)
+			warnings = append(warnings, fmt.Sprintf("annotation '%s' is deprecated, use '%s' instead", k, key))
+		}
+
+		if strings.HasPrefix(key, c.prefix()) && !c.isKnownAnnotation(key) {
+			warnings = append(warnings, fmt.Sprintf("unknown annotation '%s' is ignored", k))
+		}
+	}
+
+	return warnings
+}
+
+// HasAnnotations checks if the pod has annotations configuring the injection
+// with the configured prefix or with a legacy one.
+func (c *Config) HasAnnotations(pod *corev1.Pod) bool {
+	return len(c.injectionAnnotations(pod)) > 0
+}
+
+// isKnownAnnotation checks if the key, with the configured prefix,
+// is an annotation of the pod or of a container group.
+func (c *Config) isKnownAnnotation(key string) bool {
+	for _, annotation := range podLevelAnnotations {
+		if key == c.AnnotationKey(annotation) {
+			return true
+		}
+	}
+
+	if _, ok := c.annotationGroup(key); ok {
+		return true
+	}
+
+	return c.isContainerAnnotation(key)
+}
+
+// Warnings returns the warnings about the annotations of the containers
+// which are ignored because of other settings.
+func (s *Sidecars) Warnings() []string {
+	var warnings []string
+
+	for _, c := range s.Containers {
+		warnings = append(warnings, c.warnings()...)
+	}
+
+	return warnings
+}
+
+// warnings returns the warnings about the annotations of the container
+// which are ignored because of other settings.
+func (c *Container) warnings() []string {
+	var warnings []string
+
+	if _, ok := c.annotation(AnnotationContainerSidecarMode); ok && c.InitContainer {
+		warnings = append(warnings, fmt.Sprintf("annotation '%s' is ignored by init containers",
+			c.annotationKey(AnnotationContainerSidecarMode)))
+	}
+
+	if !c.injectedAsInit() {
+		for _, annotation := range []string{AnnotationContainerInitFirst, AnnotationContainerInitPosition} {
+			if _, ok := c.annotation(annotation); ok {
+				warnings = append(warnings, fmt.Sprintf("annotation '%s' is ignored by regular containers",
+					c.annotationKey(annotation)))
+			}
+		}
+	}
+
+	return warnings
+}
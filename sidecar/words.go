@@ -0,0 +1,129 @@
+package sidecar
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// reShellScriptOption matches the options of a shell ending with "-c"
+// such as "-c" or "-ec".
+var reShellScriptOption = regexp.MustCompile(`^-[a-zA-Z]*c$`)
+
+// splitWords parses the value of a command or args annotation. A json array
+// of strings is used verbatim. Values which are not json are split into words
+// following the POSIX shell rules for quotes and backslashes, so that shell
+// commands such as "[ -f /ready ]" are supported. No expansion is performed.
+func splitWords(value string) ([]string, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), "[") && json.Valid([]byte(value)) {
+		var words []string
+
+		if err := json.Unmarshal([]byte(value), &words); err != nil {
+			return nil, fmt.Errorf("'%s' must be a json array of strings", value)
+		}
+
+		return words, nil
+	}
+
+	return splitShellWords(value)
+}
+
+// splitArgs parses the value of an args annotation like splitWords. When the
+// command ends with a "-c" option of a shell, a multi-line value such as a YAML
+// block is the script run by the shell and is kept as a single argument.
+func splitArgs(value string, command []string) ([]string, error) {
+	args, err := splitWords(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) > 1 && len(command) > 0 && reShellScriptOption.MatchString(command[len(command)-1]) &&
+		strings.Contains(strings.TrimSpace(value), "\n") && !json.Valid([]byte(value)) {
+		return []string{value}, nil
+	}
+
+	return args, nil
+}
+
+// splitShellWords splits the string into words as a POSIX shell does.
+// Single quotes keep every character literally, double quotes only allow
+// escaping '$', '`', '"', '\' and newline with a backslash. Outside quotes,
+// a backslash escapes the next character and a backslash-newline is removed.
+func splitShellWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+
+	inWord := false
+	runes := []rune(s)
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch {
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case r == '\\':
+			i++
+			if i == len(runes) {
+				return nil, fmt.Errorf("unterminated escape at end of '%s'", s)
+			}
+
+			if runes[i] != '\n' {
+				word.WriteRune(runes[i])
+				inWord = true
+			}
+		case r == '\'':
+			end := indexRune(runes, i+1, '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote in '%s'", s)
+			}
+
+			word.WriteString(string(runes[i+1 : end]))
+			inWord = true
+			i = end
+		case r == '"':
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) && strings.ContainsRune("$`\"\\\n", runes[i+1]) {
+					i++
+					if runes[i] == '\n' {
+						continue
+					}
+				}
+
+				word.WriteRune(runes[i])
+			}
+
+			if i == len(runes) {
+				return nil, fmt.Errorf("unterminated double quote in '%s'", s)
+			}
+
+			inWord = true
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
+
+// indexRune returns the index of the first r in runes from start or -1.
+func indexRune(runes []rune, start int, r rune) int {
+	for i := start; i < len(runes); i++ {
+		if runes[i] == r {
+			return i
+		}
+	}
+
+	return -1
+}